@@ -11,6 +11,11 @@ GOARCH="${GOARCH:-amd64}"
 GOARM="${GOARM:-}"
 CGO_ENABLED="${CGO_ENABLED:-0}"
 
+# stamped into the binary, shown by --version and /version
+VERSION="${VERSION:-dev}"
+COMMIT="${COMMIT:-}"
+BUILD_DATE="${BUILD_DATE:-$(date -u +%Y-%m-%dT%H:%M:%SZ)}"
+
 HOST_UID="${HOST_UID:-}"
 HOST_GID="${HOST_GID:-}"
 
@@ -20,12 +25,12 @@ cp -a "${SRC_DIR}/." /work/src || true
 cd /work/src
 
 if [ ! -f go.mod ]; then
-  printf "module buildtmp\n\ngo 1.22\n" > go.mod
+  printf "module buildtmp\n\ngo 1.24\n" > go.mod
 fi
 
 go mod tidy || true
 
-echo "==> Building $OUTPUT ($GOOS/$GOARCH${GOARM:+/v$GOARM}) from $MAIN"
+echo "==> Building $OUTPUT $VERSION ($GOOS/$GOARCH${GOARM:+/v$GOARM}) from $MAIN"
 
 # We form the env carefully so that the GOARM is not passed empty.
 ENV_VARS="GOOS=$GOOS GOARCH=$GOARCH CGO_ENABLED=$CGO_ENABLED"
@@ -34,7 +39,7 @@ ENV_VARS="GOOS=$GOOS GOARCH=$GOARCH CGO_ENABLED=$CGO_ENABLED"
 # shellcheck disable=SC2086
 env $ENV_VARS \
   go build -trimpath \
-    -ldflags="-s -w -extldflags '-static'" \
+    -ldflags="-s -w -extldflags '-static' -X main.version=${VERSION} -X main.commit=${COMMIT} -X main.buildDate=${BUILD_DATE}" \
     -o "${OUT_DIR}/${OUTPUT}" "${MAIN}"
 
 chmod +x "${OUT_DIR}/${OUTPUT}"
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// accessLog writes one line per HTTP request, whatever came of it
+// (ACCESS_LOG), apart from the app log.
+type accessLog struct {
+	mu   sync.Mutex
+	w    io.Writer
+	tmpl *template.Template // nil: JSON lines
+}
+
+// accessEntry is what access log templates see.
+type accessEntry struct {
+	RemoteIP   string    `json:"remote_ip"`
+	Time       time.Time `json:"time"` // when the request came in
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"` // as sent, with the query
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"` // of the response body, as sent
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	RequestID  string    `json:"request_id"`
+	Endpoint   string    `json:"endpoint,omitempty"`  // uri template, empty for other paths
+	ExitCode   *int      `json:"exit_code,omitempty"` // if a script ran in the request
+}
+
+// the formats ACCESS_LOG_FORMAT knows by name, as Apache writes them
+var accessFormats = map[string]string{
+	"common":   `{{.RemoteIP}} - - [{{clftime .Time}}] "{{esc .Method}} {{esc .URI}} {{esc .Proto}}" {{.Status}} {{dash .Bytes}}`,
+	"combined": `{{.RemoteIP}} - - [{{clftime .Time}}] "{{esc .Method}} {{esc .URI}} {{esc .Proto}}" {{.Status}} {{dash .Bytes}} "{{dash (esc .Referer)}}" "{{dash (esc .UserAgent)}}"`,
+}
+
+var accessFuncs = template.FuncMap{
+	"clftime": func(t time.Time) string { return t.Format("02/Jan/2006:15:04:05 -0700") },
+	// esc makes a client-sent value safe inside quotes on one line
+	"esc": func(s string) string {
+		var b strings.Builder
+		for i := 0; i < len(s); i++ {
+			switch c := s[i]; {
+			case c == '"' || c == '\\':
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			case c < 0x20 || c >= 0x7f:
+				fmt.Fprintf(&b, `\x%02x`, c)
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return b.String()
+	},
+	// dash stands in for an empty value
+	"dash": func(v any) any {
+		switch v {
+		case "", 0, int64(0):
+			return "-"
+		}
+		return v
+	},
+}
+
+// newAccessLog opens dest ("-" or "stdout", "stderr", or a file appended
+// to and rotated like LOG_FILE) with format: common, combined, json, or
+// a text/template over accessEntry.
+func newAccessLog(dest, format string) (*accessLog, error) {
+	a := &accessLog{}
+	if format != "json" {
+		src, ok := accessFormats[format]
+		if !ok {
+			src = format
+		}
+		t, err := template.New("access").Funcs(accessFuncs).Parse(src)
+		if err != nil {
+			return nil, fmt.Errorf("ACCESS_LOG_FORMAT: %v", err)
+		}
+		// catch unknown fields now rather than on every request
+		if err := t.Execute(io.Discard, accessEntry{}); err != nil {
+			return nil, fmt.Errorf("ACCESS_LOG_FORMAT: %v", err)
+		}
+		a.tmpl = t
+	}
+	switch dest {
+	case "-", "stdout":
+		a.w = os.Stdout
+	case "stderr":
+		a.w = os.Stderr
+	default:
+		f, err := openLogFile(dest)
+		if err != nil {
+			return nil, fmt.Errorf("ACCESS_LOG: %v", err)
+		}
+		a.w = f
+	}
+	return a, nil
+}
+
+// log writes the line for an answered request.
+func (a *accessLog) log(r *http.Request, sw *statusWriter, status int, start time.Time, endpoint string) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	e := accessEntry{
+		RemoteIP:   ip,
+		Time:       start,
+		Method:     r.Method,
+		URI:        maskQuery(r.RequestURI),
+		Proto:      r.Proto,
+		Status:     status,
+		Bytes:      sw.bytes,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		DurationMs: time.Since(start).Milliseconds(),
+		RequestID:  requestID(r.Context()),
+		Endpoint:   endpoint,
+	}
+	if n, err := strconv.Atoi(sw.Header().Get("X-Exit-Code")); err == nil {
+		e.ExitCode = &n
+	}
+	var b bytes.Buffer
+	if a.tmpl == nil {
+		_ = json.NewEncoder(&b).Encode(e)
+	} else {
+		_ = a.tmpl.Execute(&b, e)
+		if b.Len() == 0 || b.Bytes()[b.Len()-1] != '\n' {
+			b.WriteByte('\n')
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, _ = a.w.Write(b.Bytes())
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// admin guards operator-only handlers with ADMIN_AUTH ("Header:Token").
+func (s *server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get(s.adminHeader)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(s.adminToken)) != 1 {
+			s.fail(w, r, nil, errorData{Kind: "unauthorized", Status: http.StatusUnauthorized, Message: "unauthorized"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// authorizedFor reports whether r carries ep's token or ADMIN_AUTH; it
+// guards things an endpoint produced (stored results, jobs).
+func (s *server) authorizedFor(r *http.Request, ep *Endpoint) bool {
+	if s.adminHeader != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(s.adminHeader)), []byte(s.adminToken)) == 1 {
+		return true
+	}
+	if ep == nil {
+		return false
+	}
+	_, ok := ep.checkToken(r.Header.Get(ep.header))
+	return ok
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// catalogEntry describes a loaded endpoint; the auth token is never included.
+type catalogEntry struct {
+	URI       string   `json:"uri"`
+	Type      string   `json:"type"`
+	Methods   []string `json:"methods"`
+	About     string   `json:"about,omitempty"`
+	Host      string   `json:"host,omitempty"`
+	Listeners []string `json:"listeners,omitempty"`
+	Priority  int      `json:"priority,omitempty"`
+	TTL       string   `json:"ttl"`
+	Auth      struct {
+		Type   string   `json:"type"`
+		Header string   `json:"header"`
+		Tokens []string `json:"tokens,omitempty"` // names of the named tokens
+	} `json:"auth"`
+}
+
+// catalog lists endpoints in match order.
+func (s *server) catalog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		s.fail(w, r, nil, errorData{Kind: "method_not_allowed", Status: http.StatusMethodNotAllowed, Message: "method not allowed"})
+		return
+	}
+	out := make([]catalogEntry, 0, len(s.eps))
+	for _, ep := range s.eps {
+		e := catalogEntry{
+			URI:       ep.URI,
+			Type:      "script",
+			Methods:   allowedMethods([]*Endpoint{ep}),
+			About:     ep.About,
+			Host:      ep.Host,
+			Listeners: ep.Listeners,
+			Priority:  ep.Prio,
+			TTL:       ep.timeout.String(),
+		}
+		if ep.Type != "" {
+			e.Type = ep.Type
+		}
+		e.Auth.Type, e.Auth.Header = "header", ep.header
+		if ep.token == "" {
+			e.Auth.Type = "signature"
+			if q, ok := strings.CutPrefix(deliveryCredential(ep), "?"); ok {
+				e.Auth.Type, e.Auth.Header = "query", q
+			}
+		}
+		if len(ep.tokenNames) > 0 {
+			e.Auth.Tokens = slices.Sorted(maps.Values(ep.tokenNames))
+		}
+		out = append(out, e)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// servePprof serves the runtime profiles of net/http/pprof under
+// /admin/debug/pprof/ (PPROF=1).
+func servePprof(w http.ResponseWriter, r *http.Request) {
+	// the pprof handlers expect /debug/pprof/ paths
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = strings.TrimPrefix(r.URL.Path, "/admin")
+	switch r2.URL.Path {
+	case "/debug/pprof/cmdline":
+		pprof.Cmdline(w, r2)
+	case "/debug/pprof/profile":
+		pprof.Profile(w, r2)
+	case "/debug/pprof/symbol":
+		pprof.Symbol(w, r2)
+	case "/debug/pprof/trace":
+		pprof.Trace(w, r2)
+	default:
+		pprof.Index(w, r2)
+	}
+}
+
+// logLevelState is the body of /admin/log-level.
+type logLevelState struct {
+	Level   string     `json:"level"`
+	Default string     `json:"default"`         // LOG_LEVEL
+	Until   *time.Time `json:"until,omitempty"` // when it goes back to default
+}
+
+// serveLogLevel shows the log level and, on PUT, changes it:
+// {"level": "debug", "for": "15m"}; without "for" the change stays.
+func (s *server) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		var req struct {
+			Level string `json:"level"`
+			For   string `json:"for"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+			s.fail(w, r, nil, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: "bad body: " + err.Error()})
+			return
+		}
+		l, err := parseLevel(req.Level)
+		if err != nil {
+			s.fail(w, r, nil, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: "level: " + err.Error()})
+			return
+		}
+		var d time.Duration
+		if req.For != "" {
+			if d, err = time.ParseDuration(req.For); err != nil || d <= 0 {
+				s.fail(w, r, nil, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: fmt.Sprintf("for: want a duration like 15m, got %q", req.For)})
+				return
+			}
+		}
+		setLogLevel(l, d)
+		// whatever the level, as the server's own lines are
+		if d > 0 {
+			log.Printf("log level %s for %s", levelName(l), d)
+		} else {
+			log.Printf("log level %s", levelName(l))
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		s.fail(w, r, nil, errorData{Kind: "method_not_allowed", Status: http.StatusMethodNotAllowed, Message: "method not allowed"})
+		return
+	}
+	levelState.Lock()
+	st := logLevelState{Level: levelName(logLevel.Level()), Default: levelName(levelState.base)}
+	if !levelState.until.IsZero() {
+		until := levelState.until.UTC()
+		st.Until = &until
+	}
+	levelState.Unlock()
+	writeJSON(w, http.StatusOK, st)
+}
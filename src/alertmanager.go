@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// alertmanagerFilter is an endpoint's alertmanager block: it takes
+// Prometheus Alertmanager notifications, and runs the script once for the
+// group or once for each alert in it.
+type alertmanagerFilter struct {
+	Per       string            `json:"per"`       // "group" (default) or "alert": a job per alert, as a batch
+	Statuses  []string          `json:"statuses"`  // of the alerts: "firing", "resolved"; empty = both
+	Receivers []string          `json:"receivers"` // globs over the receiver name
+	Labels    map[string]string `json:"labels"`    // globs over label values, all to match: {"alertname": "Disk*"}
+}
+
+// alertSource is a block taking Alertmanager notifications, or ones
+// built like them.
+type alertSource interface {
+	deliveryFilter
+	perAlert() bool
+	// matching are the alerts of a notification the block runs for
+	matching(alerts []any) []map[string]any
+	// runParams are the params of a run for alert a, over those of its
+	// group
+	runParams(group map[string]string, a map[string]any) map[string]string
+}
+
+func (f *alertmanagerFilter) perAlert() bool { return f.Per == "alert" }
+
+func (f *alertmanagerFilter) params() []string {
+	return slices.Concat(alertParams, []string{"alert_receiver", "alert_group_key", "alert_external_url", "alert_count", "alert_firing"})
+}
+
+// alertParams are the params of a single alert; in a run for the group,
+// labels and annotations are those all its alerts share, the rest empty.
+var alertParams = []string{"alert_status", "alert_fingerprint", "alert_starts_at", "alert_ends_at", "alert_generator_url", "alert_label_*", "alert_annotation_*"}
+
+func (f *alertmanagerFilter) credential() string                 { return "" }
+func (f *alertmanagerFilter) verify(*http.Request, []byte) error { return nil }
+
+func (f *alertmanagerFilter) validate() error {
+	if f.Per != "" && f.Per != "group" && f.Per != "alert" {
+		return fmt.Errorf("per must be group or alert, got %q", f.Per)
+	}
+	for _, st := range f.Statuses {
+		if st != "firing" && st != "resolved" {
+			return fmt.Errorf("bad status %q, want firing or resolved", st)
+		}
+	}
+	for k, v := range f.Labels {
+		if k == "" {
+			return errors.New("empty label name")
+		}
+		if err := checkPatterns("label", []string{v}); err != nil {
+			return err
+		}
+	}
+	return checkPatterns("receiver", f.Receivers)
+}
+
+func (f *alertmanagerFilter) check(r *http.Request, body *requestBody) (map[string]string, string) {
+	return checkAlerts(f, f.Receivers, deliveryPayload(body))
+}
+
+// checkAlerts filters a notification by receiver and its alerts as src
+// does, and reads the alert_* params of the group from those left.
+func checkAlerts(src alertSource, receivers []string, payload any) (map[string]string, string) {
+	all, ok := jsonValue(payload, "alerts").([]any)
+	if !ok {
+		return nil, "not an Alertmanager notification (no alerts)"
+	}
+	receiver := jsonPath(payload, "receiver")
+	if !matchAny(receivers, receiver) {
+		return nil, fmt.Sprintf("receiver %s not in receivers", receiver)
+	}
+	alerts := src.matching(all)
+	if len(alerts) == 0 {
+		return nil, fmt.Sprintf("none of %d alerts match", len(all))
+	}
+	p := map[string]string{
+		"alert_receiver":     receiver,
+		"alert_group_key":    jsonPath(payload, "groupKey"),
+		"alert_external_url": jsonPath(payload, "externalURL"),
+		"alert_count":        strconv.Itoa(len(alerts)),
+	}
+	firing := 0
+	for _, a := range alerts {
+		if jsonPath(a, "status") == "firing" {
+			firing++
+		}
+	}
+	p["alert_firing"] = strconv.Itoa(firing)
+	// the group fires while one of its alerts does, as Alertmanager has it
+	p["alert_status"] = "resolved"
+	if firing > 0 {
+		p["alert_status"] = "firing"
+	}
+	for _, k := range []string{"labels", "annotations"} {
+		for name, v := range commonPairs(alerts, k) {
+			p["alert_"+k[:len(k)-1]+"_"+name] = v
+		}
+	}
+	for _, k := range []string{"alert_fingerprint", "alert_starts_at", "alert_ends_at", "alert_generator_url"} {
+		p[k] = ""
+	}
+	return p, ""
+}
+
+// matching are the alerts with a wanted status and labels.
+func (f *alertmanagerFilter) matching(alerts []any) []map[string]any {
+	var out []map[string]any
+	for _, v := range alerts {
+		a, ok := v.(map[string]any)
+		if !ok || len(f.Statuses) > 0 && !slices.Contains(f.Statuses, jsonPath(a, "status")) {
+			continue
+		}
+		labels := stringPairs(a["labels"])
+		match := true
+		for k, glob := range f.Labels {
+			if v, ok := labels[k]; !ok || !matchAny([]string{glob}, v) {
+				match = false
+				break
+			}
+		}
+		if match {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// runParams sets the alert's own params over the group's; its labels
+// and annotations are a superset of those the group shares.
+func (f *alertmanagerFilter) runParams(group map[string]string, a map[string]any) map[string]string {
+	p := maps.Clone(group)
+	p["alert_status"] = jsonPath(a, "status")
+	p["alert_fingerprint"] = jsonPath(a, "fingerprint")
+	p["alert_starts_at"] = jsonPath(a, "startsAt")
+	p["alert_ends_at"] = jsonPath(a, "endsAt")
+	p["alert_generator_url"] = jsonPath(a, "generatorURL")
+	for name, v := range stringPairs(a["labels"]) {
+		p["alert_label_"+name] = v
+	}
+	for name, v := range stringPairs(a["annotations"]) {
+		p["alert_annotation_"+name] = v
+	}
+	return p
+}
+
+// serveAlerts starts a job per alert of a notification, as one batch.
+// An alert's run gets the alert as its body.
+func (s *server) serveAlerts(w http.ResponseWriter, r *http.Request, ep *Endpoint, src alertSource, pv map[string]string, body *requestBody, group map[string]string) {
+	delay, err := requestDelay(r, ep)
+	if err != nil {
+		s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
+	all, _ := jsonValue(deliveryPayload(body), "alerts").([]any)
+	alerts := src.matching(all)
+	batch := make([]batchItem, len(alerts))
+	for i, a := range alerts {
+		if batch[i], err = prepareBatchItem(r, ep, pv, a, src.runParams(group, a), delay); err != nil {
+			s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: fmt.Sprintf("alert %d: %v", i, err)})
+			return
+		}
+	}
+	s.startBatch(w, r, ep, batch)
+}
+
+// stringPairs are the string, number and bool values of a decoded JSON
+// object, as Alertmanager sends labels and annotations.
+func stringPairs(v any) map[string]string {
+	out := map[string]string{}
+	m, _ := v.(map[string]any)
+	for k, v := range m {
+		switch v.(type) {
+		case string, json.Number, bool, float64:
+			out[k] = toString(v)
+		}
+	}
+	return out
+}
+
+// commonPairs are the pairs of field k that all alerts share.
+func commonPairs(alerts []map[string]any, k string) map[string]string {
+	common := stringPairs(alerts[0][k])
+	for _, a := range alerts[1:] {
+		pairs := stringPairs(a[k])
+		for name, v := range common {
+			if pairs[name] != v {
+				delete(common, name)
+			}
+		}
+	}
+	return common
+}
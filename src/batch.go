@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// batchItem is one prepared run of a batch.
+type batchItem struct {
+	sc     *scriptCmd
+	params map[string]string
+	opts   jobOptions
+}
+
+// serveBatch handles a JSON array sent to a batch endpoint: every item
+// is the body of one run, started as a job of one batch. The items are
+// checked first and admitted together, so the batch either starts as a
+// whole or not at all. delivered are the params of the endpoint's forge
+// block, the same for every item.
+func (s *server) serveBatch(w http.ResponseWriter, r *http.Request, ep *Endpoint, pv map[string]string, items []any, delivered map[string]string) {
+	bad := func(status int, msg string) {
+		s.fail(w, r, ep, errorData{Kind: "bad_request", Status: status, Message: msg})
+	}
+	if len(items) == 0 || len(items) > ep.Batch {
+		bad(http.StatusBadRequest, fmt.Sprintf("batch of %d items, want 1 to %d", len(items), ep.Batch))
+		return
+	}
+	delay, err := requestDelay(r, ep)
+	if err != nil {
+		bad(http.StatusBadRequest, err.Error())
+		return
+	}
+	batch := make([]batchItem, len(items))
+	for i, item := range items {
+		if _, ok := item.(map[string]any); !ok {
+			bad(http.StatusBadRequest, fmt.Sprintf("item %d: want an object", i))
+			return
+		}
+		if ep.schema != nil {
+			if errs := ep.schema.validate(item, fmt.Sprintf("body[%d]", i)); len(errs) > 0 {
+				bad(http.StatusUnprocessableEntity, strings.Join(errs, "\n"))
+				return
+			}
+		}
+		if batch[i], err = prepareBatchItem(r, ep, pv, item, delivered, delay); err != nil {
+			bad(http.StatusBadRequest, fmt.Sprintf("item %d: %v", i, err))
+			return
+		}
+	}
+	s.startBatch(w, r, ep, batch)
+}
+
+// prepareBatchItem makes the run of one item: item is its body, extra
+// the params it brings besides those.
+func prepareBatchItem(r *http.Request, ep *Endpoint, pv map[string]string, item any, extra map[string]string, delay time.Duration) (batchItem, error) {
+	raw, _ := json.Marshal(item)
+	body := &requestBody{format: "json", raw: raw, data: item}
+	params, err := mergeParams(ep, pv, r, body)
+	if err == nil {
+		maps.Copy(params, extra)
+		addBuiltins(params)
+		if err = applyComputed(ep, params); err != nil {
+			err = fmt.Errorf("bad computed param: %v", err)
+		}
+	}
+	var sc *scriptCmd
+	if err == nil {
+		if sc, err = newScriptCmd(r.Context(), ep, params); err != nil {
+			err = fmt.Errorf("bad template: %v", err)
+		}
+	}
+	opts := jobOptions{delay: delay}
+	if err == nil {
+		opts.callback, err = callbackURL(ep, params, r.Header.Get("X-Callback-Url"))
+	}
+	if err != nil {
+		return batchItem{}, err
+	}
+	if ep.BodyTo == "stdin" {
+		sc.stdin = bytes.NewReader(raw)
+	}
+	return batchItem{sc: sc, params: params, opts: opts}, nil
+}
+
+// startBatch admits the prepared runs together and starts them as jobs
+// of one batch, or turns the request away if the queue can't take them
+// all.
+func (s *server) startBatch(w http.ResponseWriter, r *http.Request, ep *Endpoint, batch []batchItem) {
+	for i := range batch {
+		if !s.queue.admit(ep) {
+			for range i {
+				s.queue.release(ep)
+			}
+			s.rejectBusy(w, r, ep)
+			return
+		}
+	}
+	id := newUUID()
+	type accepted struct {
+		ID    string `json:"id"`
+		State string `json:"state"`
+		URL   string `json:"url"`
+	}
+	jobs := make([]accepted, len(batch))
+	for i, it := range batch {
+		it.opts.batch = id
+		j := s.startJob(r.Context(), ep, it.sc, it.params, nil, it.opts)
+		jobs[i] = accepted{ID: j.ID, State: jobQueued, URL: s.basePath + "/jobs/" + j.ID}
+	}
+	logf(r.Context(), "batch %s %s %s: started %d jobs", id, ep.Method, ep.URI, len(jobs))
+	link := s.basePath + "/jobs?batch=" + id
+	w.Header().Set("X-Batch-Id", id)
+	w.Header().Set("Location", link)
+	writeJSON(w, http.StatusAccepted, map[string]any{"batch": id, "url": link, "jobs": jobs})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// bitbucketFilter is an endpoint's bitbucket block: which Bitbucket Cloud
+// or Bitbucket Server (Data Center) webhook events run the script, and the
+// secret they are signed with.
+type bitbucketFilter struct {
+	Events   []string `json:"events"`   // globs over X-Event-Key: "repo:push", "pullrequest:*", "pr:merged"; empty = all but pings
+	Branches []string `json:"branches"` // globs: "main", "release/*"
+	Repos    []string `json:"repos"`    // globs: "workspace/slug" (Cloud), "PROJECT/slug" (Server)
+	Secret   string   `json:"secret"`   // the webhook's secret: check X-Hub-Signature
+}
+
+func (f *bitbucketFilter) params() []string {
+	return []string{"bitbucket_event", "bitbucket_request_id", "bitbucket_repo", "bitbucket_branch", "bitbucket_tag", "bitbucket_sha"}
+}
+
+func (f *bitbucketFilter) credential() string {
+	if f.Secret == "" {
+		return ""
+	}
+	return "X-Hub-Signature"
+}
+
+// verify checks X-Hub-Signature, which Cloud and Server both send as
+// sha256=<HMAC of the body>.
+func (f *bitbucketFilter) verify(r *http.Request, raw []byte) error {
+	return verifyHMAC(r, "X-Hub-Signature", f.Secret, raw)
+}
+
+func (f *bitbucketFilter) validate() error {
+	if err := checkPatterns("event", f.Events); err != nil {
+		return err
+	}
+	if err := checkPatterns("branch", f.Branches); err != nil {
+		return err
+	}
+	return checkPatterns("repo", f.Repos)
+}
+
+// check filters an event by key, branch and repository, and reads the
+// bitbucket_* params from it. Cloud and Server payloads differ; a push
+// goes by its first change.
+func (f *bitbucketFilter) check(r *http.Request, body *requestBody) (map[string]string, string) {
+	event := r.Header.Get("X-Event-Key")
+	if event == "" {
+		return nil, "not a Bitbucket event (no X-Event-Key)"
+	}
+	// Server's "Test connection" sends diagnostics:ping
+	if len(f.Events) == 0 && event == "diagnostics:ping" || !matchAny(f.Events, event) {
+		return nil, fmt.Sprintf("event %s not in events", event)
+	}
+	payload := deliveryPayload(body)
+	p := map[string]string{
+		"bitbucket_event":      event,
+		"bitbucket_request_id": r.Header.Get("X-Request-UUID"), // Cloud
+		"bitbucket_repo":       jsonPath(payload, "repository.full_name"),
+		"bitbucket_branch":     "",
+		"bitbucket_tag":        "",
+		"bitbucket_sha":        "",
+	}
+	if p["bitbucket_request_id"] == "" {
+		p["bitbucket_request_id"] = r.Header.Get("X-Request-Id") // Server
+	}
+	if p["bitbucket_repo"] == "" {
+		// Server names repositories by project key and slug
+		for _, repo := range []string{"repository", "pullRequest.toRef.repository"} {
+			if key, slug := jsonPath(payload, repo+".project.key"), jsonPath(payload, repo+".slug"); key != "" && slug != "" {
+				p["bitbucket_repo"] = key + "/" + slug
+				break
+			}
+		}
+	}
+	var name, typ string
+	switch {
+	case jsonPath(payload, "push.changes.0.new.name") != "": // Cloud push
+		name, typ = jsonPath(payload, "push.changes.0.new.name"), jsonPath(payload, "push.changes.0.new.type")
+		p["bitbucket_sha"] = jsonPath(payload, "push.changes.0.new.target.hash")
+	case jsonPath(payload, "push.changes.0.old.name") != "": // Cloud, deleted
+		name, typ = jsonPath(payload, "push.changes.0.old.name"), jsonPath(payload, "push.changes.0.old.type")
+	case jsonPath(payload, "pullrequest.destination.branch.name") != "": // Cloud pull request
+		name, typ = jsonPath(payload, "pullrequest.destination.branch.name"), "branch"
+		p["bitbucket_sha"] = jsonPath(payload, "pullrequest.source.commit.hash")
+	case jsonPath(payload, "changes.0.ref.displayId") != "": // Server push
+		name, typ = jsonPath(payload, "changes.0.ref.displayId"), strings.ToLower(jsonPath(payload, "changes.0.ref.type"))
+		p["bitbucket_sha"] = jsonPath(payload, "changes.0.toHash")
+	case jsonPath(payload, "pullRequest.toRef.displayId") != "": // Server pull request
+		name, typ = jsonPath(payload, "pullRequest.toRef.displayId"), "branch"
+		p["bitbucket_sha"] = jsonPath(payload, "pullRequest.fromRef.latestCommit")
+	}
+	switch typ {
+	case "branch":
+		p["bitbucket_branch"] = name
+	case "tag":
+		p["bitbucket_tag"] = name
+	}
+	if len(f.Branches) > 0 {
+		if p["bitbucket_branch"] == "" {
+			return nil, fmt.Sprintf("%s event without a branch", event)
+		}
+		if !matchAny(f.Branches, p["bitbucket_branch"]) {
+			return nil, fmt.Sprintf("branch %s not in branches", p["bitbucket_branch"])
+		}
+	}
+	if len(f.Repos) > 0 && !matchAny(f.Repos, p["bitbucket_repo"]) {
+		return nil, fmt.Sprintf("repo %s not in repos", p["bitbucket_repo"])
+	}
+	return p, ""
+}
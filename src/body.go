@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type requestBody struct {
+	format string // parser used: json, form, multipart, xml, raw or "" (empty body)
+	raw    []byte
+	wire   []byte // as received, before body_encoding: what senders sign
+	data   any    // decoded value; map[string]any for form/multipart/xml
+}
+
+// bodyFormat picks the parser: the endpoint's body_format wins, then the
+// request Content-Type. A body without Content-Type is parsed as JSON.
+func bodyFormat(ep *Endpoint, r *http.Request) string {
+	if ep.BodyFormat != "" {
+		return ep.BodyFormat
+	}
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return "json"
+	}
+	mt, _, _ := mime.ParseMediaType(ct)
+	switch {
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		return "json"
+	case mt == "application/x-www-form-urlencoded":
+		return "form"
+	case mt == "multipart/form-data":
+		return "multipart"
+	case mt == "application/xml" || mt == "text/xml" || strings.HasSuffix(mt, "+xml"):
+		return "xml"
+	}
+	return "raw"
+}
+
+// readBody reads the request body as sent, up to the endpoint's
+// max_body_bytes, else limit; past it the error is an
+// *http.MaxBytesError. It is decoded apart, once its signature checks
+// out.
+func readBody(ep *Endpoint, w http.ResponseWriter, r *http.Request, limit int64) (*requestBody, error) {
+	b := &requestBody{}
+	if r.Body == nil {
+		return b, nil
+	}
+	defer r.Body.Close()
+	if ep.MaxBody > 0 {
+		limit = int64(ep.MaxBody)
+	}
+	body := r.Body
+	if limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	b.wire = raw
+	return b, nil
+}
+
+// decode decodes the body by the endpoint's body_encoding and the format
+// bodyFormat picks. Decode errors are returned instead of being ignored.
+func (b *requestBody) decode(ep *Endpoint, r *http.Request) error {
+	raw := b.wire
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil
+	}
+	if ep.BodyEnc == "base64" {
+		dec, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(raw)))
+		if err != nil {
+			return fmt.Errorf("invalid base64: %v", err)
+		}
+		raw = dec
+	}
+	b.raw = raw
+	b.format = bodyFormat(ep, r)
+	switch b.format {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		if err := dec.Decode(&b.data); err != nil {
+			return fmt.Errorf("invalid JSON: %v", err)
+		}
+		if dec.Decode(&struct{}{}) != io.EOF {
+			return fmt.Errorf("invalid JSON: trailing data")
+		}
+	case "form":
+		vals, err := url.ParseQuery(string(raw))
+		if err != nil {
+			return fmt.Errorf("invalid form: %v", err)
+		}
+		m := map[string]any{}
+		for k := range vals {
+			m[k] = vals.Get(k)
+		}
+		b.data = m
+	case "multipart":
+		_, mp, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mp["boundary"] == "" {
+			return fmt.Errorf("multipart body without boundary")
+		}
+		form, err := multipart.NewReader(bytes.NewReader(raw), mp["boundary"]).ReadForm(32 << 20)
+		if err != nil {
+			return fmt.Errorf("invalid multipart: %v", err)
+		}
+		defer form.RemoveAll()
+		m := map[string]any{}
+		for k, v := range form.Value {
+			if len(v) > 0 {
+				m[k] = v[0]
+			}
+		}
+		// file fields carry the uploaded file name
+		for k, fh := range form.File {
+			if len(fh) > 0 {
+				m[k] = fh[0].Filename
+			}
+		}
+		b.data = m
+	case "xml":
+		m, err := decodeXML(raw)
+		if err != nil {
+			return fmt.Errorf("invalid XML: %v", err)
+		}
+		b.data = m
+	case "raw":
+		b.data = string(raw)
+	}
+	return nil
+}
+
+// decodeXML flattens the children of the root element into a map:
+// <push><ref>main</ref><repo><name>x</name></repo></push> gives
+// ref=main and repo.name=x. Repeated elements keep the last value.
+func decodeXML(raw []byte) (map[string]any, error) {
+	dec := xml.NewDecoder(bytes.NewReader(raw))
+	m := map[string]any{}
+	var stack []string
+	var text strings.Builder
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth > 1 {
+				stack = append(stack, t.Name.Local)
+			}
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if depth > 1 {
+				if v := strings.TrimSpace(text.String()); v != "" {
+					m[strings.Join(stack, ".")] = v
+				}
+				stack = stack[:len(stack)-1]
+			}
+			text.Reset()
+			depth--
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unexpected end of document")
+	}
+	return m, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultCache keeps successful results of one endpoint for its cache
+// ttl, keyed by the expanded command and stdin.
+type resultCache struct {
+	ttl time.Duration
+	mu  sync.Mutex
+	m   map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	res            *runResult
+	out            []byte // interleaved output
+	stdout, stderr []byte // response: json or result
+	etag           string
+	stored         time.Time
+	expires        time.Time
+}
+
+func newResultCache(ttl time.Duration) *resultCache {
+	return &resultCache{ttl: ttl, m: map[string]*cacheEntry{}}
+}
+
+func (c *resultCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.m[key]
+	if e != nil && time.Now().After(e.expires) {
+		delete(c.m, key)
+		return nil
+	}
+	return e
+}
+
+func (c *resultCache) put(key string, e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, old := range c.m {
+		if now.After(old.expires) {
+			delete(c.m, k)
+		}
+	}
+	e.stored, e.expires = now, now.Add(c.ttl)
+	c.m[key] = e
+}
+
+func cacheKey(sc *scriptCmd, stdin []byte) string {
+	h := sha256.New()
+	for _, argv := range append([][]string{sc.argv}, sc.steps...) {
+		for _, a := range argv {
+			io.WriteString(h, a)
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{1})
+	}
+	h.Write(stdin)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// etagMatch reports whether If-None-Match lists etag (or "*").
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// runCached runs the script, or answers from the endpoint cache. done
+// means a 304 was sent and there is nothing left to write. With dedup,
+// identical triggers with the same dedupKey share one run.
+func runCached(w http.ResponseWriter, r *http.Request, ep *Endpoint, sc *scriptCmd, stdin []byte, dedupKey string) (e *cacheEntry, done bool) {
+	ctx := r.Context()
+	if ep.dedup != nil {
+		// one caller hanging up must not kill the run the others wait for
+		ctx = context.WithoutCancel(ctx)
+	}
+	run := func() *cacheEntry {
+		e := &cacheEntry{}
+		if ep.Response == "json" || ep.Response == "result" {
+			var stdout, stderr bytes.Buffer
+			e.res = runScript(ctx, ep, sc, &stdout, &stderr)
+			e.stdout, e.stderr = stdout.Bytes(), stderr.Bytes()
+		} else {
+			var out bytes.Buffer
+			e.res = runScript(ctx, ep, sc, &out, &out)
+			e.out = out.Bytes()
+		}
+		return e
+	}
+	if ep.dedup != nil {
+		fn := run
+		run = func() *cacheEntry {
+			e, shared := ep.dedup.run(r.Context(), dedupKey, fn)
+			if shared {
+				w.Header().Set("X-Deduplicated", "1")
+			}
+			return e
+		}
+	}
+	if ep.cache == nil {
+		e = run()
+		setResultHeaders(w.Header(), e.res)
+		return e, false
+	}
+	key := cacheKey(sc, stdin)
+	h := w.Header()
+	if e = ep.cache.get(key); e != nil {
+		h.Set("X-Cache", "HIT")
+		h.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	} else {
+		e = run()
+		if e.res.err != nil {
+			setResultHeaders(h, e.res)
+			return e, false
+		}
+		sum := sha256.New()
+		sum.Write(e.out)
+		sum.Write(e.stdout)
+		sum.Write(e.stderr)
+		e.etag = `"` + hex.EncodeToString(sum.Sum(nil)[:16]) + `"`
+		ep.cache.put(key, e)
+		h.Set("X-Cache", "MISS")
+	}
+	setResultHeaders(h, e.res)
+	h.Set("ETag", e.etag)
+	if h.Get("Cache-Control") == "" {
+		h.Set("Cache-Control", "private, max-age="+strconv.Itoa(int(time.Until(e.expires).Round(time.Second).Seconds())))
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatch(inm, e.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return e, true
+	}
+	return e, false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// callbackConfig is an async endpoint's "callback" section.
+type callbackConfig struct {
+	URL        string `json:"url"`         // POSTed to when a job ends, with {placeholders}
+	Secret     string `json:"secret"`      // HMAC-SHA256 key for X-Signature-256
+	FromHeader bool   `json:"from_header"` // callers may pick the URL with X-Callback-Url
+}
+
+// callbackOutputMax is how much of the output, from the end, a callback
+// carries.
+const callbackOutputMax = 64 << 10
+
+// callbackPayload is the body POSTed to a job's callback URL.
+type callbackPayload struct {
+	jobInfo
+	Output  string         `json:"output"` // the last callbackOutputMax bytes
+	Uploads []uploadResult `json:"uploads,omitempty"`
+}
+
+// callbackURL returns where to report the job of this request: the
+// caller's X-Callback-Url if the endpoint takes it, or the configured
+// url; "" for none.
+func callbackURL(ep *Endpoint, params map[string]string, header string) (string, error) {
+	cb := ep.Callback
+	if header != "" && (cb == nil || !cb.FromHeader) {
+		return "", errors.New("endpoint takes no X-Callback-Url")
+	}
+	u := header
+	if u == "" {
+		if cb == nil || cb.URL == "" {
+			return "", nil
+		}
+		esc := make(map[string]string, len(params))
+		for k, v := range params {
+			esc[k] = url.QueryEscape(v)
+		}
+		var err error
+		if u, _, err = expandToken(cb.URL, esc); err != nil {
+			return "", fmt.Errorf("bad callback url: %v", err)
+		}
+	}
+	if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+		return "", fmt.Errorf("bad callback url %q", u)
+	}
+	return u, nil
+}
+
+// sendCallback POSTs the finished job to its callback URL, signed with
+// the endpoint's secret, retrying failed deliveries with backoff.
+// Delivery problems are only logged.
+func (s *server) sendCallback(ctx context.Context, j *job, res *runResult) {
+	_, info := s.jobs.get(j.ID)
+	out := j.out.bytes()
+	if len(out) > callbackOutputMax {
+		out = out[len(out)-callbackOutputMax:]
+	}
+	body, _ := json.Marshal(callbackPayload{jobInfo: info, Output: string(out), Uploads: res.uploads})
+	sig := ""
+	if j.ep.Callback != nil && j.ep.Callback.Secret != "" {
+		sig = "sha256=" + hex.EncodeToString(hmacSHA256([]byte(j.ep.Callback.Secret), string(body)))
+	}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := s.postCallback(ctx, j, body, sig)
+		if err == nil {
+			logf(ctx, "job %s: callback delivered", j.ID)
+			return
+		}
+		if attempt >= s.callbackTries {
+			warnf(ctx, "job %s: callback failed, giving up after %d attempts: %v", j.ID, attempt, err)
+			return
+		}
+		warnf(ctx, "job %s: callback failed, retrying in %s: %v", j.ID, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 4
+	}
+}
+
+func (s *server) postCallback(ctx context.Context, j *job, body []byte, sig string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, j.callback, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "shhoook")
+	req.Header.Set("X-Job-Id", j.ID)
+	req.Header.Set(requestIDHeader, j.RequestID)
+	if sig != "" {
+		req.Header.Set("X-Signature-256", sig)
+	}
+	resp, err := s.callbacks.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
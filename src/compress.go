@@ -0,0 +1,156 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptedEncoding picks gzip or deflate from Accept-Encoding, "" if
+// the client takes neither.
+func acceptedEncoding(r *http.Request) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		v := 1.0
+		if k, val, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil {
+				v = f
+			}
+		}
+		q[strings.ToLower(name)] = v
+	}
+	for _, enc := range []string{"gzip", "deflate"} {
+		if v, ok := q[enc]; ok && v > 0 {
+			return enc
+		}
+	}
+	if v, ok := q["*"]; ok && v > 0 {
+		return "gzip"
+	}
+	return ""
+}
+
+// incompressible reports content types that are already compressed.
+func incompressible(ct string) bool {
+	mt, _, _ := mime.ParseMediaType(ct)
+	switch {
+	case strings.HasPrefix(mt, "image/") && mt != "image/svg+xml",
+		strings.HasPrefix(mt, "video/"), strings.HasPrefix(mt, "audio/"):
+		return true
+	}
+	switch mt {
+	case "application/gzip", "application/x-gzip", "application/zip", "application/zstd",
+		"application/x-bzip2", "application/x-xz", "application/x-7z-compressed":
+		return true
+	}
+	return false
+}
+
+// compressWriter compresses a response once it reaches min bytes or is
+// flushed (streams); smaller responses go out as is. Responses that
+// already have a Content-Encoding, are partial, or have an
+// incompressible type are passed through.
+type compressWriter struct {
+	http.ResponseWriter
+	enc     string
+	min     int
+	status  int
+	buf     []byte
+	decided bool
+	zw      io.WriteCloser // nil: pass-through
+}
+
+func newCompressWriter(w http.ResponseWriter, enc string, min int) *compressWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+	return &compressWriter{ResponseWriter: w, enc: enc, min: min, status: http.StatusOK}
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.decided {
+		return
+	}
+	c.status = code
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified {
+		c.decide(false)
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.decided {
+		c.buf = append(c.buf, p...)
+		if len(c.buf) < c.min {
+			return len(p), nil
+		}
+		c.decide(true)
+		return len(p), c.drain()
+	}
+	if c.zw != nil {
+		return c.zw.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.decide(true)
+	}
+	_ = c.drain()
+	if f, ok := c.zw.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	_ = http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// decide sends the header, compressing if want and the response allows.
+func (c *compressWriter) decide(want bool) {
+	c.decided = true
+	h := c.Header()
+	if want && h.Get("Content-Encoding") == "" && c.status != http.StatusPartialContent &&
+		!incompressible(h.Get("Content-Type")) {
+		if h.Get("Content-Type") == "" && len(c.buf) > 0 {
+			h.Set("Content-Type", http.DetectContentType(c.buf))
+		}
+		h.Set("Content-Encoding", c.enc)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		if c.enc == "gzip" {
+			c.zw = gzip.NewWriter(c.ResponseWriter)
+		} else {
+			c.zw, _ = flate.NewWriter(c.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+}
+
+func (c *compressWriter) drain() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	b := c.buf
+	c.buf = nil
+	var err error
+	if c.zw != nil {
+		_, err = c.zw.Write(b)
+	} else {
+		_, err = c.ResponseWriter.Write(b)
+	}
+	return err
+}
+
+// close sends what is left; small responses go out uncompressed.
+func (c *compressWriter) close() {
+	if !c.decided {
+		c.decide(false)
+	}
+	_ = c.drain()
+	if c.zw != nil {
+		_ = c.zw.Close()
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// corsAllowed reports whether origin may call ep from a browser.
+func corsAllowed(ep *Endpoint, origin string) bool {
+	return origin != "" && (slices.Contains(ep.CORS, "*") || slices.Contains(ep.CORS, origin))
+}
+
+// setCORS adds Access-Control-Allow-Origin for allowed origins.
+func setCORS(w http.ResponseWriter, r *http.Request, ep *Endpoint) {
+	if len(ep.CORS) == 0 {
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); corsAllowed(ep, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// serveOptions answers OPTIONS for a known path with the allowed
+// methods. CORS preflights additionally get the Access-Control-*
+// headers of the endpoint they ask about, if its cors list allows the
+// origin.
+func serveOptions(w http.ResponseWriter, r *http.Request, eps []*Endpoint, allowed []string) {
+	allowed = append(allowed, http.MethodOptions)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	origin := r.Header.Get("Origin")
+	want := r.Header.Get("Access-Control-Request-Method")
+	for _, ep := range eps {
+		if want == "" || ep.Method != want || len(ep.CORS) == 0 {
+			continue
+		}
+		w.Header().Add("Vary", "Origin")
+		if corsAllowed(ep, origin) {
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Methods", ep.Method)
+			h.Set("Access-Control-Allow-Headers", strings.TrimPrefix(ep.header+", Content-Type", ", "))
+			h.Set("Access-Control-Max-Age", "600")
+		}
+		break
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// dedupConfig is an endpoint's "dedup" section.
+type dedupConfig struct {
+	Key    string `json:"key"`    // with {placeholders}; "" = the expanded command and stdin
+	Window string `json:"window"` // "30s": how long after a run starts identical triggers join it
+}
+
+// dedupGroup coalesces identical triggers of one endpoint: the first
+// one runs, the ones with the same key within the window get its result
+// (or, for async endpoints, its job).
+type dedupGroup struct {
+	window time.Duration
+	mu     sync.Mutex
+	m      map[string]*dedupCall
+}
+
+type dedupCall struct {
+	until time.Time
+	done  chan struct{} // closed once e is set
+	e     *cacheEntry
+	job   *job
+}
+
+var errBusy = errors.New("too many pending runs")
+
+func newDedupGroup(window time.Duration) *dedupGroup {
+	return &dedupGroup{window: window, m: map[string]*dedupCall{}}
+}
+
+// lookup returns the live call for key, or registers c as it. Called
+// with g.mu held.
+func (g *dedupGroup) lookup(key string, c *dedupCall) (*dedupCall, bool) {
+	now := time.Now()
+	for k, old := range g.m {
+		if now.After(old.until) {
+			delete(g.m, k)
+		}
+	}
+	if old := g.m[key]; old != nil {
+		return old, true
+	}
+	c.until = now.Add(g.window)
+	g.m[key] = c
+	return c, false
+}
+
+// run runs fn, or waits for the run of an identical trigger; shared
+// reports the latter. A waiting caller gives up when ctx ends.
+func (g *dedupGroup) run(ctx context.Context, key string, fn func() *cacheEntry) (e *cacheEntry, shared bool) {
+	g.mu.Lock()
+	c, shared := g.lookup(key, &dedupCall{done: make(chan struct{})})
+	g.mu.Unlock()
+	if !shared {
+		c.e = fn()
+		close(c.done)
+		return c.e, false
+	}
+	select {
+	case <-c.done:
+		return c.e, true
+	case <-ctx.Done():
+		return &cacheEntry{res: &runResult{exitCode: -1, err: ctx.Err()}}, true
+	}
+}
+
+// job returns the job of an identical trigger, or the one start creates.
+// start runs under the group's lock, so it should be quick.
+func (g *dedupGroup) job(key string, start func() (*job, error)) (j *job, shared bool, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, shared := g.lookup(key, &dedupCall{})
+	if shared {
+		return c.job, true, nil
+	}
+	if c.job, err = start(); err != nil {
+		delete(g.m, key)
+		return nil, false, err
+	}
+	return c.job, false, nil
+}
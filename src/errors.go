@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"text/template"
+)
+
+// errorPage is a templated body for an error response.
+type errorPage struct {
+	ContentType string `json:"content_type"` // default text/plain
+	Body        string `json:"body"`         // text/template over errorData
+
+	tmpl *template.Template
+}
+
+// errorPages maps a response kind to its page.
+type errorPages map[string]*errorPage
+
+var errorKinds = map[string]bool{
+	"not_found":          true,
+	"method_not_allowed": true,
+	"unauthorized":       true,
+	"bad_request":        true, // 400 and 422
+	"error":              true, // script failure or timeout
+	"busy":               true, // 429, run queue full
+}
+
+// errorData is what error templates see.
+type errorData struct {
+	Status   int
+	Kind     string
+	Message  string
+	Method   string
+	Path     string
+	Endpoint string // uri template, empty for not_found
+	Output   string // script output, kind "error" only
+	Timeout  bool
+	// RequestID is also in the X-Request-ID header
+	RequestID string
+}
+
+var errorFuncs = template.FuncMap{
+	// json renders a value as a JSON literal: {"error": {{json .Message}}}
+	"json": func(v any) string {
+		b, _ := json.Marshal(v)
+		return string(b)
+	},
+}
+
+func (p errorPages) compile() error {
+	for kind, page := range p {
+		if !errorKinds[kind] {
+			return fmt.Errorf("unknown error kind %q", kind)
+		}
+		t, err := template.New(kind).Funcs(errorFuncs).Parse(page.Body)
+		if err != nil {
+			return fmt.Errorf("%s: %v", kind, err)
+		}
+		page.tmpl = t
+		if page.ContentType == "" {
+			page.ContentType = "text/plain; charset=utf-8"
+		}
+	}
+	return nil
+}
+
+// loadErrorPages reads the global ERROR_PAGES file.
+func loadErrorPages(path string) (errorPages, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p errorPages
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// fail writes an error response, using the endpoint's page for kind,
+// then the global one, then the plain-text default.
+func (s *server) fail(w http.ResponseWriter, r *http.Request, ep *Endpoint, d errorData) {
+	d.Method, d.Path, d.RequestID = r.Method, r.URL.Path, requestID(r.Context())
+	var page *errorPage
+	if ep != nil {
+		d.Endpoint = ep.URI
+		page = ep.Errors[d.Kind]
+	}
+	if d.Kind == "unauthorized" {
+		stats.add(mAuthFail, "", 1, "endpoint", d.Endpoint)
+		statsd.count("auth_failures", 1, "endpoint", d.Endpoint)
+		if ep != nil {
+			stats.add(mOutcomes, "", 1, "endpoint", d.Endpoint, "outcome", "unauthorized")
+			statsd.count("outcomes", 1, "endpoint", d.Endpoint, "outcome", "unauthorized")
+		}
+	}
+	if page == nil {
+		page = s.errors[d.Kind]
+	}
+	if page == nil {
+		if d.Kind == "error" {
+			// non-zero code/timeout → the output body as is
+			w.WriteHeader(d.Status)
+			_, _ = w.Write([]byte(d.Output))
+			if d.Timeout {
+				_, _ = w.Write([]byte("\n(timeout)\n"))
+			}
+			return
+		}
+		http.Error(w, d.Message, d.Status)
+		return
+	}
+	var buf bytes.Buffer
+	if err := page.tmpl.Execute(&buf, d); err != nil {
+		http.Error(w, "error template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", page.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(d.Status)
+	_, _ = w.Write(buf.Bytes())
+}
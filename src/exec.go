@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// runResult is the outcome of one script run.
+type runResult struct {
+	exitCode int // -1 if the script did not exit normally
+	duration time.Duration
+	timedOut bool
+	err      error // nil on exit code 0
+
+	outputBytes int64 // produced by the script (after sanitize)
+	truncated   bool  // max_output_bytes cut the output
+	limit       int64 // max_output_bytes in effect
+
+	steps      []stepResult // one per command run, for endpoints with steps
+	failedStep int          // 1-based index of the step that failed, 0 = none
+
+	uploads []uploadResult // objects stored by the endpoint's upload
+}
+
+// stepResult is the outcome of one command of a chain.
+type stepResult struct {
+	Command    string `json:"command"`
+	ExitCode   int    `json:"exit_code"`
+	DurationMs int64  `json:"duration_ms"`
+	TimedOut   bool   `json:"timed_out,omitempty"`
+	Stdout     string `json:"stdout"` // response: json only
+	Stderr     string `json:"stderr"`
+}
+
+// outputCap counts output and passes on at most limit bytes (0 = all),
+// over stdout and stderr together.
+type outputCap struct {
+	mu    sync.Mutex
+	limit int64
+	total int64
+}
+
+type capWriter struct {
+	w io.Writer
+	c *outputCap
+}
+
+func (cw capWriter) Write(p []byte) (int, error) {
+	cw.c.mu.Lock()
+	keep := int64(len(p))
+	if cw.c.limit > 0 {
+		keep = max(0, min(keep, cw.c.limit-cw.c.total))
+	}
+	cw.c.total += int64(len(p))
+	cw.c.mu.Unlock()
+	if keep > 0 {
+		if _, err := cw.w.Write(p[:keep]); err != nil {
+			return 0, err
+		}
+	}
+	// dropped output still counts as written, or the script gets EPIPE
+	return len(p), nil
+}
+
+// truncationMarker is appended to text output cut by max_output_bytes.
+func truncationMarker(res *runResult) string {
+	return fmt.Sprintf("\n[output truncated: %d of %d bytes shown]\n", res.limit, res.outputBytes)
+}
+
+// scriptCmd is a script invocation ready to run.
+type scriptCmd struct {
+	argv  []string
+	steps [][]string // run after argv, in order, while they succeed
+	env   []string   // on top of the minimal PATH
+	stdin io.Reader  // may be nil; goes to the first command only
+	pool  *execQueue // where to get a worker; nil = run at once
+
+	secrets []string // param values error reports mask; nil = not known, empty = none
+}
+
+// newScriptCmd expands the endpoint's script and steps with params.
+func newScriptCmd(ctx context.Context, ep *Endpoint, params map[string]string) (*scriptCmd, error) {
+	argv, err := applyTemplate(ep.Script, params)
+	if err != nil {
+		return nil, err
+	}
+	sc := &scriptCmd{argv: argv}
+	for _, st := range ep.Steps {
+		a, err := applyTemplate(st, params)
+		if err != nil {
+			return nil, err
+		}
+		sc.steps = append(sc.steps, a)
+	}
+	if reporting != nil {
+		sc.secrets = append([]string{}, secretValues(ep, params)...)
+	}
+	if debugOn() {
+		secrets := secretValues(ep, params)
+		for i, argv := range append([][]string{sc.argv}, sc.steps...) {
+			shown := make([]string, len(argv))
+			for j, a := range argv {
+				shown[j] = redact(a, secrets)
+			}
+			what := "argv"
+			if i > 0 {
+				what = fmt.Sprintf("step %d", i)
+			}
+			debugf(ctx, "%s %s: %s %q", ep.Method, ep.URI, what, shown)
+		}
+	}
+	return sc, nil
+}
+
+// setResultHeaders reports the run result in X-Exit-Code and
+// X-Duration-Ms, whatever the response body looks like.
+func setResultHeaders(h http.Header, res *runResult) {
+	h.Set("X-Exit-Code", strconv.Itoa(res.exitCode))
+	h.Set("X-Duration-Ms", strconv.FormatInt(res.duration.Milliseconds(), 10))
+	if res.truncated {
+		h.Set("X-Output-Truncated", "1")
+		h.Set("X-Output-Bytes", strconv.FormatInt(res.outputBytes, 10))
+	}
+	if res.failedStep > 0 {
+		h.Set("X-Failed-Step", strconv.Itoa(res.failedStep))
+	}
+}
+
+// setKillSequence runs cmd in its own process group and, on timeout or
+// cancellation, sends the group kill_signal, then SIGKILL after
+// kill_grace. Children the script started go down with it.
+func setKillSequence(cmd *exec.Cmd, ep *Endpoint) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		err := syscall.Kill(-pgid, ep.killSignal)
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		time.AfterFunc(ep.killGrace, func() { _ = syscall.Kill(-pgid, syscall.SIGKILL) })
+		return err
+	}
+	// don't wait forever for pipes held open by leftover children
+	cmd.WaitDelay = ep.killGrace + time.Second
+}
+
+// runScript runs sc with the endpoint ttl. Passing the same writer as
+// stdout and stderr interleaves them; writes to it are never concurrent.
+// A chain stops at the first failing step, and the ttl covers all steps.
+func runScript(ctx context.Context, ep *Endpoint, sc *scriptCmd, stdout, stderr io.Writer) *runResult {
+	// the ttl starts once a worker is free
+	if sc.pool != nil {
+		if err := sc.pool.acquire(ctx, ep); err != nil {
+			return &runResult{exitCode: -1, err: err}
+		}
+		defer sc.pool.done(ep)
+	}
+	runStarted(ep)
+	ctx, sp := scriptSpan(ctx, ep, sc)
+	ctx, cancel := context.WithTimeout(ctx, ep.timeout)
+	defer cancel()
+	var logged []*outputLogger
+	if ep.LogOutput {
+		lo, le := newOutputLogger(ctx, ep, "stdout"), newOutputLogger(ctx, ep, "stderr")
+		logged = []*outputLogger{lo, le}
+		if stdout == stderr {
+			// the streams are told apart from here on, so exec copies them
+			// at once
+			stdout = &lockedWriter{w: stdout}
+			stderr = stdout
+		}
+		stdout, stderr = io.MultiWriter(stdout, lo), io.MultiWriter(stderr, le)
+	}
+	var tail *tailBuffer
+	if reporting != nil && ep.Report != "off" {
+		tail = &tailBuffer{max: reportOutputMax}
+		if stdout == stderr {
+			stdout = io.MultiWriter(stdout, tail)
+			stderr = stdout
+		} else {
+			stdout, stderr = io.MultiWriter(stdout, tail), io.MultiWriter(stderr, tail)
+		}
+	}
+	oc := &outputCap{limit: int64(ep.MaxOutput)}
+	if stdout == stderr {
+		stdout = capWriter{stdout, oc}
+		stderr = stdout
+	} else {
+		stdout, stderr = capWriter{stdout, oc}, capWriter{stderr, oc}
+	}
+	if ep.Sanitize {
+		stdout, stderr = sanitizeWriters(stdout, stderr)
+	}
+
+	res := &runResult{}
+	start := time.Now()
+	var slow *time.Timer
+	if ep.slow > 0 {
+		slow = time.AfterFunc(ep.slow, func() { slowRun(ctx, ep, start) })
+	}
+	for i, argv := range append([][]string{sc.argv}, sc.steps...) {
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		// minimal PATH, empty environment
+		cmd.Env = append([]string{"PATH=/usr/sbin:/usr/bin:/sbin:/bin"}, sc.env...)
+		if id := requestID(ctx); id != "" {
+			cmd.Env = append(cmd.Env, "SHHOOOK_REQUEST_ID="+id)
+		}
+		if sp != nil {
+			// the script can carry on the trace
+			cmd.Env = append(cmd.Env, "TRACEPARENT="+sp.traceparent())
+		}
+		setKillSequence(cmd, ep)
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		if i == 0 {
+			cmd.Stdin = sc.stdin
+		}
+		// per-step output is only kept for the JSON envelope
+		var so, se bytes.Buffer
+		if len(sc.steps) > 0 && ep.Response == "json" {
+			cmd.Stdout, cmd.Stderr = io.MultiWriter(stdout, &so), io.MultiWriter(stderr, &se)
+		}
+		stepStart := time.Now()
+		res.err = cmd.Run()
+		res.exitCode = -1
+		if cmd.ProcessState != nil {
+			res.exitCode = cmd.ProcessState.ExitCode()
+		}
+		res.timedOut = errors.Is(res.err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded
+		if len(sc.steps) > 0 {
+			res.steps = append(res.steps, stepResult{
+				Command:    argv[0],
+				ExitCode:   res.exitCode,
+				DurationMs: time.Since(stepStart).Milliseconds(),
+				TimedOut:   res.timedOut,
+				Stdout:     so.String(),
+				Stderr:     se.String(),
+			})
+			if res.err != nil {
+				res.failedStep = i + 1
+			}
+		}
+		if res.err != nil {
+			break
+		}
+	}
+	if slow != nil {
+		slow.Stop()
+	}
+	for _, l := range logged {
+		l.flush()
+	}
+	res.duration = time.Since(start)
+	res.outputBytes, res.limit = oc.total, oc.limit
+	res.truncated = oc.limit > 0 && oc.total > oc.limit
+	canceled := errors.Is(ctx.Err(), context.Canceled)
+	runFinished(ctx, ep, res, canceled)
+	if tail != nil && res.err != nil && !canceled {
+		reportRun(ctx, ep, sc, res, tail.bytes())
+	}
+	endScriptSpan(sp, res)
+	return res
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A tiny CEL-like expression language used by "computed" params.
+//
+// Supported:
+//   literals:   'str', "str", 42, true, false
+//   variables:  any merged param name (missing → "")
+//   operators:  + (concat / add), == != < <= > >=, && || !, cond ? a : b
+//   indexing:   list[i]
+//   methods:    split(sep) join(sep) lower() upper() trim() size()
+//               replace(old, new) substring(from[, to])
+//               startsWith(s) endsWith(s) contains(s) matches(re)
+
+type exprFn func(vars map[string]string) (any, error)
+
+type expr struct {
+	src string
+	fn  exprFn
+}
+
+func compileExpr(src string) (*expr, error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	fn, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tkEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", p.peek().text, p.peek().pos)
+	}
+	return &expr{src: src, fn: fn}, nil
+}
+
+func (e *expr) eval(vars map[string]string) (string, error) {
+	v, err := e.fn(vars)
+	if err != nil {
+		return "", err
+	}
+	return exprString(v), nil
+}
+
+// ---- lexer ----
+
+type tokKind int
+
+const (
+	tkEOF tokKind = iota
+	tkIdent
+	tkString
+	tkInt
+	tkOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+func lexExpr(s string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			q := c
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != q; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+					switch s[j] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(s[j])
+					}
+					continue
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			toks = append(toks, token{tkString, b.String(), i})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			toks = append(toks, token{tkInt, s[i:j], i})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			toks = append(toks, token{tkIdent, s[i:j], i})
+			i = j
+		default:
+			two := ""
+			if i+1 < len(s) {
+				two = s[i : i+2]
+			}
+			switch two {
+			case "==", "!=", "<=", ">=", "&&", "||":
+				toks = append(toks, token{tkOp, two, i})
+				i += 2
+				continue
+			}
+			if strings.IndexByte("+<>!?:()[],.", c) < 0 {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+			toks = append(toks, token{tkOp, string(c), i})
+			i++
+		}
+	}
+	toks = append(toks, token{tkEOF, "", len(s)})
+	return toks, nil
+}
+
+// ---- parser ----
+
+type exprParser struct {
+	toks []token
+	i    int
+}
+
+func (p *exprParser) peek() token { return p.toks[p.i] }
+
+func (p *exprParser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tkEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *exprParser) accept(op string) bool {
+	if t := p.peek(); t.kind == tkOp && t.text == op {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("expected %q at %d", op, t.pos)
+	}
+	return nil
+}
+
+func (p *exprParser) parseTernary() (exprFn, error) {
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return cond, nil
+	}
+	a, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return func(vars map[string]string) (any, error) {
+		c, err := cond(vars)
+		if err != nil {
+			return nil, err
+		}
+		if exprTruthy(c) {
+			return a(vars)
+		}
+		return b(vars)
+	}, nil
+}
+
+func (p *exprParser) parseOr() (exprFn, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = logical(l, r, true)
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseAnd() (exprFn, error) {
+	l, err := p.parseCmp()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		r, err := p.parseCmp()
+		if err != nil {
+			return nil, err
+		}
+		l = logical(l, r, false)
+	}
+	return l, nil
+}
+
+func logical(l, r exprFn, or bool) exprFn {
+	return func(vars map[string]string) (any, error) {
+		a, err := l(vars)
+		if err != nil {
+			return nil, err
+		}
+		if exprTruthy(a) == or {
+			return or, nil
+		}
+		b, err := r(vars)
+		if err != nil {
+			return nil, err
+		}
+		return exprTruthy(b), nil
+	}
+}
+
+func (p *exprParser) parseCmp() (exprFn, error) {
+	l, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.kind != tkOp {
+		return l, nil
+	}
+	switch t.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return l, nil
+	}
+	p.next()
+	r, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	op := t.text
+	return func(vars map[string]string) (any, error) {
+		a, err := l(vars)
+		if err != nil {
+			return nil, err
+		}
+		b, err := r(vars)
+		if err != nil {
+			return nil, err
+		}
+		var c int
+		ai, aok := a.(int)
+		bi, bok := b.(int)
+		if aok && bok {
+			c = ai - bi
+		} else {
+			c = strings.Compare(exprString(a), exprString(b))
+		}
+		switch op {
+		case "==":
+			return c == 0, nil
+		case "!=":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}, nil
+}
+
+func (p *exprParser) parseAdd() (exprFn, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("+") {
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		ll := l
+		l = func(vars map[string]string) (any, error) {
+			a, err := ll(vars)
+			if err != nil {
+				return nil, err
+			}
+			b, err := r(vars)
+			if err != nil {
+				return nil, err
+			}
+			ai, aok := a.(int)
+			bi, bok := b.(int)
+			if aok && bok {
+				return ai + bi, nil
+			}
+			al, aok := a.([]string)
+			bl, bok := b.([]string)
+			if aok && bok {
+				return append(append([]string{}, al...), bl...), nil
+			}
+			return exprString(a) + exprString(b), nil
+		}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseUnary() (exprFn, error) {
+	if p.accept("!") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(vars map[string]string) (any, error) {
+			v, err := x(vars)
+			if err != nil {
+				return nil, err
+			}
+			return !exprTruthy(v), nil
+		}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (exprFn, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("["):
+			idx, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = indexFn(x, idx)
+		case p.accept("."):
+			t := p.next()
+			if t.kind != tkIdent {
+				return nil, fmt.Errorf("expected method name at %d", t.pos)
+			}
+			if err := p.expect("("); err != nil {
+				return nil, err
+			}
+			var args []exprFn
+			if !p.accept(")") {
+				for {
+					a, err := p.parseTernary()
+					if err != nil {
+						return nil, err
+					}
+					args = append(args, a)
+					if p.accept(")") {
+						break
+					}
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			m, err := methodFn(t.text, x, args)
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %v", t.pos, err)
+			}
+			x = m
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (exprFn, error) {
+	t := p.next()
+	switch t.kind {
+	case tkString:
+		s := t.text
+		return func(map[string]string) (any, error) { return s, nil }, nil
+	case tkInt:
+		n, err := strconv.Atoi(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", t.text)
+		}
+		return func(map[string]string) (any, error) { return n, nil }, nil
+	case tkIdent:
+		name := t.text
+		switch name {
+		case "true", "false":
+			b := name == "true"
+			return func(map[string]string) (any, error) { return b, nil }, nil
+		}
+		return func(vars map[string]string) (any, error) { return vars[name], nil }, nil
+	case tkOp:
+		if t.text == "(" {
+			x, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return x, nil
+		}
+	}
+	if t.kind == tkEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+func indexFn(x, idx exprFn) exprFn {
+	return func(vars map[string]string) (any, error) {
+		v, err := x(vars)
+		if err != nil {
+			return nil, err
+		}
+		iv, err := idx(vars)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := iv.(int)
+		if !ok {
+			n, err := strconv.Atoi(exprString(iv))
+			if err != nil {
+				return nil, fmt.Errorf("index must be int, got %q", exprString(iv))
+			}
+			i = n
+		}
+		switch t := v.(type) {
+		case []string:
+			if i < 0 || i >= len(t) {
+				return nil, fmt.Errorf("index %d out of range [0,%d)", i, len(t))
+			}
+			return t[i], nil
+		case string:
+			r := []rune(t)
+			if i < 0 || i >= len(r) {
+				return nil, fmt.Errorf("index %d out of range [0,%d)", i, len(r))
+			}
+			return string(r[i]), nil
+		}
+		return nil, fmt.Errorf("value is not indexable")
+	}
+}
+
+var exprMethodArity = map[string][2]int{
+	"split":      {1, 1},
+	"join":       {0, 1},
+	"lower":      {0, 0},
+	"upper":      {0, 0},
+	"trim":       {0, 0},
+	"size":       {0, 0},
+	"replace":    {2, 2},
+	"substring":  {1, 2},
+	"startsWith": {1, 1},
+	"endsWith":   {1, 1},
+	"contains":   {1, 1},
+	"matches":    {1, 1},
+}
+
+func methodFn(name string, recv exprFn, args []exprFn) (exprFn, error) {
+	ar, ok := exprMethodArity[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown method %q", name)
+	}
+	if len(args) < ar[0] || len(args) > ar[1] {
+		return nil, fmt.Errorf("%s: wrong number of arguments", name)
+	}
+	return func(vars map[string]string) (any, error) {
+		rv, err := recv(vars)
+		if err != nil {
+			return nil, err
+		}
+		av := make([]any, len(args))
+		for i, a := range args {
+			if av[i], err = a(vars); err != nil {
+				return nil, err
+			}
+		}
+		s := exprString(rv)
+		arg := func(i int) string { return exprString(av[i]) }
+		argInt := func(i int) (int, error) {
+			if n, ok := av[i].(int); ok {
+				return n, nil
+			}
+			return strconv.Atoi(arg(i))
+		}
+		switch name {
+		case "split":
+			return strings.Split(s, arg(0)), nil
+		case "join":
+			l, ok := rv.([]string)
+			if !ok {
+				return s, nil
+			}
+			sep := ""
+			if len(av) > 0 {
+				sep = arg(0)
+			}
+			return strings.Join(l, sep), nil
+		case "lower":
+			return strings.ToLower(s), nil
+		case "upper":
+			return strings.ToUpper(s), nil
+		case "trim":
+			return strings.TrimSpace(s), nil
+		case "size":
+			if l, ok := rv.([]string); ok {
+				return len(l), nil
+			}
+			return len([]rune(s)), nil
+		case "replace":
+			return strings.ReplaceAll(s, arg(0), arg(1)), nil
+		case "substring":
+			r := []rune(s)
+			from, err := argInt(0)
+			if err != nil {
+				return nil, fmt.Errorf("substring: %v", err)
+			}
+			to := len(r)
+			if len(av) > 1 {
+				if to, err = argInt(1); err != nil {
+					return nil, fmt.Errorf("substring: %v", err)
+				}
+			}
+			if from < 0 || to > len(r) || from > to {
+				return nil, fmt.Errorf("substring: range [%d,%d) out of bounds", from, to)
+			}
+			return string(r[from:to]), nil
+		case "startsWith":
+			return strings.HasPrefix(s, arg(0)), nil
+		case "endsWith":
+			return strings.HasSuffix(s, arg(0)), nil
+		case "contains":
+			return strings.Contains(s, arg(0)), nil
+		case "matches":
+			re, err := regexp.Compile(arg(0))
+			if err != nil {
+				return nil, fmt.Errorf("matches: %v", err)
+			}
+			return re.MatchString(s), nil
+		}
+		return nil, fmt.Errorf("unknown method %q", name)
+	}, nil
+}
+
+func exprTruthy(v any) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case int:
+		return t != 0
+	case []string:
+		return len(t) > 0
+	case string:
+		return t != "" && t != "false" && t != "0"
+	}
+	return false
+}
+
+func exprString(v any) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case int:
+		return strconv.Itoa(t)
+	case bool:
+		if t {
+			return "true"
+		}
+		return "false"
+	case []string:
+		return strings.Join(t, ",")
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// githubFilter is an endpoint's github block: which GitHub webhook
+// deliveries run the script, and the secret they are signed with.
+type githubFilter struct {
+	Events   []string `json:"events"`   // X-GitHub-Event: "push", "pull_request", ...; empty = all but ping
+	Branches []string `json:"branches"` // globs: "main", "release/*"
+	Repos    []string `json:"repos"`    // globs over owner/name: "acme/*"
+	Secret   string   `json:"secret"`   // the webhook's secret: check X-Hub-Signature-256
+}
+
+func (f *githubFilter) params() []string {
+	return []string{"github_event", "github_delivery", "github_repo", "github_action", "github_branch", "github_tag"}
+}
+
+func (f *githubFilter) credential() string {
+	if f.Secret == "" {
+		return ""
+	}
+	return "X-Hub-Signature-256"
+}
+
+// validate checks the block as loaded.
+func (f *githubFilter) validate() error {
+	for _, e := range f.Events {
+		if e == "" {
+			return errors.New("empty event")
+		}
+	}
+	if err := checkPatterns("branch", f.Branches); err != nil {
+		return err
+	}
+	return checkPatterns("repo", f.Repos)
+}
+
+func (f *githubFilter) verify(r *http.Request, raw []byte) error {
+	return verifyHMAC(r, "X-Hub-Signature-256", f.Secret, raw)
+}
+
+// check filters a delivery by event, branch and repository, and reads
+// the github_* params from it.
+func (f *githubFilter) check(r *http.Request, body *requestBody) (map[string]string, string) {
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "" {
+		return nil, "not a GitHub delivery (no X-GitHub-Event)"
+	}
+	// GitHub pings a hook when it is created; that runs nothing unless asked
+	if len(f.Events) == 0 && event == "ping" || len(f.Events) > 0 && !slices.Contains(f.Events, event) {
+		return nil, fmt.Sprintf("event %s not in events", event)
+	}
+	payload := deliveryPayload(body)
+	p := map[string]string{
+		"github_event":    event,
+		"github_delivery": r.Header.Get("X-GitHub-Delivery"),
+		"github_repo":     jsonPath(payload, "repository.full_name"),
+		"github_action":   jsonPath(payload, "action"),
+		"github_branch":   "",
+		"github_tag":      "",
+	}
+	ref := jsonPath(payload, "ref")
+	if event == "create" || event == "delete" {
+		// these carry the bare name, with ref_type
+		ref = "refs/" + map[string]string{"branch": "heads", "tag": "tags"}[jsonPath(payload, "ref_type")] + "/" + ref
+	}
+	if b, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+		p["github_branch"] = b
+	} else if t, ok := strings.CutPrefix(ref, "refs/tags/"); ok {
+		p["github_tag"] = t
+	} else {
+		// pull requests go by the branch they would merge into
+		for _, k := range []string{"pull_request.base.ref", "workflow_run.head_branch", "check_suite.head_branch", "deployment.ref"} {
+			if v := jsonPath(payload, k); v != "" {
+				p["github_branch"] = v
+				break
+			}
+		}
+	}
+	if len(f.Branches) > 0 {
+		if p["github_branch"] == "" {
+			return nil, fmt.Sprintf("%s event without a branch", event)
+		}
+		if !matchAny(f.Branches, p["github_branch"]) {
+			return nil, fmt.Sprintf("branch %s not in branches", p["github_branch"])
+		}
+	}
+	if len(f.Repos) > 0 && !matchAny(f.Repos, p["github_repo"]) {
+		return nil, fmt.Sprintf("repo %s not in repos", p["github_repo"])
+	}
+	return p, ""
+}
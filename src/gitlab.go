@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// gitlabFilter is an endpoint's gitlab block: which GitLab webhook events
+// run the script. GitLab sends the webhook's secret token as is, in
+// X-Gitlab-Token, so auth checks it.
+type gitlabFilter struct {
+	Kinds    []string `json:"kinds"`    // object_kind: "push", "pipeline", "merge_request", ...
+	Statuses []string `json:"statuses"` // of pipelines, jobs and deployments ("success"), the state of merge requests ("merged")
+	Branches []string `json:"branches"` // globs: "main", "release/*"
+	Projects []string `json:"projects"` // globs over the project path: "acme/*"
+}
+
+func (f *gitlabFilter) params() []string {
+	return []string{"gitlab_kind", "gitlab_event_uuid", "gitlab_project", "gitlab_branch", "gitlab_tag", "gitlab_status", "gitlab_action", "gitlab_sha"}
+}
+
+func (f *gitlabFilter) credential() string                 { return "" }
+func (f *gitlabFilter) verify(*http.Request, []byte) error { return nil }
+
+func (f *gitlabFilter) validate() error {
+	if slices.Contains(f.Kinds, "") || slices.Contains(f.Statuses, "") {
+		return errors.New("empty kind or status")
+	}
+	if err := checkPatterns("branch", f.Branches); err != nil {
+		return err
+	}
+	return checkPatterns("project", f.Projects)
+}
+
+// check filters an event by kind, status, branch and project, and reads
+// the gitlab_* params from it.
+func (f *gitlabFilter) check(r *http.Request, body *requestBody) (map[string]string, string) {
+	payload := deliveryPayload(body)
+	kind := jsonPath(payload, "object_kind")
+	if kind == "" {
+		return nil, "not a GitLab event (no object_kind)"
+	}
+	if len(f.Kinds) > 0 && !slices.Contains(f.Kinds, kind) {
+		return nil, fmt.Sprintf("kind %s not in kinds", kind)
+	}
+	p := map[string]string{
+		"gitlab_kind":       kind,
+		"gitlab_event_uuid": r.Header.Get("X-Gitlab-Event-UUID"),
+		"gitlab_project":    jsonPath(payload, "project.path_with_namespace"),
+		"gitlab_branch":     "",
+		"gitlab_tag":        "",
+		"gitlab_status":     "",
+		"gitlab_action":     jsonPath(payload, "object_attributes.action"),
+		"gitlab_sha":        "",
+	}
+	// each kind keeps its ref, status and commit in a place of its own
+	var ref string
+	var tag bool
+	switch kind {
+	case "push", "tag_push":
+		ref, p["gitlab_sha"] = jsonPath(payload, "ref"), jsonPath(payload, "checkout_sha")
+	case "pipeline":
+		ref, tag = jsonPath(payload, "object_attributes.ref"), jsonPath(payload, "object_attributes.tag") == "true"
+		p["gitlab_status"], p["gitlab_sha"] = jsonPath(payload, "object_attributes.status"), jsonPath(payload, "object_attributes.sha")
+	case "build":
+		ref, tag = jsonPath(payload, "ref"), jsonPath(payload, "tag") == "true"
+		p["gitlab_status"], p["gitlab_sha"] = jsonPath(payload, "build_status"), jsonPath(payload, "sha")
+	case "deployment":
+		ref = jsonPath(payload, "ref")
+		p["gitlab_status"], p["gitlab_sha"] = jsonPath(payload, "status"), jsonPath(payload, "short_sha")
+	case "merge_request":
+		// merge requests go by the branch they would merge into
+		ref = jsonPath(payload, "object_attributes.target_branch")
+		p["gitlab_status"], p["gitlab_sha"] = jsonPath(payload, "object_attributes.state"), jsonPath(payload, "object_attributes.last_commit.id")
+	}
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		p["gitlab_branch"] = strings.TrimPrefix(ref, "refs/heads/")
+	case strings.HasPrefix(ref, "refs/tags/"):
+		p["gitlab_tag"] = strings.TrimPrefix(ref, "refs/tags/")
+	case tag:
+		p["gitlab_tag"] = ref
+	default:
+		p["gitlab_branch"] = ref
+	}
+	if len(f.Statuses) > 0 && !slices.Contains(f.Statuses, p["gitlab_status"]) {
+		if p["gitlab_status"] == "" {
+			return nil, fmt.Sprintf("%s event without a status", kind)
+		}
+		return nil, fmt.Sprintf("status %s not in statuses", p["gitlab_status"])
+	}
+	if len(f.Branches) > 0 {
+		if p["gitlab_branch"] == "" {
+			return nil, fmt.Sprintf("%s event without a branch", kind)
+		}
+		if !matchAny(f.Branches, p["gitlab_branch"]) {
+			return nil, fmt.Sprintf("branch %s not in branches", p["gitlab_branch"])
+		}
+	}
+	if len(f.Projects) > 0 && !matchAny(f.Projects, p["gitlab_project"]) {
+		return nil, fmt.Sprintf("project %s not in projects", p["gitlab_project"])
+	}
+	return p, ""
+}
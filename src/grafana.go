@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// grafanaFilter is an endpoint's grafana block. Grafana's alerting sends
+// webhooks built like Alertmanager's, with the rule's state, query values
+// and links added to each alert.
+type grafanaFilter struct {
+	alertmanagerFilter
+	States []string `json:"states"` // what alerts went to: "alerting", "normal", "nodata", "error"; empty = all
+}
+
+var grafanaStates = []string{"alerting", "normal", "nodata", "error"}
+
+func (f *grafanaFilter) params() []string {
+	return slices.Concat(f.alertmanagerFilter.params(), []string{
+		"alert_state", "alert_value_*", "alert_value_string", "alert_rule_uid",
+		"alert_dashboard_url", "alert_panel_url", "alert_silence_url", "alert_image_url",
+		"alert_title", "alert_message", "alert_org_id",
+	})
+}
+
+func (f *grafanaFilter) validate() error {
+	for _, st := range f.States {
+		if !slices.Contains(grafanaStates, st) {
+			return fmt.Errorf("bad state %q, want alerting, normal, nodata or error", st)
+		}
+	}
+	return f.alertmanagerFilter.validate()
+}
+
+// grafanaState is the state alert a went to. Grafana sends no data and
+// errors as alerts of their own (DatasourceNoData, DatasourceError), or,
+// for rules that alert on them, with grafana_state_reason.
+func grafanaState(a map[string]any) string {
+	if jsonPath(a, "status") == "resolved" {
+		return "normal"
+	}
+	switch {
+	case jsonPath(a, "labels.alertname") == "DatasourceNoData" || jsonPath(a, "annotations.grafana_state_reason") == "NoData":
+		return "nodata"
+	case jsonPath(a, "labels.alertname") == "DatasourceError" || jsonPath(a, "annotations.grafana_state_reason") == "Error":
+		return "error"
+	}
+	return "alerting"
+}
+
+// grafanaRule is the UID of the rule alert a came from: a label, or else
+// in its link, .../alerting/grafana/<uid>/view.
+func grafanaRule(a map[string]any) string {
+	if uid := jsonPath(a, "labels.__alert_rule_uid__"); uid != "" {
+		return uid
+	}
+	_, rest, ok := strings.Cut(jsonPath(a, "generatorURL"), "/alerting/grafana/")
+	if !ok {
+		return ""
+	}
+	uid, _, _ := strings.Cut(rest, "/")
+	return uid
+}
+
+// shared is of(a) if it is the same for all alerts, else "".
+func shared(alerts []map[string]any, of func(map[string]any) string) string {
+	v := of(alerts[0])
+	for _, a := range alerts[1:] {
+		if of(a) != v {
+			return ""
+		}
+	}
+	return v
+}
+
+func (f *grafanaFilter) matching(alerts []any) []map[string]any {
+	var out []map[string]any
+	for _, a := range f.alertmanagerFilter.matching(alerts) {
+		if len(f.States) == 0 || slices.Contains(f.States, grafanaState(a)) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// check filters a notification as an alertmanager block does, then by
+// state; the group's state, values and links are those all its alerts
+// share.
+func (f *grafanaFilter) check(r *http.Request, body *requestBody) (map[string]string, string) {
+	payload := deliveryPayload(body)
+	p, skip := checkAlerts(f, f.Receivers, payload)
+	if skip != "" {
+		return nil, skip
+	}
+	p["alert_title"] = jsonPath(payload, "title")
+	p["alert_message"] = jsonPath(payload, "message")
+	p["alert_org_id"] = jsonPath(payload, "orgId")
+	all, _ := jsonValue(payload, "alerts").([]any)
+	alerts := f.matching(all)
+	for name, v := range commonPairs(alerts, "values") {
+		p["alert_value_"+name] = v
+	}
+	p["alert_state"] = shared(alerts, grafanaState)
+	p["alert_rule_uid"] = shared(alerts, grafanaRule)
+	p["alert_dashboard_url"] = shared(alerts, func(a map[string]any) string { return jsonPath(a, "dashboardURL") })
+	p["alert_panel_url"] = shared(alerts, func(a map[string]any) string { return jsonPath(a, "panelURL") })
+	for _, k := range []string{"alert_value_string", "alert_silence_url", "alert_image_url"} {
+		p[k] = ""
+	}
+	return p, ""
+}
+
+func (f *grafanaFilter) runParams(group map[string]string, a map[string]any) map[string]string {
+	p := f.alertmanagerFilter.runParams(group, a)
+	p["alert_state"] = grafanaState(a)
+	for name, v := range stringPairs(a["values"]) {
+		p["alert_value_"+name] = v
+	}
+	p["alert_value_string"] = jsonPath(a, "valueString")
+	p["alert_rule_uid"] = grafanaRule(a)
+	p["alert_dashboard_url"] = jsonPath(a, "dashboardURL")
+	p["alert_panel_url"] = jsonPath(a, "panelURL")
+	p["alert_silence_url"] = jsonPath(a, "silenceURL")
+	p["alert_image_url"] = jsonPath(a, "imageURL")
+	return p
+}
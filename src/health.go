@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// healthCheck is a command /health runs (HEALTH_CHECKS); exit code 0
+// means healthy.
+type healthCheck struct {
+	Name   string   `json:"name"`
+	Script []string `json:"script"`
+	TTL    string   `json:"ttl"`   // default 5s
+	Probe  string   `json:"probe"` // "ready": only /ready runs it; default both
+
+	timeout time.Duration
+}
+
+// healthOutputMax is how much of a failed check's output is reported.
+const healthOutputMax = 1024
+
+// checkResult is one check in the /health body.
+type checkResult struct {
+	Name       string `json:"name"`
+	Ok         bool   `json:"ok"`
+	ExitCode   int    `json:"exit_code"`
+	DurationMs int64  `json:"duration_ms"`
+	TimedOut   bool   `json:"timed_out,omitempty"`
+	Output     string `json:"output,omitempty"` // failed checks only
+}
+
+// healthReport is the /health body when checks are configured.
+type healthReport struct {
+	Status string        `json:"status"` // ok or failing
+	Checks []checkResult `json:"checks"`
+}
+
+// healthChecks runs the checks for /health; requests that come in while
+// a run is under way get its result rather than starting another.
+type healthChecks struct {
+	checks []*healthCheck
+
+	mu      sync.Mutex
+	running chan struct{} // closed when the current run is over
+	last    healthReport
+}
+
+// loadHealthChecks reads HEALTH_CHECKS into the checks of /health and
+// those of /ready.
+func loadHealthChecks(path string) (health, ready *healthChecks, err error) {
+	if path == "" {
+		return nil, nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var checks []*healthCheck
+	if err := json.Unmarshal(b, &checks); err != nil {
+		return nil, nil, err
+	}
+	health, ready = &healthChecks{}, &healthChecks{}
+	seen := map[string]bool{}
+	for i, c := range checks {
+		if c.Name == "" || seen[c.Name] {
+			return nil, nil, fmt.Errorf("check %d: want a unique name", i)
+		}
+		seen[c.Name] = true
+		if len(c.Script) == 0 {
+			return nil, nil, fmt.Errorf("%s: script is required", c.Name)
+		}
+		if c.TTL == "" {
+			c.TTL = "5s"
+		}
+		if c.timeout, err = time.ParseDuration(c.TTL); err != nil || c.timeout <= 0 {
+			return nil, nil, fmt.Errorf("%s: bad ttl %q", c.Name, c.TTL)
+		}
+		switch c.Probe {
+		case "", "health":
+			health.checks = append(health.checks, c)
+		case "ready":
+		default:
+			return nil, nil, fmt.Errorf("%s: probe must be health or ready, got %q", c.Name, c.Probe)
+		}
+		ready.checks = append(ready.checks, c)
+	}
+	if len(health.checks) == 0 {
+		health = nil
+	}
+	return health, ready, nil
+}
+
+// report runs the checks, at once, or waits for the run under way.
+func (hc *healthChecks) report() healthReport {
+	hc.mu.Lock()
+	if ch := hc.running; ch != nil {
+		hc.mu.Unlock()
+		<-ch
+		hc.mu.Lock()
+		defer hc.mu.Unlock()
+		return hc.last
+	}
+	ch := make(chan struct{})
+	hc.running = ch
+	hc.mu.Unlock()
+
+	rep := healthReport{Status: "ok", Checks: make([]checkResult, len(hc.checks))}
+	var wg sync.WaitGroup
+	for i, c := range hc.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rep.Checks[i] = c.run()
+		}()
+	}
+	wg.Wait()
+	for _, r := range rep.Checks {
+		if !r.Ok {
+			rep.Status = "failing"
+		}
+	}
+
+	hc.mu.Lock()
+	hc.last, hc.running = rep, nil
+	hc.mu.Unlock()
+	close(ch)
+	return rep
+}
+
+// run runs the check with its ttl, in an empty environment like
+// endpoint scripts; on timeout its whole process group is killed.
+func (c *healthCheck) run() checkResult {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.Script[0], c.Script[1:]...)
+	cmd.Env = []string{"PATH=/usr/sbin:/usr/bin:/sbin:/bin"}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	cmd.WaitDelay = time.Second
+	var out bytes.Buffer
+	cmd.Stdout = capWriter{&out, &outputCap{limit: 64 << 10}}
+	cmd.Stderr = cmd.Stdout
+	start := time.Now()
+	err := cmd.Run()
+	res := checkResult{Name: c.Name, Ok: err == nil, ExitCode: -1, DurationMs: time.Since(start).Milliseconds()}
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	res.TimedOut = ctx.Err() == context.DeadlineExceeded
+	if !res.Ok {
+		b := bytes.TrimSpace(out.Bytes())
+		if len(b) > healthOutputMax {
+			b = b[len(b)-healthOutputMax:]
+		}
+		res.Output = string(b)
+		if res.Output == "" && cmd.ProcessState == nil {
+			res.Output = err.Error() // didn't start
+		}
+	}
+	return res
+}
+
+// serveHealth answers /health: "ok" without checks, otherwise 200 or 503
+// with the result of each check.
+func (s *server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if s.health == nil {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+		return
+	}
+	rep := s.health.report()
+	status := http.StatusOK
+	if rep.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, rep)
+}
+
+// readyReport is the /ready body.
+type readyReport struct {
+	Status    string        `json:"status"`            // ready or not_ready
+	Reasons   []string      `json:"reasons,omitempty"` // why not
+	Endpoints int           `json:"endpoints"`
+	Queue     queueState    `json:"queue"`
+	Redis     *redisState   `json:"redis,omitempty"`
+	Checks    []checkResult `json:"checks,omitempty"`
+}
+
+type queueState struct {
+	Pending int `json:"pending"`
+	Limit   int `json:"limit,omitempty"` // MAX_QUEUE
+}
+
+type redisState struct {
+	Ok         bool   `json:"ok"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// readyRedisTimeout bounds the Redis ping of /ready.
+const readyRedisTimeout = 2 * time.Second
+
+// serveReady answers /ready: 200 when this instance should get traffic,
+// 503 when the run queue is full, Redis can't be reached or a check
+// fails.
+func (s *server) serveReady(w http.ResponseWriter, r *http.Request) {
+	rep := readyReport{Status: "ready", Endpoints: len(s.eps)}
+	rep.Queue.Pending, rep.Queue.Limit = s.queue.load()
+	if rep.Queue.Limit > 0 && rep.Queue.Pending >= rep.Queue.Limit {
+		rep.Reasons = append(rep.Reasons, "run queue full")
+	}
+	if s.shared != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), readyRedisTimeout)
+		start := time.Now()
+		err := s.shared.ping(ctx)
+		cancel()
+		rep.Redis = &redisState{Ok: err == nil, DurationMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			rep.Redis.Error = err.Error()
+			rep.Reasons = append(rep.Reasons, "redis unreachable")
+		}
+	}
+	if s.ready != nil {
+		rep.Checks = s.ready.report().Checks
+		for _, c := range rep.Checks {
+			if !c.Ok {
+				rep.Reasons = append(rep.Reasons, "check "+c.Name+" failing")
+			}
+		}
+	}
+	status := http.StatusOK
+	if len(rep.Reasons) > 0 {
+		rep.Status, status = "not_ready", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, rep)
+}
@@ -0,0 +1,37 @@
+//go:build http3
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+const http3Available = true
+
+// serveHTTP3 starts an HTTP/3 (QUIC) server on pc, the UDP side of a
+// listener; if it stops serving, the error goes to errc.
+func serveHTTP3(pc net.PacketConn, h http.Handler, certFile, keyFile string, errc chan<- error) drainer {
+	srv := &http3.Server{Handler: h}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		errc <- err
+		return srv
+	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	go func() { errc <- srv.Serve(pc) }()
+	return srv
+}
+
+// advertiseHTTP3 adds the Alt-Svc header so TCP clients learn about
+// the QUIC listener on the same port.
+func advertiseHTTP3(addr string, h http.Handler) http.Handler {
+	srv := &http3.Server{Addr: addr}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = srv.SetQUICHeaders(w.Header())
+		h.ServeHTTP(w, r)
+	})
+}
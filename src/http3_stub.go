@@ -0,0 +1,25 @@
+//go:build !http3
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// HTTP/3 needs a QUIC stack outside the standard library; it is only
+// compiled in with -tags http3.
+const http3Available = false
+
+// serveHTTP3 is never called without it: HTTP3=1 stops the server at
+// startup.
+func serveHTTP3(net.PacketConn, http.Handler, string, string, chan<- error) drainer {
+	return noHTTP3{}
+}
+
+type noHTTP3 struct{}
+
+func (noHTTP3) Shutdown(context.Context) error { return nil }
+
+func advertiseHTTP3(_ string, h http.Handler) http.Handler { return h }
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jobOptions are the per-request settings of a job.
+type jobOptions struct {
+	delay    time.Duration // start no earlier than this after the request
+	callback string        // where to report the finished job; "" = nowhere
+	batch    string        // ID of the batch the job is part of
+}
+
+// startJob queues sc as a job of ep and runs it in the background. ctx
+// is the triggering request's.
+func (s *server) startJob(ctx context.Context, ep *Endpoint, sc *scriptCmd, params map[string]string, tmp []string, opts jobOptions) *job {
+	id := newUUID()
+	j := &job{
+		jobInfo: jobInfo{
+			ID:        id,
+			Method:    ep.Method,
+			URI:       ep.URI,
+			Host:      ep.Host,
+			State:     jobQueued,
+			Created:   time.Now().UTC(),
+			RequestID: requestID(ctx),
+			Batch:     opts.batch,
+			ServerPID: os.Getpid(),
+		},
+		ep:       ep,
+		out:      s.jobs.newOutput(id),
+		params:   params,
+		tmp:      tmp,
+		callback: opts.callback,
+	}
+	if opts.delay > 0 {
+		t := j.Created.Add(opts.delay)
+		j.NotBefore = &t
+	}
+	// a body file only exists here, so such jobs don't go to other instances
+	if s.shared != nil && len(tmp) == 0 {
+		err := s.shared.enqueue(ctx, j, newJobRun(j, sc))
+		if err == nil {
+			s.queue.release(ep)
+			return j
+		}
+		errorf(ctx, "job %s %s %s: shared queue: %v; running it here", j.ID, j.Method, j.URI, err)
+	}
+	// the job outlives the request, but keeps its request ID for logs
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	j.cancel = cancel
+	s.jobs.saveRun(j, sc)
+	s.jobs.add(j)
+	s.jobs.running.Add(1)
+	go s.runJob(ctx, j, sc)
+	return j
+}
+
+// resumeJobs runs again the jobs a restart interrupted, as their
+// endpoints' resume policy says. Their output starts over.
+func (s *server) resumeJobs() {
+	for _, j := range s.jobs.resume {
+		ctx := context.WithValue(context.Background(), requestIDKey{}, j.RequestID)
+		sc, err := s.jobs.loadRun(j)
+		if err != nil {
+			s.jobs.abandon(j, "interrupted by a restart, can't resume: "+err.Error())
+			warnf(ctx, "job %s %s %s: can't resume: %v", j.ID, j.Method, j.URI, err)
+			continue
+		}
+		was := j.State
+		os.Remove(s.jobs.logPath(j.ID))
+		s.jobs.requeue(j)
+		ctx, j.cancel = context.WithCancel(ctx)
+		s.queue.take(j.ep)
+		s.jobs.running.Add(1)
+		go s.runJob(ctx, j, sc)
+		logf(ctx, "job %s %s %s: resumed (was %s)", j.ID, j.Method, j.URI, was)
+	}
+	s.jobs.resume = nil
+}
+
+func (s *server) runJob(ctx context.Context, j *job, sc *scriptCmd) {
+	defer s.jobs.running.Done()
+	defer s.queue.release(j.ep)
+	defer j.cancel()
+	ctx = context.WithValue(ctx, jobIDKey{}, j.ID)
+	// a panic mustn't keep the worker or leave the job running forever
+	var working, finished bool
+	defer func() {
+		if v := recover(); v != nil {
+			logPanic(ctx, "job "+j.ID, v)
+			if working {
+				s.queue.done(j.ep)
+			}
+			if !finished {
+				s.jobs.abandon(j, fmt.Sprintf("panic: %v", v))
+			}
+		}
+	}()
+	defer func() {
+		for _, f := range j.tmp {
+			os.Remove(f)
+		}
+	}()
+	var res *runResult
+	for {
+		// only cancellation ends the delay or the wait for a worker
+		started := sleepUntil(ctx, j.NotBefore) && s.queue.acquire(ctx, j.ep) == nil
+		if started && !s.jobs.setRunning(j) {
+			s.queue.done(j.ep)
+			started = false
+		}
+		if !started {
+			res = &runResult{exitCode: -1, err: context.Canceled}
+			s.jobs.finish(j, res)
+			finished = true
+			logf(ctx, "job %s %s %s: canceled before it started", j.ID, j.Method, j.URI)
+			break
+		}
+		if rs, ok := sc.stdin.(io.Seeker); ok {
+			_, _ = rs.Seek(0, io.SeekStart) // a retry gets the same stdin
+		}
+		out := io.Writer(j.out)
+		if j.ep.PrefixOutput {
+			out = &linePrefixer{w: j.out, prefix: []byte("[" + j.ID + "] ")}
+		}
+		working = true
+		res = runScript(ctx, j.ep, sc, io.MultiWriter(out, &progressWriter{st: s.jobs, j: j}), out)
+		// retries, uploads and the callback don't need the worker
+		s.queue.done(j.ep)
+		working = false
+		if res.err != nil {
+			if at, ok := s.jobs.retry(j, res); ok {
+				fmt.Fprintf(j.out, "\n(attempt %d failed with exit code %d, retrying at %s)\n", j.Attempts, res.exitCode, at.Format(time.RFC3339))
+				warnf(ctx, "job %s %s %s: attempt %d failed, exit code %d; retrying at %s", j.ID, j.Method, j.URI, j.Attempts, res.exitCode, at.Format(time.RFC3339))
+				continue
+			}
+		}
+		if j.ep.Upload != nil {
+			s.upload(ctx, http.Header{}, j.ep, j.params, res, j.out.bytes())
+		}
+		state := s.jobs.finish(j, res)
+		finished = true
+		level := slog.LevelInfo
+		if state == jobFailed || state == jobTimeout || state == jobDead {
+			level = slog.LevelWarn
+		}
+		logAttrs(ctx, level, fmt.Sprintf("job %s %s %s: %s, exit code %d", j.ID, j.Method, j.URI, state, res.exitCode),
+			append(runAttrs(j.ep, res), slog.String("job_id", j.ID), slog.String("state", state))...)
+		break
+	}
+	if j.callback != "" {
+		// a canceled job is still reported
+		s.sendCallback(context.WithoutCancel(ctx), j, res)
+	}
+}
+
+// sleepUntil waits until t (if any); false if ctx ends first.
+func sleepUntil(ctx context.Context, t *time.Time) bool {
+	if t == nil {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(time.Until(*t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// requestDelay reads the delay a caller asked for, in the X-Delay header
+// or the delay query param ("90s", "5m" or plain seconds). The query
+// param is taken off the request so it doesn't reach the script.
+func requestDelay(r *http.Request, ep *Endpoint) (time.Duration, error) {
+	v := r.Header.Get("X-Delay")
+	if q := r.URL.Query(); q.Has("delay") && ep.maxDelay > 0 {
+		v = q.Get("delay")
+		q.Del("delay")
+		r.URL.RawQuery = q.Encode()
+	}
+	if v == "" {
+		return 0, nil
+	}
+	if ep.maxDelay == 0 {
+		return 0, errors.New("endpoint takes no delay")
+	}
+	d, err := time.ParseDuration(v)
+	if n, nerr := strconv.Atoi(v); nerr == nil {
+		d, err = time.Duration(n)*time.Second, nil
+	}
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("bad delay %q", v)
+	}
+	if d > ep.maxDelay {
+		return 0, fmt.Errorf("delay %s exceeds max_delay %s", d, ep.maxDelay)
+	}
+	return d, nil
+}
+
+// writeAccepted answers an async request with 202, the job ID and where
+// to follow it.
+func (s *server) writeAccepted(w http.ResponseWriter, j *job) {
+	_, info := s.lookupJob(context.Background(), j.ID)
+	link := s.basePath + "/jobs/" + j.ID
+	w.Header().Set("X-Job-Id", j.ID)
+	w.Header().Set("Location", link)
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": j.ID, "state": info.State, "url": link})
+}
+
+// lookupJob returns a job of this instance or, with a shared queue, a
+// snapshot of one another instance accepted or runs; nil if unknown.
+func (s *server) lookupJob(ctx context.Context, id string) (*job, jobInfo) {
+	if j, info := s.jobs.get(id); j != nil || s.shared == nil {
+		return j, info
+	}
+	info, out, ok := s.shared.info(ctx, id)
+	if !ok {
+		return nil, info
+	}
+	j := &job{jobInfo: info, ep: findEndpoint(s.eps, info), out: &jobOutput{}, remote: true}
+	j.out.buf.Write(out)
+	return j, info
+}
+
+// serveJob handles /jobs/<id>, /jobs/<id>/output and cancellation
+// (DELETE /jobs/<id> or POST /jobs/<id>/cancel). It takes the auth of
+// the job's endpoint (or ADMIN_AUTH).
+func (s *server) serveJob(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	allow := "GET, HEAD"
+	switch sub {
+	case "":
+		allow = "GET, HEAD, DELETE"
+	case "cancel", "redrive":
+		allow = http.MethodPost
+	}
+	if !slices.Contains(strings.Split(allow, ", "), r.Method) {
+		w.Header().Set("Allow", allow)
+		s.fail(w, r, nil, errorData{Kind: "method_not_allowed", Status: http.StatusMethodNotAllowed, Message: "method not allowed"})
+		return
+	}
+	j, info := s.lookupJob(r.Context(), id)
+	if j == nil || (sub != "" && sub != "output" && sub != "cancel" && sub != "redrive") {
+		s.fail(w, r, nil, errorData{Kind: "not_found", Status: http.StatusNotFound, Message: "404 page not found"})
+		return
+	}
+	if !s.authorizedFor(r, j.ep) {
+		s.fail(w, r, nil, errorData{Kind: "unauthorized", Status: http.StatusUnauthorized, Message: "unauthorized"})
+		return
+	}
+	switch {
+	case sub == "output":
+		s.serveJobOutput(w, r, j, info)
+	case sub == "redrive":
+		s.redriveJob(w, r, j)
+	case (sub == "cancel" || r.Method == http.MethodDelete) && j.remote:
+		if info.Finished != nil {
+			s.fail(w, r, j.ep, errorData{Kind: "bad_request", Status: http.StatusConflict, Message: "job is already " + info.State})
+			return
+		}
+		if err := s.shared.cancel(r.Context(), id); err != nil {
+			s.fail(w, r, j.ep, errorData{Kind: "error", Status: http.StatusInternalServerError, Message: "shared queue: " + err.Error()})
+			return
+		}
+		logf(r.Context(), "job %s %s %s: cancel requested", j.ID, j.Method, j.URI)
+		writeJSON(w, http.StatusAccepted, info)
+	case sub == "cancel" || r.Method == http.MethodDelete:
+		if j.cancel == nil && info.Finished == nil {
+			s.fail(w, r, j.ep, errorData{Kind: "bad_request", Status: http.StatusConflict, Message: "job is run by the previous server process"})
+			return
+		}
+		if !s.jobs.cancel(j) {
+			s.fail(w, r, j.ep, errorData{Kind: "bad_request", Status: http.StatusConflict, Message: "job is already " + info.State})
+			return
+		}
+		logf(r.Context(), "job %s %s %s: cancel requested", j.ID, j.Method, j.URI)
+		_, info = s.jobs.get(id)
+		writeJSON(w, http.StatusAccepted, info)
+	default:
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+// listJobs handles GET /jobs: the jobs the caller may see (all with
+// ADMIN_AUTH, else those of endpoints whose token it carries), newest
+// first, filtered by endpoint, method, state, since and until, a page of
+// limit at a time.
+func (s *server) listJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		s.fail(w, r, nil, errorData{Kind: "method_not_allowed", Status: http.StatusMethodNotAllowed, Message: "method not allowed"})
+		return
+	}
+	if !s.authorizedFor(r, nil) && !slices.ContainsFunc(s.eps, func(ep *Endpoint) bool { return ep.Async && s.authorizedFor(r, ep) }) {
+		s.fail(w, r, nil, errorData{Kind: "unauthorized", Status: http.StatusUnauthorized, Message: "unauthorized"})
+		return
+	}
+	q := r.URL.Query()
+	bad := func(msg string) {
+		s.fail(w, r, nil, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: msg})
+	}
+	var since, until time.Time
+	var err error
+	if v := q.Get("since"); v != "" {
+		if since, err = parseSince(v); err != nil {
+			bad("bad since: " + err.Error())
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if until, err = parseSince(v); err != nil {
+			bad("bad until: " + err.Error())
+			return
+		}
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 1000 {
+			bad("bad limit, want 1 to 1000")
+			return
+		}
+	}
+	var after *jobInfo // the last job of the previous page
+	if v := q.Get("cursor"); v != "" {
+		ts, id, ok := strings.Cut(v, ".")
+		ns, err := strconv.ParseInt(ts, 10, 64)
+		if !ok || err != nil {
+			bad("bad cursor")
+			return
+		}
+		after = &jobInfo{ID: id, Created: time.Unix(0, ns).UTC()}
+	}
+	states := q["state"]
+	if len(states) == 1 {
+		states = strings.Split(states[0], ",")
+	}
+	jobs := s.jobs.list(func(j *job) bool {
+		switch {
+		case q.Has("endpoint") && j.URI != q.Get("endpoint"),
+			q.Has("batch") && j.Batch != q.Get("batch"),
+			q.Has("method") && j.Method != strings.ToUpper(q.Get("method")),
+			len(states) > 0 && !slices.Contains(states, j.State),
+			!since.IsZero() && j.Created.Before(since),
+			!until.IsZero() && !j.Created.Before(until),
+			after != nil && !j.Created.Before(after.Created) && (!j.Created.Equal(after.Created) || j.ID >= after.ID):
+			return false
+		}
+		return s.authorizedFor(r, j.ep)
+	})
+	page := struct {
+		Jobs   []jobInfo `json:"jobs"`
+		Cursor string    `json:"next_cursor,omitempty"` // pass as cursor for the next page
+	}{Jobs: jobs}
+	if len(jobs) > limit {
+		page.Jobs = jobs[:limit]
+		last := page.Jobs[limit-1]
+		page.Cursor = strconv.FormatInt(last.Created.UnixNano(), 10) + "." + last.ID
+	}
+	if page.Jobs == nil {
+		page.Jobs = []jobInfo{}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// parseSince reads a point in time: RFC 3339, or a duration back from
+// now ("24h").
+func parseSince(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// redriveJob runs a dead job again as a new job, with the same params,
+// stdin, batch and callback.
+func (s *server) redriveJob(w http.ResponseWriter, r *http.Request, j *job) {
+	conflict := func(msg string) {
+		s.fail(w, r, j.ep, errorData{Kind: "bad_request", Status: http.StatusConflict, Message: msg})
+	}
+	if j.remote || j.ep == nil {
+		conflict("job can't be re-driven here")
+		return
+	}
+	if !s.queue.admit(j.ep) {
+		s.rejectBusy(w, r, j.ep)
+		return
+	}
+	run, err := s.jobs.takeDead(j)
+	if err != nil {
+		s.queue.release(j.ep)
+		conflict(err.Error())
+		return
+	}
+	nj := &job{}
+	sc, err := run.apply(nj)
+	if err != nil {
+		s.jobs.redriven(j, "")
+		s.queue.release(j.ep)
+		conflict("can't re-drive: " + err.Error())
+		return
+	}
+	_, info := s.jobs.get(j.ID)
+	nj = s.startJob(r.Context(), j.ep, sc, nj.params, nil, jobOptions{callback: nj.callback, batch: info.Batch})
+	s.jobs.redriven(j, nj.ID)
+	logf(r.Context(), "job %s %s %s: re-driven as %s", j.ID, j.Method, j.URI, nj.ID)
+	s.writeAccepted(w, nj)
+}
+
+// serveJobOutput returns the output so far, with Range support, or its
+// last lines with ?tail=N; with ?follow=1 it keeps sending output until
+// the job is over.
+func (s *server) serveJobOutput(w http.ResponseWriter, r *http.Request, j *job, info jobInfo) {
+	out := j.out.bytes()
+	h := w.Header()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("X-Job-State", info.State)
+	follow := r.URL.Query().Get("follow") == "1" && !j.remote
+	size := int64(len(out))
+	if t := r.URL.Query().Get("tail"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil || n < 0 {
+			s.fail(w, r, j.ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: "bad tail"})
+			return
+		}
+		out = tailLines(out, n)
+		if !follow {
+			h.Set("Content-Length", strconv.Itoa(len(out)))
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(out)
+			return
+		}
+	}
+	if follow {
+		s.followJobOutput(w, r, j, out, size)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(out))
+}
+
+// followJobOutput sends out, then the output after off as the script
+// writes it, until the job is over or the caller goes away.
+func (s *server) followJobOutput(w http.ResponseWriter, r *http.Request, j *job, out []byte, off int64) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // nginx: don't buffer
+	fw := flushWriter{w, http.NewResponseController(w)}
+	w.WriteHeader(http.StatusOK)
+	if _, err := fw.Write(out); err != nil || r.Method == http.MethodHead {
+		return
+	}
+	// a job of the process we took over from writes behind our back
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+	for {
+		changed := j.out.wait()
+		_, info := s.jobs.get(j.ID)
+		more := j.out.from(off)
+		off += int64(len(more))
+		if len(more) > 0 {
+			if _, err := fw.Write(more); err != nil {
+				return
+			}
+		}
+		if info.Finished != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-poll.C:
+		}
+	}
+}
+
+// tailLines returns the last n lines of b.
+func tailLines(b []byte, n int) []byte {
+	if n == 0 {
+		return nil
+	}
+	end := len(b)
+	if end > 0 && b[end-1] == '\n' {
+		end-- // a trailing newline doesn't start a line
+	}
+	for i := end - 1; i >= 0; i-- {
+		if b[i] == '\n' {
+			if n--; n == 0 {
+				return b[i+1:]
+			}
+		}
+	}
+	return b
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobTimeout   = "timeout"
+	jobCanceled  = "canceled"
+	jobDead      = "dead"     // failed for good, kept to re-drive (dead_letter)
+	jobRedriven  = "redriven" // a dead job run again as redriven_as
+)
+
+// jobInfo is the public record of a job, as served by /jobs/<id> and
+// stored as JOBS_DIR/<id>.json.
+type jobInfo struct {
+	ID        string       `json:"id"`
+	Method    string       `json:"method"`
+	URI       string       `json:"uri"` // endpoint uri template
+	Host      string       `json:"host,omitempty"`
+	State     string       `json:"state"`
+	Error     string       `json:"error,omitempty"` // why a job ended without running to completion
+	Created   time.Time    `json:"created"`
+	NotBefore *time.Time   `json:"not_before,omitempty"` // delayed: start no earlier than this
+	Started   *time.Time   `json:"started,omitempty"`
+	Finished  *time.Time   `json:"finished,omitempty"`
+	ExitCode  *int         `json:"exit_code,omitempty"`
+	Attempts  int          `json:"attempts,omitempty"`    // runs so far, with retries
+	Progress  *jobProgress `json:"progress,omitempty"`    // last PROGRESS: line of the script
+	Redriven  string       `json:"redriven_as,omitempty"` // the job that re-drove this dead one
+	Duration  int64        `json:"duration_ms,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	Batch     string       `json:"batch,omitempty"` // batch trigger the job came from
+	ServerPID int          `json:"server_pid"`      // the shhoook process running the job
+}
+
+// job is one execution of an async endpoint. jobInfo is guarded by the
+// store's mutex.
+type job struct {
+	jobInfo
+	ep          *Endpoint          // nil for a stored job whose endpoint is gone
+	cancel      context.CancelFunc // nil for jobs of another process
+	foreign     bool               // still run by the process we took over from
+	remote      bool               // a snapshot from the shared queue
+	canceled    bool
+	out         *jobOutput
+	params      map[string]string
+	tmp         []string  // files to remove once the job is over
+	callback    string    // URL to POST the finished job to
+	run         *jobRun   // how to re-drive a dead letter, without JOBS_DIR
+	saved       time.Time // last record save, to pace progress updates
+	savePending bool      // a paced save is scheduled
+}
+
+// jobOutput is a job's interleaved stdout and stderr, readable while
+// the script writes to it: in memory, or in JOBS_LOG_DIR/<id>.log.
+type jobOutput struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	path    string        // "" = in memory
+	f       *os.File      // open while the job runs
+	changed chan struct{} // closed on the next write, see wait
+}
+
+func (o *jobOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.notify()
+	if o.path == "" {
+		return o.buf.Write(p)
+	}
+	if o.f == nil {
+		f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return 0, err
+		}
+		o.f = f
+	}
+	return o.f.Write(p)
+}
+
+// wait returns a channel closed when output is added or the job is over.
+func (o *jobOutput) wait() <-chan struct{} {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.changed == nil {
+		o.changed = make(chan struct{})
+	}
+	return o.changed
+}
+
+// notify wakes up waiters. Called with o.mu held.
+func (o *jobOutput) notify() {
+	if o.changed != nil {
+		close(o.changed)
+		o.changed = nil
+	}
+}
+
+// from returns the output from offset off on.
+func (o *jobOutput) from(off int64) []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.path == "" {
+		if off >= int64(o.buf.Len()) {
+			return nil
+		}
+		return bytes.Clone(o.buf.Bytes()[off:])
+	}
+	f, err := os.Open(o.path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return nil
+	}
+	b, _ := io.ReadAll(f)
+	return b
+}
+
+// bytes returns a copy of the output so far.
+func (o *jobOutput) bytes() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.path == "" {
+		return bytes.Clone(o.buf.Bytes())
+	}
+	b, _ := os.ReadFile(o.path)
+	return b
+}
+
+// size is the number of output bytes so far.
+func (o *jobOutput) size() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.path == "" {
+		return int64(o.buf.Len())
+	}
+	fi, err := os.Stat(o.path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func (o *jobOutput) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.notify()
+	if o.f != nil {
+		o.f.Close()
+		o.f = nil
+	}
+}
+
+// jobStore keeps all unfinished jobs and the last keep finished ones,
+// in memory and, with JOBS_DIR, on disk.
+type jobStore struct {
+	mu      sync.Mutex
+	jobs    map[string]*job
+	done    []string // finished job IDs, oldest first
+	keep    int
+	dir     string // JOBS_DIR, "" = memory only
+	logDir  string // JOBS_LOG_DIR (JOBS_DIR by default), "" = output in memory
+	running sync.WaitGroup
+	resume  []*job        // interrupted jobs to run again, see resumeJobs
+	publish func(jobInfo) // mirrors every record update; nil = off
+}
+
+// jobRun is what it takes to run a job again after a restart, stored as
+// JOBS_DIR/<id>.run.json for endpoints with a resume policy.
+type jobRun struct {
+	Argv     []string          `json:"argv"`
+	Steps    [][]string        `json:"steps,omitempty"`
+	Env      []string          `json:"env,omitempty"`
+	Stdin    []byte            `json:"stdin,omitempty"`
+	Params   map[string]string `json:"params"`
+	Tmp      []string          `json:"tmp,omitempty"`
+	Callback string            `json:"callback,omitempty"`
+}
+
+// findEndpoint returns the endpoint a job record belongs to; nil if it
+// is gone.
+func findEndpoint(eps []*Endpoint, info jobInfo) *Endpoint {
+	for _, ep := range eps {
+		if ep.Method == info.Method && ep.URI == info.URI && ep.Host == info.Host {
+			return ep
+		}
+	}
+	return nil
+}
+
+// newJobStore creates the store and loads the jobs kept in dir. Jobs
+// that were still queued or running when the server stopped are marked
+// failed, except those the parent is still draining after an upgrade
+// (their records are re-read until they finish) and those their
+// endpoint's resume policy runs again.
+func newJobStore(keep int, dir, logDir string, eps []*Endpoint) (*jobStore, error) {
+	if logDir == "" {
+		logDir = dir
+	}
+	st := &jobStore{jobs: map[string]*job{}, keep: keep, dir: dir, logDir: logDir}
+	if logDir != "" {
+		if err := os.MkdirAll(logDir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	if dir == "" {
+		return st, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var done []*job
+	for _, f := range files {
+		if strings.HasSuffix(f, ".run.json") {
+			continue
+		}
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		j := &job{}
+		if err := json.Unmarshal(b, &j.jobInfo); err != nil || !resultID.MatchString(j.ID) {
+			log.Printf("jobs: skipping %s: not a job record", f)
+			continue
+		}
+		j.out = &jobOutput{path: st.logPath(j.ID)}
+		j.ep = findEndpoint(eps, j.jobInfo)
+		st.jobs[j.ID] = j
+		if j.Finished == nil && handedOff() && j.ServerPID == os.Getppid() {
+			j.foreign = true
+			continue
+		}
+		if j.Finished == nil && j.ep != nil && (j.ep.Resume == "all" || j.ep.Resume == "queued" && j.Started == nil) {
+			if _, err := os.Stat(st.runPath(j.ID)); err == nil {
+				st.resume = append(st.resume, j)
+				continue
+			}
+		}
+		if j.Finished == nil {
+			now := time.Now().UTC()
+			j.State, j.Error, j.Finished = jobFailed, "interrupted by a restart", &now
+			if _, err := os.Stat(st.runPath(j.ID)); err == nil && j.ep != nil && j.ep.DeadLetter {
+				j.State = jobDead
+			} else {
+				os.Remove(st.runPath(j.ID))
+			}
+			st.save(j)
+		}
+		done = append(done, j)
+	}
+	sort.Slice(done, func(a, b int) bool { return done[a].Finished.Before(*done[b].Finished) })
+	sort.Slice(st.resume, func(a, b int) bool { return st.resume[a].Created.Before(st.resume[b].Created) })
+	for _, j := range done {
+		st.done = append(st.done, j.ID)
+	}
+	st.trim()
+	return st, nil
+}
+
+func (st *jobStore) recordPath(id string) string { return filepath.Join(st.dir, id+".json") }
+func (st *jobStore) logPath(id string) string    { return filepath.Join(st.logDir, id+".log") }
+func (st *jobStore) runPath(id string) string    { return filepath.Join(st.dir, id+".run.json") }
+
+// saveRun stores how to run j again, if its endpoint resumes jobs or
+// keeps dead letters.
+func (st *jobStore) saveRun(j *job, sc *scriptCmd) {
+	if j.ep.Resume != "" || j.ep.DeadLetter {
+		st.keepRun(j, newJobRun(j, sc))
+	}
+}
+
+// keepRun stores run for j: in JOBS_DIR, or in memory for dead letters.
+func (st *jobStore) keepRun(j *job, run jobRun) {
+	if st.dir == "" {
+		if j.ep.DeadLetter {
+			j.run = &run
+		}
+		return
+	}
+	b, _ := json.Marshal(run)
+	if err := os.WriteFile(st.runPath(j.ID), b, 0o600); err != nil {
+		errorf(context.Background(), "jobs: save %s: %v", j.ID, err)
+	}
+}
+
+// newJobRun captures j's invocation. It reads sc's stdin and replaces it
+// with a copy.
+func newJobRun(j *job, sc *scriptCmd) jobRun {
+	run := jobRun{Argv: sc.argv, Steps: sc.steps, Env: sc.env, Params: j.params, Tmp: j.tmp, Callback: j.callback}
+	if sc.stdin != nil {
+		run.Stdin, _ = io.ReadAll(sc.stdin)
+		sc.stdin = bytes.NewReader(run.Stdin)
+	}
+	return run
+}
+
+// apply sets up j to run again as recorded and returns its scriptCmd.
+func (run *jobRun) apply(j *job) (*scriptCmd, error) {
+	if len(run.Argv) == 0 {
+		return nil, errors.New("empty run record")
+	}
+	for _, f := range run.Tmp {
+		if _, err := os.Stat(f); err != nil {
+			return nil, err
+		}
+	}
+	j.params, j.tmp, j.callback = run.Params, run.Tmp, run.Callback
+	sc := &scriptCmd{argv: run.Argv, steps: run.Steps, env: run.Env}
+	if run.Stdin != nil {
+		sc.stdin = bytes.NewReader(run.Stdin)
+	}
+	return sc, nil
+}
+
+// loadRun reads back what saveRun stored, into j and a new scriptCmd.
+func (st *jobStore) loadRun(j *job) (*scriptCmd, error) {
+	run, err := st.readRun(j)
+	if err != nil {
+		return nil, err
+	}
+	return run.apply(j)
+}
+
+func (st *jobStore) readRun(j *job) (*jobRun, error) {
+	if st.dir == "" {
+		if j.run == nil {
+			return nil, errors.New("no run record")
+		}
+		return j.run, nil
+	}
+	b, err := os.ReadFile(st.runPath(j.ID))
+	if err != nil {
+		return nil, err
+	}
+	run := &jobRun{}
+	if err := json.Unmarshal(b, run); err != nil {
+		return nil, fmt.Errorf("%s: bad run record", st.runPath(j.ID))
+	}
+	return run, nil
+}
+
+// newOutput returns where a new job writes its output.
+func (st *jobStore) newOutput(id string) *jobOutput {
+	if st.logDir == "" {
+		return &jobOutput{}
+	}
+	return &jobOutput{path: st.logPath(id)}
+}
+
+// save writes the job record to disk, if the store has a dir, and
+// publishes it to the shared queue, if there is one. Called
+// with st.mu held (or before the job is shared).
+func (st *jobStore) save(j *job) {
+	j.saved = time.Now()
+	if st.publish != nil {
+		st.publish(j.jobInfo)
+	}
+	if st.dir == "" {
+		return
+	}
+	// a record that can't be encoded keeps the last one on disk
+	b, err := json.Marshal(j.jobInfo)
+	tmp := st.recordPath(j.ID) + ".tmp"
+	if err == nil {
+		err = os.WriteFile(tmp, b, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, st.recordPath(j.ID))
+	}
+	if err != nil {
+		errorf(context.Background(), "jobs: save %s: %v", j.ID, err)
+	}
+}
+
+// trim drops the oldest finished jobs beyond keep. Called with st.mu
+// held.
+func (st *jobStore) trim() {
+	for len(st.done) > st.keep {
+		st.dropOldest()
+	}
+}
+
+// dropOldest forgets the oldest finished job and deletes its files.
+// Called with st.mu held.
+func (st *jobStore) dropOldest() {
+	id := st.done[0]
+	delete(st.jobs, id)
+	st.done = st.done[1:]
+	if st.dir != "" {
+		os.Remove(st.recordPath(id))
+		os.Remove(st.runPath(id))
+	}
+	if st.logDir != "" {
+		os.Remove(st.logPath(id))
+	}
+}
+
+// sweep drops finished jobs older than maxAge, then the oldest ones
+// until their output adds up to at most maxBytes (0 = no limit). It
+// returns how many jobs went.
+func (st *jobStore) sweep(maxAge time.Duration, maxBytes int64) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	n := 0
+	if maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge)
+		for len(st.done) > 0 && st.jobs[st.done[0]].Finished.Before(cutoff) {
+			st.dropOldest()
+			n++
+		}
+	}
+	if maxBytes > 0 {
+		var total int64
+		for _, id := range st.done {
+			total += st.jobs[id].out.size()
+		}
+		for len(st.done) > 0 && total > maxBytes {
+			total -= st.jobs[st.done[0]].out.size()
+			st.dropOldest()
+			n++
+		}
+	}
+	return n
+}
+
+func (st *jobStore) add(j *job) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.jobs[j.ID] = j
+	st.save(j)
+}
+
+// requeue puts a resumed job back in the queue, under this process.
+func (st *jobStore) requeue(j *job) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	j.State, j.Started, j.Progress, j.ServerPID = jobQueued, nil, nil, os.Getpid()
+	st.save(j)
+}
+
+// abandon ends a job that can't be resumed as failed.
+func (st *jobStore) abandon(j *job, why string) {
+	j.out.close()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now().UTC()
+	j.State, j.Error, j.Finished = jobFailed, why, &now
+	st.save(j)
+	os.Remove(st.runPath(j.ID))
+	st.done = append(st.done, j.ID)
+	st.trim()
+}
+
+// setRunning marks a job as started; false if it was canceled first.
+func (st *jobStore) setRunning(j *job) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if j.canceled {
+		return false
+	}
+	now := time.Now().UTC()
+	j.State, j.Started, j.NotBefore = jobRunning, &now, nil
+	j.Attempts++
+	st.save(j)
+	return true
+}
+
+// retry queues j again after a failed run, once its endpoint's
+// retry_delay (doubled for every earlier retry) is over. It reports
+// false if j has no retries left or was canceled.
+func (st *jobStore) retry(j *job, res *runResult) (time.Time, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if j.canceled || j.ep == nil || j.Attempts > j.ep.Retries {
+		return time.Time{}, false
+	}
+	at := time.Now().UTC().Add(j.ep.retryDelay << min(j.Attempts-1, 16))
+	j.State, j.NotBefore, j.ExitCode = jobQueued, &at, &res.exitCode
+	st.save(j)
+	return at, true
+}
+
+// takeDead claims a dead job for a re-drive and returns how to run it.
+func (st *jobStore) takeDead(j *job) (*jobRun, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if j.State != jobDead {
+		return nil, fmt.Errorf("job is %s, not %s", j.State, jobDead)
+	}
+	run, err := st.readRun(j)
+	if err != nil {
+		return nil, err
+	}
+	j.State = jobRedriven
+	return run, nil
+}
+
+// redriven records the job that re-drove dead job j; "" if none could
+// start, and j is dead again.
+func (st *jobStore) redriven(j *job, id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if id == "" {
+		j.State = jobDead
+		return
+	}
+	j.Redriven, j.run = id, nil
+	st.save(j)
+	if st.dir != "" {
+		os.Remove(st.runPath(j.ID))
+	}
+}
+
+// setProgress records line if it reports progress. The record is saved
+// at most every progressSaveEvery.
+func (st *jobStore) setProgress(j *job, line string) {
+	if !strings.HasPrefix(line, progressPrefix) {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var prev jobProgress
+	if j.Progress != nil {
+		prev = *j.Progress
+	}
+	p, _ := parseProgress(line, prev)
+	j.Progress = &p
+	wait := progressSaveEvery - time.Since(j.saved)
+	switch {
+	case wait <= 0:
+		st.save(j)
+	case !j.savePending:
+		// the last update of a burst is saved too
+		j.savePending = true
+		time.AfterFunc(wait, func() {
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			j.savePending = false
+			if j.Finished == nil {
+				st.save(j)
+			}
+		})
+	}
+}
+
+// finish records the result of a run and drops the oldest finished
+// jobs. It returns the final state.
+func (st *jobStore) finish(j *job, res *runResult) string {
+	j.out.close()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now().UTC()
+	j.Finished = &now
+	j.ExitCode = &res.exitCode
+	j.Duration = res.duration.Milliseconds()
+	switch {
+	case j.canceled:
+		j.State = jobCanceled
+	case res.timedOut:
+		j.State = jobTimeout
+	case res.err != nil:
+		j.State = jobFailed
+	default:
+		j.State = jobSucceeded
+	}
+	if j.canceled && j.Started == nil {
+		j.Error = "canceled before it started"
+	}
+	if (j.State == jobFailed || j.State == jobTimeout) && j.ep != nil && j.ep.DeadLetter {
+		j.State, j.Error = jobDead, fmt.Sprintf("%s after %d attempts", j.State, j.Attempts)
+	}
+	st.save(j)
+	if j.State != jobDead {
+		j.run = nil
+		if st.dir != "" {
+			os.Remove(st.runPath(j.ID))
+		}
+	}
+	st.done = append(st.done, j.ID)
+	st.trim()
+	return j.State
+}
+
+// get returns the job and a snapshot of its record; nil if unknown.
+func (st *jobStore) get(id string) (*job, jobInfo) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	j := st.jobs[id]
+	if j == nil {
+		return nil, jobInfo{}
+	}
+	st.refresh(j)
+	return j, j.jobInfo
+}
+
+// list returns the jobs keep accepts, newest first.
+func (st *jobStore) list(keep func(*job) bool) []jobInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var out []jobInfo
+	for _, j := range st.jobs {
+		st.refresh(j)
+		if keep(j) {
+			out = append(out, j.jobInfo)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if !out[a].Created.Equal(out[b].Created) {
+			return out[a].Created.After(out[b].Created)
+		}
+		return out[a].ID > out[b].ID
+	})
+	return out
+}
+
+// refresh re-reads the record of a job the previous process is still
+// running. Called with st.mu held.
+func (st *jobStore) refresh(j *job) {
+	if !j.foreign || j.Finished != nil {
+		return
+	}
+	var info jobInfo
+	if b, err := os.ReadFile(st.recordPath(j.ID)); err == nil && json.Unmarshal(b, &info) == nil {
+		j.jobInfo = info
+	}
+	if j.Finished != nil {
+		st.done = append(st.done, j.ID)
+		st.trim()
+	}
+}
+
+// cancel stops a job: the script gets the endpoint's kill sequence, a
+// queued job won't start. It reports false if the job is already over.
+func (st *jobStore) cancel(j *job) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if j.Finished != nil {
+		return false
+	}
+	j.canceled = true
+	j.cancel()
+	return true
+}
+
+// wait blocks until all jobs are over or ctx expires.
+func (st *jobStore) wait(ctx context.Context) error {
+	return waitGroup(ctx, &st.running)
+}
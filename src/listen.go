@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type listenSpec struct {
+	name string // listener name used by endpoint "listeners"; defaults to addr
+	addr string
+	ln   net.Listener   // inherited socket, nil means bind addr ourselves
+	pc   net.PacketConn // the same for HTTP/3's UDP socket
+}
+
+// redirectListener names REDIRECT_ADDR's socket among those inherited.
+const redirectListener = "redirect"
+
+// listenFdsStart is the first fd passed by systemd socket activation.
+const listenFdsStart = 3
+
+// activatedListeners returns the sockets passed via systemd socket
+// activation (LISTEN_PID/LISTEN_FDS/LISTEN_FDNAMES) or by upgrade, or nil
+// if there are none. Listeners are named after FileDescriptorName= from
+// the .socket unit; a datagram socket is the HTTP/3 side of the stream
+// socket of the same name.
+func activatedListeners() ([]listenSpec, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if (err != nil || pid != os.Getpid()) && !handedOff() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var out, udp []listenSpec
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		var l listenSpec
+		if ln, err := net.FileListener(f); err == nil {
+			l = listenSpec{addr: ln.Addr().String(), ln: ln}
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			l = listenSpec{addr: pc.LocalAddr().String(), pc: pc}
+		} else {
+			f.Close()
+			return nil, fmt.Errorf("inherited fd %d: %v", fd, err)
+		}
+		f.Close()
+		l.name = l.addr
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			l.name = names[i]
+		}
+		if l.pc != nil {
+			udp = append(udp, l)
+			continue
+		}
+		if hasListener(out, l.name) {
+			return nil, fmt.Errorf("duplicate listener %q", l.name)
+		}
+		out = append(out, l)
+	}
+	for _, u := range udp {
+		i := slices.IndexFunc(out, func(l listenSpec) bool { return l.name == u.name })
+		if i < 0 || out[i].pc != nil {
+			return nil, fmt.Errorf("datagram socket %q without a listener of its own", u.name)
+		}
+		out[i].pc = u.pc
+	}
+	return out, nil
+}
+
+// parseListeners parses LISTEN_ADDR: a comma-separated list of host:port
+// (IP, [IPv6] or resolvable hostname), each optionally named as
+// name=host:port.
+func parseListeners(v string) ([]listenSpec, error) {
+	var out []listenSpec
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		l := listenSpec{name: item, addr: item}
+		if name, addr, ok := strings.Cut(item, "="); ok {
+			l.name, l.addr = strings.TrimSpace(name), strings.TrimSpace(addr)
+		}
+		if err := checkAddr(l.addr); err != nil {
+			return nil, err
+		}
+		if l.name != l.addr && (l.name == "" || strings.Contains(l.name, ":")) {
+			return nil, fmt.Errorf("bad listener name %q", l.name)
+		}
+		if hasListener(out, l.name) {
+			return nil, fmt.Errorf("duplicate listener %q", l.name)
+		}
+		out = append(out, l)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no listen address")
+	}
+	return out, nil
+}
+
+// checkAddr validates a host:port bind address; hostnames must resolve.
+func checkAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "" {
+		return fmt.Errorf("must be host:port, got %q", addr)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("bad port in %q", addr)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return fmt.Errorf("cannot resolve %q: %v", host, err)
+		}
+	}
+	return nil
+}
+
+func hasListener(ls []listenSpec, name string) bool {
+	for _, l := range ls {
+		if l.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// servedOn reports whether the endpoint is reachable via the named listener.
+func (ep *Endpoint) servedOn(listener string) bool {
+	if len(ep.Listeners) == 0 {
+		return true
+	}
+	for _, l := range ep.Listeners {
+		if l == listener {
+			return true
+		}
+	}
+	return false
+}
+
+// limitListener caps the number of simultaneously open connections
+// across all listeners sharing sem; Accept blocks while it is full.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func limitListen(ln net.Listener, sem chan struct{}) net.Listener {
+	if sem == nil {
+		return ln
+	}
+	return &limitListener{Listener: ln, sem: sem}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.sem <- struct{}{}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
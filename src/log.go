@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jsonLogs is set by LOG_FORMAT=json: every log line is a JSON record,
+// and the details logAttrs is given become fields of it.
+var jsonLogs bool
+
+// structuredLogs is set when records go through slog's default handler
+// with their level and details: LOG_FORMAT=json, syslog or journald.
+var structuredLogs bool
+
+// logLevel is the least level logf and co. write: LOG_LEVEL, changed at
+// runtime by PUT /admin/log-level or SIGUSR1. Lines about the server
+// itself (log.Printf: startup, shutdown, fatal errors) are always written.
+var logLevel = new(slog.LevelVar)
+
+// levelState is what a runtime change of logLevel goes back to, and when.
+var levelState struct {
+	sync.Mutex
+	base   slog.Level  // LOG_LEVEL
+	until  time.Time   // zero: no revert pending
+	revert *time.Timer // nil: none pending
+}
+
+// parseLevel reads debug, info, warn or error.
+func parseLevel(v string) (slog.Level, error) {
+	switch strings.ToLower(v) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("want debug, info, warn or error, got %q", v)
+}
+
+func levelName(l slog.Level) string { return strings.ToLower(l.String()) }
+
+// setLogLevel changes the level, going back to LOG_LEVEL after d if d > 0.
+func setLogLevel(l slog.Level, d time.Duration) {
+	levelState.Lock()
+	defer levelState.Unlock()
+	if levelState.revert != nil {
+		levelState.revert.Stop()
+		levelState.revert, levelState.until = nil, time.Time{}
+	}
+	logLevel.Set(l)
+	if d > 0 && l != levelState.base {
+		levelState.until = time.Now().Add(d)
+		levelState.revert = time.AfterFunc(d, func() {
+			levelState.Lock()
+			defer levelState.Unlock()
+			logLevel.Set(levelState.base)
+			levelState.revert, levelState.until = nil, time.Time{}
+			log.Printf("log level back to %s", levelName(levelState.base))
+		})
+	}
+}
+
+// toggleDebug switches between debug and LOG_LEVEL, for SIGUSR1.
+func toggleDebug() slog.Level {
+	l := slog.LevelDebug
+	if logLevel.Level() == slog.LevelDebug {
+		l = levelState.base
+	}
+	setLogLevel(l, 0)
+	return l
+}
+
+// setupLogging sends the log to w (stderr or LOG_FILE) in LOG_FORMAT, or
+// to sink (LOG_SYSLOG, LOG_JOURNALD) if set.
+func setupLogging(format string, w io.Writer, sink logSink) error {
+	switch format {
+	case "text":
+	case "json":
+		jsonLogs = true
+	default:
+		return fmt.Errorf("want text or json, got %q", format)
+	}
+	// log.Printf goes through the default handler from here on
+	switch {
+	case sink != nil:
+		structuredLogs = true
+		slog.SetDefault(slog.New(&sinkHandler{sink: sink}))
+	case jsonLogs:
+		structuredLogs = true
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	default:
+		log.SetOutput(w)
+	}
+	return nil
+}
+
+// logf logs a line about a request, prefixed with its ID (a request_id
+// field in JSON).
+func logf(ctx context.Context, format string, args ...any) {
+	logAttrs(ctx, slog.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+// debugf logs what the server makes of a request, for when a hook
+// misbehaves: merged params, resolved argv. Values that may be secret
+// are redacted.
+func debugf(ctx context.Context, format string, args ...any) {
+	logAttrs(ctx, slog.LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func debugOn() bool { return logLevel.Level() <= slog.LevelDebug }
+
+// warnf logs something that went wrong for a request or job; errorf,
+// something wrong with the server or what it depends on. The level only
+// shows in JSON, syslog and journald.
+func warnf(ctx context.Context, format string, args ...any) {
+	logAttrs(ctx, slog.LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func errorf(ctx context.Context, format string, args ...any) {
+	logAttrs(ctx, slog.LevelError, fmt.Sprintf(format, args...))
+}
+
+// logAttrs logs msg about a request; attrs only show in structured logs,
+// so msg should carry what a reader of the text log needs too.
+func logAttrs(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	if level < logLevel.Level() {
+		return
+	}
+	id := requestID(ctx)
+	if !structuredLogs {
+		if id != "" {
+			msg = "[" + id + "] " + msg
+		}
+		log.Print(msg)
+		return
+	}
+	if id != "" {
+		attrs = append([]slog.Attr{slog.String("request_id", id)}, attrs...)
+	}
+	slog.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// runAttrs describes a finished script run.
+func runAttrs(ep *Endpoint, res *runResult) []slog.Attr {
+	return []slog.Attr{
+		slog.String("endpoint", ep.URI),
+		slog.Int("exit_code", res.exitCode),
+		slog.Int64("duration_ms", res.duration.Milliseconds()),
+	}
+}
+
+// logRequest logs a request that was routed to an endpoint once it is
+// answered; exit is its X-Exit-Code, if any.
+func logRequest(r *http.Request, endpoint string, status int, d time.Duration, exit string) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	msg := fmt.Sprintf("%s %s from %s: %d in %dms", r.Method, r.URL.Path, ip, status, d.Milliseconds())
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("endpoint", endpoint),
+		slog.String("remote_ip", ip),
+		slog.Int("status", status),
+		slog.Int64("duration_ms", d.Milliseconds()),
+	}
+	if code, err := strconv.Atoi(exit); err == nil {
+		msg += fmt.Sprintf(", exit code %d", code)
+		attrs = append(attrs, slog.Int("exit_code", code))
+	}
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	}
+	logAttrs(r.Context(), level, msg, attrs...)
+}
+
+// secretName matches param names whose values debugf leaves out.
+var secretName = regexp.MustCompile(`(?i)token|secret|passw|key|auth|signature|credential|session|cookie`)
+
+// secretValues are the values among params that debug lines redact: of
+// secret-looking names, or equal to the endpoint's token.
+func secretValues(ep *Endpoint, params map[string]string) []string {
+	var out []string
+	for k, v := range params {
+		if _, named := ep.tokenNames[v]; v != "" && (secretName.MatchString(k) || v == ep.token || named) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// redact replaces the secrets in v, and cuts it to 200 bytes. Secrets
+// shorter than 6 bytes are only replaced when they are all of v, lest
+// "t" turn "feat" into "fea***".
+func redact(v string, secrets []string) string {
+	for _, sv := range secrets {
+		if v == sv {
+			return "***"
+		}
+	}
+	v = maskSecrets(v, secrets)
+	if len(v) > 200 {
+		v = v[:200] + "..."
+	}
+	return v
+}
+
+// maskSecrets replaces the secrets of at least 6 bytes in v.
+func maskSecrets(v string, secrets []string) string {
+	for _, sv := range secrets {
+		if len(sv) >= 6 {
+			v = strings.ReplaceAll(v, sv, "***")
+		}
+	}
+	return v
+}
+
+// maskQuery replaces the values of secret-looking query params in a
+// request URI, so a token a sender can only pass in the URL stays out of
+// the access log.
+func maskQuery(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	pairs := strings.Split(query, "&")
+	for i, kv := range pairs {
+		k, _, _ := strings.Cut(kv, "=")
+		if name, err := url.QueryUnescape(k); err == nil && secretName.MatchString(name) {
+			pairs[i] = k + "=***"
+		}
+	}
+	return path + "?" + strings.Join(pairs, "&")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rotatingFile is a log file (LOG_FILE, ACCESS_LOG) that is moved aside
+// as <path>.<time> once it grows past maxBytes or has been written to
+// for maxAge, keeping the newest keep of those, gzipped if compress.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64         // 0 = no size limit
+	maxAge   time.Duration // 0 = no age limit
+	keep     int           // 0 = keep all
+	compress bool
+
+	f      *os.File
+	size   int64
+	opened time.Time
+
+	bg sync.Mutex // one compress-and-prune pass at a time
+}
+
+// rotatedSuffix matches what rotate appends to the path.
+var rotatedSuffix = regexp.MustCompile(`^\.\d{8}-\d{6}\.\d{3}(\.gz)?$`)
+
+const rotatedTimeFormat = "20060102-150405.000"
+
+func openRotatingFile(path string, maxBytes int64, maxAge time.Duration, keep int, compress bool) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes, maxAge: maxAge, keep: keep, compress: compress}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// openLogFile opens a log file with the LOG_MAX_* rotation settings.
+func openLogFile(path string) (*rotatingFile, error) {
+	return openRotatingFile(path, int64(getint("LOG_MAX_BYTES", 0)), getduration("LOG_MAX_AGE", "0"), getint("LOG_KEEP", 0), getenv("LOG_COMPRESS", "") == "1")
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size, rf.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.size > 0 && (rf.maxBytes > 0 && rf.size+int64(len(p)) > rf.maxBytes || rf.maxAge > 0 && time.Since(rf.opened) >= rf.maxAge) {
+		if err := rf.rotate(); err != nil {
+			// keep writing to the file we have rather than lose lines
+			stderrf("log file %s: rotate: %v", rf.path, err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one.
+func (rf *rotatingFile) rotate() error {
+	old := rf.path + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(rf.path, old); err != nil {
+		return err
+	}
+	prev := rf.f
+	if err := rf.open(); err != nil {
+		_ = os.Rename(old, rf.path) // carry on with the old file
+		return err
+	}
+	prev.Close()
+	go rf.tidy()
+	return nil
+}
+
+// tidy compresses rotated files, if asked to, and drops all but the
+// newest keep; files an earlier run left uncompressed are picked up too.
+func (rf *rotatingFile) tidy() {
+	rf.bg.Lock()
+	defer rf.bg.Unlock()
+	old := rf.rotated()
+	if rf.compress {
+		for i, p := range old {
+			if filepath.Ext(p) == ".gz" {
+				continue
+			}
+			if err := gzipFile(p); err != nil {
+				stderrf("log file %s: compress: %v", p, err)
+				continue
+			}
+			old[i] = p + ".gz"
+		}
+	}
+	if rf.keep > 0 && len(old) > rf.keep {
+		for _, p := range old[:len(old)-rf.keep] {
+			os.Remove(p)
+		}
+	}
+}
+
+// rotated lists the rotated files, oldest first.
+func (rf *rotatingFile) rotated() []string {
+	matches, _ := filepath.Glob(rf.path + ".*")
+	var out []string
+	for _, m := range matches {
+		if rotatedSuffix.MatchString(m[len(rf.path):]) {
+			out = append(out, m)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// gzipFile replaces p with p.gz.
+func gzipFile(p string) error {
+	in, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := p + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, p+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(p)
+}
+
+// stderrf reports trouble with a log file where it can still be seen:
+// the log itself may be what is failing.
+func stderrf(format string, args ...any) {
+	log.New(os.Stderr, "", log.LstdFlags).Printf(format, args...)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logSink takes log records somewhere other than a stream: a syslog
+// server (LOG_SYSLOG) or journald (LOG_JOURNALD).
+type logSink interface {
+	send(level slog.Level, t time.Time, msg string, attrs []slog.Attr) error
+}
+
+// sinkHandler is the slog handler in front of a logSink. A record the
+// sink can't take is written to stderr instead.
+type sinkHandler struct {
+	sink  logSink
+	attrs []slog.Attr
+}
+
+// Enabled lets everything through; logAttrs does the filtering.
+func (h *sinkHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *sinkHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := slices.Clone(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	if err := h.sink.send(r.Level, r.Time, r.Message, attrs); err != nil {
+		stderrf("%s (not sent: %v)", textMessage(r.Message, attrs), err)
+	}
+	return nil
+}
+
+func (h *sinkHandler) WithAttrs(as []slog.Attr) slog.Handler {
+	return &sinkHandler{sink: h.sink, attrs: append(slices.Clone(h.attrs), as...)}
+}
+
+// WithGroup is not used here; grouped attrs are kept flat.
+func (h *sinkHandler) WithGroup(string) slog.Handler { return h }
+
+// textMessage is msg as the text log has it: prefixed with the request ID.
+func textMessage(msg string, attrs []slog.Attr) string {
+	for _, a := range attrs {
+		if a.Key == "request_id" {
+			return "[" + a.Value.String() + "] " + msg
+		}
+	}
+	return msg
+}
+
+// jsonMessage is a record as LOG_FORMAT=json writes it.
+func jsonMessage(level slog.Level, t time.Time, msg string, attrs []slog.Attr) []byte {
+	var b bytes.Buffer
+	field := func(k string, v any) {
+		if b.Len() == 0 {
+			b.WriteByte('{')
+		} else {
+			b.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		vb, err := json.Marshal(v)
+		if err != nil {
+			vb, _ = json.Marshal(fmt.Sprint(v))
+		}
+		b.Write(kb)
+		b.WriteByte(':')
+		b.Write(vb)
+	}
+	field("time", t)
+	field("level", level.String())
+	field("msg", msg)
+	for _, a := range attrs {
+		field(a.Key, a.Value.Any())
+	}
+	b.WriteByte('}')
+	return b.Bytes()
+}
+
+// syslogSeverity maps a level to an RFC 5424 severity.
+func syslogSeverity(l slog.Level) int {
+	switch {
+	case l >= slog.LevelError:
+		return 3 // err
+	case l >= slog.LevelWarn:
+		return 4 // warning
+	case l >= slog.LevelInfo:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSDID names the structured data element the details go in; 32473
+// is the enterprise number RFC 5612 sets aside for examples.
+const syslogSDID = "shhoook@32473"
+
+// syslogRedial is how long a syslog server that can't be reached is left
+// alone, the lines meanwhile going to stderr.
+const syslogRedial = 10 * time.Second
+
+const syslogTimeout = 5 * time.Second
+
+// syslogSink sends RFC 5424 messages over UDP, TCP, TLS or a local unix
+// socket, redialing after errors.
+type syslogSink struct {
+	network  string // udp, tcp, tls or unixgram
+	addr     string
+	facility int
+	host     string
+	app      string
+	json     bool // MSG is the JSON record rather than the text line
+
+	mu     sync.Mutex
+	conn   net.Conn
+	failed time.Time // of the last failed dial or write
+}
+
+// newSyslogSink reads LOG_SYSLOG: udp://host[:514], tcp://host[:601],
+// tls://host[:6514] or unix:///dev/log.
+func newSyslogSink(raw, facility, app string, jsonMsg bool) (*syslogSink, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	fac, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility %q", facility)
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "-"
+	}
+	s := &syslogSink{facility: fac, host: host, app: app, json: jsonMsg}
+	ports := map[string]string{"udp": "514", "tcp": "601", "tls": "6514"}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("%s: no host", raw)
+		}
+		port := u.Port()
+		if port == "" {
+			port = ports[u.Scheme]
+		}
+		s.network, s.addr = u.Scheme, net.JoinHostPort(u.Hostname(), port)
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("%s: no socket path", raw)
+		}
+		s.network, s.addr = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("%s: want udp://, tcp://, tls:// or unix://", raw)
+	}
+	return s, nil
+}
+
+func (s *syslogSink) dial() error {
+	d := &net.Dialer{Timeout: syslogTimeout}
+	var err error
+	if s.network == "tls" {
+		s.conn, err = (&tls.Dialer{NetDialer: d}).Dial("tcp", s.addr)
+	} else {
+		s.conn, err = d.Dial(s.network, s.addr)
+	}
+	return err
+}
+
+// format renders a message, framed by octet counting on streams (RFC
+// 6587, 5425).
+func (s *syslogSink) format(level slog.Level, t time.Time, msg string, attrs []slog.Attr) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - ", s.facility*8+syslogSeverity(level), t.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), s.host, s.app, os.Getpid())
+	if len(attrs) == 0 {
+		b.WriteByte('-')
+	} else {
+		b.WriteString("[" + syslogSDID)
+		for _, a := range attrs {
+			b.WriteString(" " + sdName(a.Key) + `="` + sdEscaper.Replace(a.Value.String()) + `"`)
+		}
+		b.WriteByte(']')
+	}
+	b.WriteByte(' ')
+	if s.json {
+		b.Write(jsonMessage(level, t, msg, attrs))
+	} else {
+		b.WriteString(textMessage(msg, attrs))
+	}
+	if s.network == "tcp" || s.network == "tls" {
+		return append([]byte(strconv.Itoa(b.Len())+" "), b.Bytes()...)
+	}
+	return b.Bytes()
+}
+
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// sdName makes a key a valid SD-NAME: printable ASCII but = ] " and
+// space, up to 32 characters.
+func sdName(k string) string {
+	b := []byte(k)
+	for i, c := range b {
+		if c <= ' ' || c >= 0x7f || c == '=' || c == ']' || c == '"' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 32 {
+		b = b[:32]
+	}
+	return string(b)
+}
+
+var errSyslogDown = errors.New("syslog server unreachable, retrying soon")
+
+func (s *syslogSink) send(level slog.Level, t time.Time, msg string, attrs []slog.Attr) error {
+	b := s.format(level, t, msg, attrs)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a connection the server dropped only fails on the write, so a
+	// fresh one gets a second try
+	for try := 0; try < 2; try++ {
+		if s.conn == nil {
+			if time.Since(s.failed) < syslogRedial {
+				return errSyslogDown
+			}
+			if err := s.dial(); err != nil {
+				s.failed = time.Now()
+				return err
+			}
+		}
+		_ = s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		_, err := s.conn.Write(b)
+		if err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+		if try == 1 {
+			s.failed = time.Now()
+			return err
+		}
+	}
+	return nil
+}
+
+// journalSocket is where journald takes native protocol datagrams.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalSink sends records to journald with their details as fields:
+// REQUEST_ID, ENDPOINT, STATUS and so on.
+type journalSink struct {
+	conn  *net.UnixConn
+	ident string
+}
+
+func newJournalSink(ident string) (*journalSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalSink{conn: conn, ident: ident}, nil
+}
+
+func (j *journalSink) send(level slog.Level, _ time.Time, msg string, attrs []slog.Attr) error {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", textMessage(msg, attrs))
+	journalField(&b, "PRIORITY", strconv.Itoa(syslogSeverity(level)))
+	journalField(&b, "SYSLOG_IDENTIFIER", j.ident)
+	for _, a := range attrs {
+		if k := journalName(a.Key); k != "" {
+			journalField(&b, k, a.Value.String())
+		}
+	}
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
+
+// journalField writes one field of the native protocol; values with a
+// newline go length-prefixed.
+func journalField(b *bytes.Buffer, k, v string) {
+	if !strings.Contains(v, "\n") {
+		b.WriteString(k + "=" + v + "\n")
+		return
+	}
+	b.WriteString(k + "\n")
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(v)))
+	b.WriteString(v + "\n")
+}
+
+// journalName makes a key a journal field name: upper case letters,
+// digits and underscores, not starting with one ("" if nothing is left).
+func journalName(k string) string {
+	b := []byte(strings.ToUpper(k))
+	for i, c := range b {
+		if !('A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return strings.TrimLeft(string(b), "_0123456789")
+}
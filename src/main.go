@@ -2,38 +2,148 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 )
 
 type Endpoint struct {
-	URI    string            `json:"uri"`    // "/run/:name/*rest"
-	Method string            `json:"method"` // "POST"
-	Query  map[string]string `json:"query"`  // defaults for query
-	Body   map[string]string `json:"body"`   // defaults for body
-	Auth   string            `json:"auth"`   // "X-Token:SECRET"
-	TTL    string            `json:"ttl"`    // "8s"
-	Error  int               `json:"error"`  // http code on error
-	Script []string          `json:"script"` // argv with {placeholders}
+	URI    string            `json:"uri"`      // "/run/:name/*rest"
+	About  string            `json:"about"`    // free text, shown in /admin/endpoints
+	Method string            `json:"method"`   // "POST"
+	Query  map[string]string `json:"query"`    // defaults for query
+	Body   map[string]string `json:"body"`     // defaults for body
+	Auth   string            `json:"auth"`     // "X-Token:SECRET"
+	Tokens map[string]string `json:"tokens"`   // more tokens for auth's header, by caller name: {"ci": "SECRET2"}
+	TTL    string            `json:"ttl"`      // "8s"
+	Error  int               `json:"error"`    // http code on error
+	Status int               `json:"status"`   // http code on success (200)
+	Script []string          `json:"script"`   // argv with {placeholders}
+	Steps  [][]string        `json:"steps"`    // more argv run after script while each succeeds
+	Prio   int               `json:"priority"` // higher is matched first
+	Host   string            `json:"host"`     // "ops.example.com" or "*.example.com"; empty = any
+
+	GitHub       *githubFilter       `json:"github"`       // only run for these GitHub deliveries; with a secret, auth may be left out
+	GitLab       *gitlabFilter       `json:"gitlab"`       // only run for these GitLab events
+	Bitbucket    *bitbucketFilter    `json:"bitbucket"`    // only run for these Bitbucket events; with a secret, auth may be left out
+	Registry     *registryFilter     `json:"registry"`     // only run for these image pushes; with a secret or token, auth may be left out
+	Alertmanager *alertmanagerFilter `json:"alertmanager"` // take Alertmanager notifications: run for these alerts, per group or per alert
+	Grafana      *grafanaFilter      `json:"grafana"`      // take Grafana alerting webhooks: run for these alerts and states, per group or per alert
+
+	Type     string `json:"type"`     // "" (run script), "proxy" or "static"
+	Upstream string `json:"upstream"` // proxy: "http://10.0.0.5:9000/hook/{name}"
+	Root     string `json:"root"`     // static: directory served under the uri's wildcard
+	Response string `json:"response"` // "" (output as text), "json" (exit code, stdout, stderr, ...), "file" or "result" (script-built)
+
+	ContentType string     `json:"content_type"` // of the output: "" (text/plain), a media type, or "auto"
+	Stream      streamMode `json:"stream"`       // true: send output as it is produced; "sse"/"websocket": as messages
+
+	ResponseTemplate string            `json:"response_template"` // text/template over responseData
+	RespHeaders      map[string]string `json:"response_headers"`  // name -> value with {placeholders}
+	OutputFile       string            `json:"output_file"`       // response "file": path with {placeholders}; empty = temp file
+	ResultDelim      string            `json:"result_delimiter"`  // response "result": line after which stdout holds the result; empty = last line
+
+	Compress    bool `json:"compress"`           // gzip/deflate responses for clients that accept it
+	CompressMin int  `json:"compress_min_bytes"` // smaller responses are sent as is (default 1024)
+	SpoolBytes  int  `json:"spool_bytes"`        // larger output is stored in RESULTS_DIR, 0 = never
+
+	Cache    string `json:"cache"`    // "30s": reuse successful results for identical commands
+	Redirect string `json:"redirect"` // on success: 302 to this URL, with {placeholders}
+	Sanitize bool   `json:"sanitize"` // strip ANSI escapes and control characters from output
+
+	MaxOutput    int  `json:"max_output_bytes"` // output beyond this is dropped and marked; 0 = no limit
+	MaxBody      int  `json:"max_body_bytes"`   // request bodies beyond this get 413; 0 = MAX_BODY_BYTES
+	LogOutput    bool `json:"log_output"`       // also write every line of output to the server log
+	PrefixOutput bool `json:"prefix_output"`    // async: start every line of stored output with the job ID
+
+	Upload   *uploadConfig   `json:"upload"`    // store output and artifacts in S3_ENDPOINT
+	Async    bool            `json:"async"`     // answer 202 with a job ID, run in the background
+	MaxDelay string          `json:"max_delay"` // async: longest delay a caller may ask for; "" = no delays
+	Callback *callbackConfig `json:"callback"`  // async: POST the finished job here
+	Dedup    *dedupConfig    `json:"dedup"`     // coalesce identical triggers within a window
+	Resume   string          `json:"resume"`    // async, with JOBS_DIR: "" (fail), "queued" or "all": jobs a restart interrupted run again
+	Batch    int             `json:"batch"`     // async: a JSON array body starts a job per item, up to this many; 0 = off
+
+	Retries    int    `json:"retries"`     // async: runs again after a failure or timeout, up to this many times
+	RetryDelay string `json:"retry_delay"` // before the first retry (10s), doubling after each
+	DeadLetter bool   `json:"dead_letter"` // async: keep jobs that failed for good as "dead", to re-drive by hand
+
+	MaxQueue  int `json:"max_queue"`      // pending runs of this endpoint before 429; 0 = no limit
+	Workers   int `json:"workers"`        // runs of this endpoint at a time; 0 = up to WORKERS
+	QueuePrio int `json:"queue_priority"` // higher runs first when waiting for a worker
+
+	Schedule string `json:"schedule"` // cron expression: also run with default params on this schedule
+
+	KillSignal string `json:"kill_signal"` // sent to the script's process group on timeout/cancel (TERM)
+	KillGrace  string `json:"kill_grace"`  // then SIGKILL after this long (5s)
+
+	Slow       string `json:"slow"`        // warn about runs still going after this long, short of ttl
+	SlowNotify string `json:"slow_notify"` // and POST a notice here
+
+	Report string `json:"report"` // to SENTRY_DSN/ERROR_WEBHOOK: "" (failures and timeouts), "timeouts" or "off"
+
+	Listeners []string `json:"listeners"` // listener names this endpoint is served on; empty = all
+	CORS      []string `json:"cors"`      // browser origins allowed to call this endpoint, or "*"
+	Head      string   `json:"head"`      // HEAD on a GET endpoint: "" (run the script) or "skip"
+
+	Errors errorPages `json:"errors"` // templated error bodies by kind, override ERROR_PAGES
+
+	Computed map[string]string `json:"computed"`      // name -> expression over params
+	ParamMap map[string]string `json:"param_map"`     // incoming name -> template name
+	Policy   string            `json:"params_policy"` // "" (open) or "strict"
+	Cookies  map[string]string `json:"cookies"`       // allowlisted cookies with defaults
+	Headers  map[string]string `json:"headers"`       // allowlisted headers with defaults
+
+	Precedence []string        `json:"precedence"`    // param source merge order, later wins
+	Schema     json.RawMessage `json:"schema"`        // JSON Schema for the body: inline or file path
+	BodyFormat string          `json:"body_format"`   // "" (by Content-Type), json, form, multipart, xml, raw
+	BodyEnc    string          `json:"body_encoding"` // "" or "base64": decode the raw body first
+	BodyTo     string          `json:"body_to"`       // "" or "stdin" / "file": hand the raw body to the script
 
 	// compiled
-	pathRe   *regexp.Regexp
-	wildcard bool
-	header   string
-	token    string
-	timeout  time.Duration
+	segs       []uriSeg
+	header     string
+	token      string
+	tokenNames map[string]string // token -> name, from tokens and auth ("default")
+	filter     deliveryFilter    // github, gitlab or bitbucket
+	timeout    time.Duration
+	slow       time.Duration
+	computed   []computedParam
+	precedence []string
+	schema     *jsonSchema
+	respTmpl   *template.Template
+	cache      *resultCache
+	killSignal syscall.Signal
+	killGrace  time.Duration
+	sched      *cronSpec
+	maxDelay   time.Duration
+	dedup      *dedupGroup
+	retryDelay time.Duration
+}
+
+type computedParam struct {
+	name string
+	expr *expr
 }
 
 func getenv(k, d string) string {
@@ -43,6 +153,28 @@ func getenv(k, d string) string {
 	return d
 }
 
+// getduration reads a duration env var; a bad value is fatal.
+func getduration(k, d string) time.Duration {
+	v, err := time.ParseDuration(getenv(k, d))
+	if err != nil {
+		log.Fatalf("%s: %v", k, err)
+	}
+	return v
+}
+
+// getint reads an integer env var; a bad value is fatal.
+func getint(k string, d int) int {
+	v := os.Getenv(k)
+	if v == "" {
+		return d
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Fatalf("%s: want a non-negative integer, got %q", k, v)
+	}
+	return n
+}
+
 func parseAuth(a string) (hdr, tok string, err error) {
 	parts := strings.SplitN(a, ":", 2)
 	if len(parts) != 2 {
@@ -56,33 +188,32 @@ func parseAuth(a string) (hdr, tok string, err error) {
 	return h, t, nil
 }
 
-func compileURI(pattern string) (*regexp.Regexp, bool, error) {
-	segs := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
-	var b strings.Builder
-	b.WriteString("^")
-	wild := false
-	for i, s := range segs {
-		if s == "" {
-			continue
-		}
-		b.WriteString("/")
-		if strings.HasPrefix(s, ":") {
-			name := s[1:]
-			b.WriteString("(?P<" + name + ">[^/]+)")
-		} else if strings.HasPrefix(s, "*") {
-			if i != len(segs)-1 {
-				return nil, false, fmt.Errorf("wildcard must be last")
-			}
-			name := s[1:]
-			wild = true
-			b.WriteString("(?P<" + name + ">.*)")
-		} else {
-			b.WriteString(regexp.QuoteMeta(s))
-		}
+// tokenName is what names in tokens may be; they end up in metric labels.
+var tokenName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// checkToken reports whether tok is one of ep's tokens, and by which name
+// ("" when the endpoint has no named tokens).
+func (ep *Endpoint) checkToken(tok string) (name string, ok bool) {
+	if ep.token == "" {
+		return "", false // signed deliveries only
+	}
+	if ep.tokenNames == nil {
+		return "", tok == ep.token
 	}
-	b.WriteString("$")
-	re, err := regexp.Compile(b.String())
-	return re, wild, err
+	name, ok = ep.tokenNames[tok]
+	return name, ok
+}
+
+// killSignals are the signals kill_signal accepts, "" meaning TERM.
+var killSignals = map[string]syscall.Signal{
+	"":     syscall.SIGTERM,
+	"TERM": syscall.SIGTERM,
+	"INT":  syscall.SIGINT,
+	"HUP":  syscall.SIGHUP,
+	"QUIT": syscall.SIGQUIT,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"KILL": syscall.SIGKILL,
 }
 
 func mustEndpointFromFile(path string) (*Endpoint, error) {
@@ -94,15 +225,71 @@ func mustEndpointFromFile(path string) (*Endpoint, error) {
 	if err := json.Unmarshal(b, &ep); err != nil {
 		return nil, fmt.Errorf("%s: %w", path, err)
 	}
-	// required
-	if ep.URI == "" || ep.Method == "" || ep.Auth == "" || len(ep.Script) == 0 {
-		return nil, fmt.Errorf("%s: missing required fields (uri/method/auth/script)", path)
-	}
-	h, t, err := parseAuth(ep.Auth)
-	if err != nil {
+	if ep.filter, err = deliveryFilterOf(&ep); err != nil {
 		return nil, fmt.Errorf("%s: %v", path, err)
 	}
-	ep.header, ep.token = h, t
+	// required; a signature check stands in for auth
+	signed := deliveryCredential(&ep) != ""
+	switch ep.Type {
+	case "":
+		if ep.URI == "" || ep.Method == "" || ep.Auth == "" && !signed || len(ep.Script) == 0 {
+			return nil, fmt.Errorf("%s: missing required fields (uri/method/auth/script)", path)
+		}
+	case "proxy":
+		if ep.URI == "" || ep.Method == "" || ep.Auth == "" && !signed || ep.Upstream == "" {
+			return nil, fmt.Errorf("%s: missing required fields (uri/method/auth/upstream)", path)
+		}
+		if !strings.HasPrefix(ep.Upstream, "http://") && !strings.HasPrefix(ep.Upstream, "https://") {
+			return nil, fmt.Errorf("%s: upstream must be an http:// or https:// url", path)
+		}
+	case "static":
+		if ep.URI == "" || ep.Auth == "" || ep.Root == "" {
+			return nil, fmt.Errorf("%s: missing required fields (uri/auth/root)", path)
+		}
+		if ep.Method == "" {
+			ep.Method = http.MethodGet
+		}
+		if ep.Method != http.MethodGet {
+			return nil, fmt.Errorf("%s: static endpoints only serve GET", path)
+		}
+		if fi, err := os.Stat(ep.Root); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("%s: root %q is not a directory", path, ep.Root)
+		}
+	default:
+		return nil, fmt.Errorf("%s: bad type %q", path, ep.Type)
+	}
+	for i, st := range ep.Steps {
+		if ep.Type != "" || len(st) == 0 {
+			return nil, fmt.Errorf("%s: steps[%d]: steps need a script endpoint and a command", path, i)
+		}
+	}
+	if ep.Auth == "" {
+		// checked once the body is read; not for what answers before
+		if ep.Stream == "websocket" || len(ep.Tokens) > 0 {
+			return nil, fmt.Errorf("%s: auth is required with stream: websocket or tokens", path)
+		}
+		if c := deliveryCredential(&ep); !strings.HasPrefix(c, "?") {
+			ep.header = c
+		}
+	} else {
+		h, t, err := parseAuth(ep.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		ep.header, ep.token = h, t
+	}
+	if len(ep.Tokens) > 0 {
+		ep.tokenNames = map[string]string{ep.token: "default"}
+		for name, tok := range ep.Tokens {
+			if !tokenName.MatchString(name) || name == "default" {
+				return nil, fmt.Errorf("%s: bad token name %q", path, name)
+			}
+			if tok = strings.TrimSpace(tok); tok == "" || ep.tokenNames[tok] != "" {
+				return nil, fmt.Errorf("%s: tokens.%s: want a token of its own", path, name)
+			}
+			ep.tokenNames[tok] = name
+		}
+	}
 	if ep.TTL == "" {
 		ep.TTL = "8s"
 	}
@@ -111,21 +298,298 @@ func mustEndpointFromFile(path string) (*Endpoint, error) {
 		return nil, fmt.Errorf("%s: bad ttl: %v", path, err)
 	}
 	ep.timeout = d
+	if ep.Slow != "" {
+		d, err := time.ParseDuration(ep.Slow)
+		if err != nil || d <= 0 || ep.timeout > 0 && d >= ep.timeout {
+			return nil, fmt.Errorf("%s: bad slow %q: want a duration short of ttl", path, ep.Slow)
+		}
+		ep.slow = d
+	}
+	if ep.SlowNotify != "" {
+		if ep.slow == 0 {
+			return nil, fmt.Errorf("%s: slow_notify needs slow", path)
+		}
+		if u, err := url.Parse(ep.SlowNotify); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s: bad slow_notify url %q", path, ep.SlowNotify)
+		}
+	}
+	switch ep.Report {
+	case "", "timeouts", "off":
+	default:
+		return nil, fmt.Errorf("%s: bad report %q", path, ep.Report)
+	}
+	sig, ok := killSignals[strings.TrimPrefix(strings.ToUpper(ep.KillSignal), "SIG")]
+	if !ok {
+		return nil, fmt.Errorf("%s: bad kill_signal %q", path, ep.KillSignal)
+	}
+	ep.killSignal = sig
+	if ep.KillGrace == "" {
+		ep.KillGrace = "5s"
+	}
+	if ep.killGrace, err = time.ParseDuration(ep.KillGrace); err != nil || ep.killGrace < 0 {
+		return nil, fmt.Errorf("%s: bad kill_grace %q", path, ep.KillGrace)
+	}
 	if ep.Error == 0 {
 		ep.Error = 500
 	}
+	if ep.Status == 0 {
+		ep.Status = http.StatusOK
+	}
+	if ep.Status < 200 || ep.Status > 599 {
+		return nil, fmt.Errorf("%s: bad status %d", path, ep.Status)
+	}
 	if ep.Query == nil {
 		ep.Query = map[string]string{}
 	}
 	if ep.Body == nil {
 		ep.Body = map[string]string{}
 	}
-	re, wild, err := compileURI(ep.URI)
+	segs, err := parseURI(ep.URI)
 	if err != nil {
 		return nil, fmt.Errorf("%s: bad uri: %v", path, err)
 	}
-	ep.pathRe = re
-	ep.wildcard = wild
+	ep.segs = segs
+	ep.precedence = defaultPrecedence
+	if len(ep.Precedence) > 0 {
+		seen := map[string]bool{}
+		for _, src := range ep.Precedence {
+			known := false
+			for _, d := range defaultPrecedence {
+				known = known || d == src
+			}
+			if !known || seen[src] {
+				return nil, fmt.Errorf("%s: precedence: unknown or duplicate source %q", path, src)
+			}
+			seen[src] = true
+		}
+		ep.precedence = ep.Precedence
+	}
+	switch ep.BodyFormat {
+	case "", "json", "form", "multipart", "xml", "raw":
+	default:
+		return nil, fmt.Errorf("%s: bad body_format %q", path, ep.BodyFormat)
+	}
+	if err := ep.Errors.compile(); err != nil {
+		return nil, fmt.Errorf("%s: errors: %v", path, err)
+	}
+	if ep.ResultDelim != "" && (ep.Response != "result" || strings.ContainsAny(ep.ResultDelim, "\r\n")) {
+		return nil, fmt.Errorf("%s: result_delimiter needs response: result and must be one line", path)
+	}
+	switch ep.Response {
+	case "", "json", "result":
+		if ep.OutputFile != "" {
+			return nil, fmt.Errorf("%s: output_file needs response: file", path)
+		}
+		if ep.Response == "result" && ep.Stream != "" {
+			return nil, fmt.Errorf("%s: stream and response: result don't mix", path)
+		}
+	case "file":
+		if ep.Stream != "" {
+			return nil, fmt.Errorf("%s: stream and response: file don't mix", path)
+		}
+	default:
+		return nil, fmt.Errorf("%s: bad response %q", path, ep.Response)
+	}
+	if ep.ContentType != "" && ep.ContentType != "auto" {
+		if _, _, err := mime.ParseMediaType(ep.ContentType); err != nil {
+			return nil, fmt.Errorf("%s: bad content_type: %v", path, err)
+		}
+	}
+	switch ep.Stream {
+	case "", "chunked", "sse":
+	case "websocket":
+		if ep.Method != http.MethodGet {
+			return nil, fmt.Errorf("%s: stream websocket needs method GET", path)
+		}
+	default:
+		return nil, fmt.Errorf("%s: bad stream %q", path, ep.Stream)
+	}
+	if ep.Stream != "" && ep.Response == "json" {
+		return nil, fmt.Errorf("%s: stream and response: json don't mix", path)
+	}
+	if ep.Stream != "" && (ep.Status == http.StatusNoContent || ep.Status == http.StatusNotModified) {
+		return nil, fmt.Errorf("%s: stream needs a status with a body, not %d", path, ep.Status)
+	}
+	if ep.Response == "file" && ep.Status != http.StatusOK {
+		return nil, fmt.Errorf("%s: response: file always answers 200, drop status", path)
+	}
+	for k := range ep.RespHeaders {
+		if k == "" || strings.ContainsAny(k, " \t\r\n:") {
+			return nil, fmt.Errorf("%s: response_headers: bad name %q", path, k)
+		}
+	}
+	if ep.ResponseTemplate != "" {
+		if ep.Stream != "" || ep.Response != "" {
+			return nil, fmt.Errorf("%s: response_template doesn't mix with stream or response", path)
+		}
+		t, err := compileResponseTemplate(ep.ResponseTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("%s: response_template: %v", path, err)
+		}
+		ep.respTmpl = t
+	}
+	if ep.Cache != "" {
+		ttl, err := time.ParseDuration(ep.Cache)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("%s: bad cache %q", path, ep.Cache)
+		}
+		if ep.Stream != "" || ep.Response == "file" || ep.SpoolBytes > 0 {
+			return nil, fmt.Errorf("%s: cache doesn't mix with stream, response: file or spool_bytes", path)
+		}
+		ep.cache = newResultCache(ttl)
+	}
+	if ep.Redirect != "" {
+		if !strings.HasPrefix(ep.Redirect, "/") && !strings.HasPrefix(ep.Redirect, "http://") && !strings.HasPrefix(ep.Redirect, "https://") {
+			return nil, fmt.Errorf("%s: redirect must be an absolute path or http(s) url", path)
+		}
+		if ep.Stream != "" || ep.Response != "" || ep.ResponseTemplate != "" || ep.Status != http.StatusOK || ep.SpoolBytes > 0 {
+			return nil, fmt.Errorf("%s: redirect doesn't mix with stream, response, response_template, status or spool_bytes", path)
+		}
+	}
+	if up := ep.Upload; up != nil {
+		if up.Bucket == "" || (up.Key == "" && len(up.Artifacts) == 0) {
+			return nil, fmt.Errorf("%s: upload needs a bucket and a key or artifacts", path)
+		}
+		if ep.Type != "" || ep.Stream != "" || ep.Response == "file" || ep.Response == "result" || ep.Cache != "" || ep.SpoolBytes > 0 {
+			return nil, fmt.Errorf("%s: upload doesn't mix with type, stream, response file/result, cache or spool_bytes", path)
+		}
+	}
+	if ep.Async {
+		if ep.Type != "" || ep.Stream != "" || ep.Response != "" || ep.ResponseTemplate != "" || ep.Redirect != "" || ep.Cache != "" || ep.SpoolBytes > 0 {
+			return nil, fmt.Errorf("%s: async doesn't mix with type, stream, response, response_template, redirect, cache or spool_bytes", path)
+		}
+	}
+	if ep.Schedule != "" {
+		if ep.Type != "" || ep.BodyTo == "file" || ep.Response == "file" {
+			return nil, fmt.Errorf("%s: schedule doesn't mix with type, body_to: file or response: file", path)
+		}
+		c, err := parseCron(ep.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad schedule %q: %v", path, ep.Schedule, err)
+		}
+		if c.next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("%s: schedule %q never matches", path, ep.Schedule)
+		}
+		ep.sched = c
+	}
+	if cb := ep.Callback; cb != nil {
+		if !ep.Async {
+			return nil, fmt.Errorf("%s: callback needs async", path)
+		}
+		if cb.URL == "" && !cb.FromHeader {
+			return nil, fmt.Errorf("%s: callback needs a url or from_header", path)
+		}
+	}
+	if dd := ep.Dedup; dd != nil {
+		window, err := time.ParseDuration(dd.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("%s: bad dedup window %q", path, dd.Window)
+		}
+		if ep.Type != "" || ep.Stream != "" || ep.Response == "file" || ep.SpoolBytes > 0 || (ep.Upload != nil && !ep.Async) {
+			return nil, fmt.Errorf("%s: dedup doesn't mix with type, stream, response: file, spool_bytes or a synchronous upload", path)
+		}
+		ep.dedup = newDedupGroup(window)
+	}
+	switch ep.Resume {
+	case "", "queued", "all":
+	default:
+		return nil, fmt.Errorf("%s: bad resume %q", path, ep.Resume)
+	}
+	if ep.Resume != "" && !ep.Async {
+		return nil, fmt.Errorf("%s: resume needs async", path)
+	}
+	if ep.PrefixOutput && !ep.Async {
+		return nil, fmt.Errorf("%s: prefix_output needs async", path)
+	}
+	if ep.Batch < 0 {
+		return nil, fmt.Errorf("%s: batch must be >= 0", path)
+	}
+	if ep.Batch > 0 && (!ep.Async || ep.Dedup != nil || ep.BodyTo == "file") {
+		return nil, fmt.Errorf("%s: batch needs async, and doesn't mix with dedup or body_to: file", path)
+	}
+	if src, ok := ep.filter.(alertSource); ok && src.perAlert() && (!ep.Async || ep.Dedup != nil || ep.BodyTo == "file") {
+		return nil, fmt.Errorf("%s: per: alert needs async, and doesn't mix with dedup or body_to: file", path)
+	}
+	if ep.Retries < 0 {
+		return nil, fmt.Errorf("%s: retries must be >= 0", path)
+	}
+	if (ep.Retries > 0 || ep.RetryDelay != "" || ep.DeadLetter) && !ep.Async {
+		return nil, fmt.Errorf("%s: retries, retry_delay and dead_letter need async", path)
+	}
+	ep.retryDelay = 10 * time.Second
+	if ep.RetryDelay != "" {
+		d, err := time.ParseDuration(ep.RetryDelay)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s: bad retry_delay %q", path, ep.RetryDelay)
+		}
+		ep.retryDelay = d
+	}
+	if ep.DeadLetter && ep.BodyTo == "file" {
+		return nil, fmt.Errorf("%s: dead_letter doesn't mix with body_to: file", path)
+	}
+	if ep.MaxDelay != "" {
+		if !ep.Async {
+			return nil, fmt.Errorf("%s: max_delay needs async", path)
+		}
+		d, err := time.ParseDuration(ep.MaxDelay)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s: bad max_delay %q", path, ep.MaxDelay)
+		}
+		ep.maxDelay = d
+	}
+	if ep.MaxQueue < 0 {
+		return nil, fmt.Errorf("%s: max_queue must be >= 0", path)
+	}
+	if ep.Workers < 0 {
+		return nil, fmt.Errorf("%s: workers must be >= 0", path)
+	}
+	if ep.MaxOutput < 0 {
+		return nil, fmt.Errorf("%s: bad max_output_bytes %d", path, ep.MaxOutput)
+	}
+	if ep.MaxBody < 0 {
+		return nil, fmt.Errorf("%s: bad max_body_bytes %d", path, ep.MaxBody)
+	}
+	if ep.SpoolBytes < 0 {
+		return nil, fmt.Errorf("%s: bad spool_bytes %d", path, ep.SpoolBytes)
+	}
+	if ep.CompressMin < 0 {
+		return nil, fmt.Errorf("%s: bad compress_min_bytes %d", path, ep.CompressMin)
+	}
+	if ep.CompressMin == 0 {
+		ep.CompressMin = 1024
+	}
+	if ep.Head != "" && ep.Head != "skip" {
+		return nil, fmt.Errorf("%s: bad head %q", path, ep.Head)
+	}
+	if ep.BodyEnc != "" && ep.BodyEnc != "base64" {
+		return nil, fmt.Errorf("%s: bad body_encoding %q", path, ep.BodyEnc)
+	}
+	if ep.BodyTo != "" && ep.BodyTo != "stdin" && ep.BodyTo != "file" {
+		return nil, fmt.Errorf("%s: bad body_to %q", path, ep.BodyTo)
+	}
+	if len(ep.Schema) > 0 {
+		sc, err := loadSchema(ep.Schema, path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: schema: %v", path, err)
+		}
+		ep.schema = sc
+	}
+	if ep.Policy != "" && ep.Policy != "strict" {
+		return nil, fmt.Errorf("%s: bad params_policy %q", path, ep.Policy)
+	}
+	for from, to := range ep.ParamMap {
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("%s: param_map: empty name", path)
+		}
+	}
+	for name, src := range ep.Computed {
+		x, err := compileExpr(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s: computed %s: %v", path, name, err)
+		}
+		ep.computed = append(ep.computed, computedParam{name: name, expr: x})
+	}
+	sort.Slice(ep.computed, func(i, j int) bool { return ep.computed[i].name < ep.computed[j].name })
 	return &ep, nil
 }
 
@@ -155,23 +619,59 @@ func loadEndpoints(dir string) ([]*Endpoint, error) {
 	if len(eps) == 0 {
 		return nil, fmt.Errorf("no endpoint configs found in %s", dir)
 	}
-	sort.Slice(eps, func(i, j int) bool { return eps[i].URI < eps[j].URI })
+	sort.SliceStable(eps, func(i, j int) bool { return moreSpecific(eps[i], eps[j]) })
 	return eps, nil
 }
 
-func pathVars(ep *Endpoint, p string) (map[string]string, bool) {
-	m := ep.pathRe.FindStringSubmatch(p)
-	if m == nil {
-		return nil, false
+// segRank orders URI segments: static < :param < *wildcard.
+func segRank(seg string) int {
+	switch {
+	case strings.HasPrefix(seg, ":"):
+		return 1
+	case strings.HasPrefix(seg, "*"):
+		return 2
 	}
-	out := map[string]string{}
-	for i, name := range ep.pathRe.SubexpNames() {
-		if i == 0 || name == "" {
-			continue
+	return 0
+}
+
+// moreSpecific reports whether a should be tried before b: explicit
+// priority first, then host-bound endpoints, then segment by segment
+// (static beats :param beats *wildcard), then more segments, then the
+// URI string.
+func moreSpecific(a, b *Endpoint) bool {
+	if a.Prio != b.Prio {
+		return a.Prio > b.Prio
+	}
+	if (a.Host != "") != (b.Host != "") {
+		return a.Host != ""
+	}
+	as := strings.Split(strings.Trim(a.URI, "/"), "/")
+	bs := strings.Split(strings.Trim(b.URI, "/"), "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if ra, rb := segRank(as[i]), segRank(bs[i]); ra != rb {
+			return ra < rb
 		}
-		out[name] = m[i]
 	}
-	return out, true
+	if len(as) != len(bs) {
+		return len(as) > len(bs)
+	}
+	return a.URI < b.URI
+}
+
+// hostMatches checks the request Host (port ignored) against ep.Host.
+func hostMatches(ep *Endpoint, host string) bool {
+	if ep.Host == "" {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	if strings.HasPrefix(ep.Host, "*.") {
+		suffix := ep.Host[1:]
+		return len(host) > len(suffix) && strings.EqualFold(host[len(host)-len(suffix):], suffix)
+	}
+	return strings.EqualFold(host, ep.Host)
 }
 
 func toString(v any) string {
@@ -196,140 +696,718 @@ func toString(v any) string {
 	}
 }
 
-func mergeParams(ep *Endpoint, pv map[string]string, r *http.Request) map[string]string {
-	params := map[string]string{}
-	// defaults
-	for k, v := range ep.Query {
-		params[k] = v
+// paramName maps an incoming param name to the name used in templates.
+func paramName(ep *Endpoint, k string) string {
+	if to, ok := ep.ParamMap[k]; ok {
+		return to
 	}
-	for k, v := range ep.Body {
-		params[k] = v
+	return k
+}
+
+// declared reports whether an incoming key is allowed under the
+// strict policy: it must be a default of its source or a param_map key.
+func declared(ep *Endpoint, defaults map[string]string, k string) bool {
+	if _, ok := defaults[k]; ok {
+		return true
 	}
-	// path
-	for k, v := range pv {
+	_, ok := ep.ParamMap[k]
+	return ok
+}
+
+// param sources, in default merge order (later wins)
+var defaultPrecedence = []string{"defaults", "path", "query", "cookies", "headers", "body"}
+
+func mergeParams(ep *Endpoint, pv map[string]string, r *http.Request, body *requestBody) (map[string]string, error) {
+	params := map[string]string{}
+	// at debug level, where each param came from and what it overrode
+	var from map[string][]string
+	set := func(k, v, src string) {
 		params[k] = v
+		if from != nil {
+			from[k] = append(from[k], src)
+		}
 	}
-	// query
-	q := r.URL.Query()
-	for k := range q {
-		params[k] = q.Get(k)
-	}
-	// body json
-	if r.Body != nil {
-		defer r.Body.Close()
-		var body map[string]any
-		dec := json.NewDecoder(r.Body)
-		dec.UseNumber()
-		if err := dec.Decode(&body); err == nil {
-			for k, v := range body {
-				params[k] = toString(v)
+	if debugOn() {
+		from = map[string][]string{}
+		defer func() { debugParams(r.Context(), ep, params, from) }()
+	}
+	for _, src := range ep.precedence {
+		switch src {
+		case "defaults":
+			for _, m := range []map[string]string{ep.Query, ep.Body, ep.Cookies, ep.Headers} {
+				for k, v := range m {
+					set(k, v, src)
+				}
+			}
+		case "path":
+			for k, v := range pv {
+				set(k, v, src)
+			}
+		case "query":
+			q := r.URL.Query()
+			for k := range q {
+				if ep.Policy == "strict" && !declared(ep, ep.Query, k) {
+					return nil, fmt.Errorf("unknown query parameter %q", k)
+				}
+				set(paramName(ep, k), q.Get(k), src)
+			}
+		case "cookies":
+			// allowlisted only
+			for _, c := range r.Cookies() {
+				if _, ok := ep.Cookies[c.Name]; ok {
+					set(paramName(ep, c.Name), c.Value, src)
+				}
+			}
+		case "headers":
+			// allowlisted only
+			for k := range ep.Headers {
+				if v := r.Header.Get(k); v != "" {
+					set(paramName(ep, k), v, src)
+				}
+			}
+		case "body":
+			if body.format == "raw" {
+				set("__body", string(body.raw), src)
+				continue
+			}
+			m, _ := body.data.(map[string]any)
+			for k, v := range m {
+				if ep.Policy == "strict" && !declared(ep, ep.Body, k) {
+					return nil, fmt.Errorf("unknown body parameter %q", k)
+				}
+				set(paramName(ep, k), toString(v), src)
 			}
 		}
 	}
-	return params
+	return params, nil
+}
+
+// debugParams logs the merged params, each with the source that set it
+// and those it won over: branch="main" (body, over query, defaults).
+func debugParams(ctx context.Context, ep *Endpoint, params map[string]string, from map[string][]string) {
+	secrets := secretValues(ep, params)
+	keys := make([]string, 0, len(from))
+	for k := range from {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		srcs := slices.Compact(from[k])
+		p := fmt.Sprintf("%s=%q (%s", k, redact(params[k], secrets), srcs[len(srcs)-1])
+		if len(srcs) > 1 {
+			over := slices.Clone(srcs[:len(srcs)-1])
+			slices.Reverse(over)
+			p += ", over " + strings.Join(over, ", ")
+		}
+		parts = append(parts, p+")")
+	}
+	debugf(ctx, "%s %s: params %s; precedence %s", ep.Method, ep.URI, strings.Join(parts, " "), strings.Join(ep.precedence, " < "))
+}
+
+var runCounter atomic.Uint64
+
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// addBuiltins sets the generated params; they override anything the
+// caller sent so run identifiers can't be spoofed.
+func addBuiltins(params map[string]string) {
+	now := time.Now()
+	params["uuid"] = newUUID()
+	params["unix_ts"] = strconv.FormatInt(now.Unix(), 10)
+	params["iso8601"] = now.UTC().Format(time.RFC3339)
+	params["counter"] = strconv.FormatUint(runCounter.Add(1), 10)
+}
+
+// applyComputed evaluates computed params in name order; each one
+// sees the merged params plus the computed ones before it.
+func applyComputed(ep *Endpoint, params map[string]string) error {
+	for _, c := range ep.computed {
+		v, err := c.expr.eval(params)
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.name, err)
+		}
+		params[c.name] = v
+	}
+	return nil
 }
 
 func applyTemplate(tokens []string, params map[string]string) ([]string, error) {
-	out := make([]string, len(tokens))
-	for i, tok := range tokens {
-		res := tok
-		for {
-			s := strings.Index(res, "{")
-			if s < 0 {
-				break
-			}
-			e := strings.Index(res[s+1:], "}")
+	out := make([]string, 0, len(tokens))
+	for _, tok := range tokens {
+		// ?{...} — the whole element vanishes if any param in it is empty
+		optional := strings.HasPrefix(tok, "?{") && strings.HasSuffix(tok, "}")
+		if optional {
+			tok = tok[2 : len(tok)-1]
+		}
+		res, full, err := expandToken(tok, params)
+		if err != nil {
+			return nil, err
+		}
+		if optional && !full {
+			continue
+		}
+		out = append(out, res)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return out, nil
+}
+
+// expandToken substitutes {name} placeholders in a single argv element.
+// Literal braces are written as {{ / }} or \{ / \}. full reports whether
+// every referenced param was non-empty.
+func expandToken(tok string, params map[string]string) (res string, full bool, err error) {
+	full = true
+	var b strings.Builder
+	for i := 0; i < len(tok); i++ {
+		c := tok[i]
+		switch {
+		case c == '\\' && i+1 < len(tok) && (tok[i+1] == '{' || tok[i+1] == '}'):
+			b.WriteByte(tok[i+1])
+			i++
+		case c == '{' && i+1 < len(tok) && tok[i+1] == '{':
+			b.WriteByte('{')
+			i++
+		case c == '}' && i+1 < len(tok) && tok[i+1] == '}':
+			b.WriteByte('}')
+			i++
+		case c == '{':
+			e := strings.IndexByte(tok[i+1:], '}')
 			if e < 0 {
-				return nil, fmt.Errorf("unclosed placeholder in %q", tok)
+				return "", false, fmt.Errorf("unclosed placeholder in %q", tok)
 			}
-			e += s + 1
-			name := res[s+1 : e]
+			name := tok[i+1 : i+1+e]
 			val := params[name] // if missing → empty
-			res = res[:s] + val + res[e+1:]
+			if val == "" {
+				full = false
+			}
+			b.WriteString(val)
+			i += e + 1
+		default:
+			b.WriteByte(c)
 		}
-		out[i] = res
 	}
-	return out, nil
+	return b.String(), full, nil
+}
+
+// placeholders lists the param names referenced by script tokens, in
+// order of first use, following the same escaping rules as expandToken.
+func placeholders(tokens []string) []string {
+	var out []string
+	for _, tok := range tokens {
+		if strings.HasPrefix(tok, "?{") && strings.HasSuffix(tok, "}") {
+			tok = tok[2 : len(tok)-1]
+		}
+		for i := 0; i < len(tok); i++ {
+			c := tok[i]
+			switch {
+			case c == '\\' && i+1 < len(tok) && (tok[i+1] == '{' || tok[i+1] == '}'),
+				c == '{' && i+1 < len(tok) && tok[i+1] == '{',
+				c == '}' && i+1 < len(tok) && tok[i+1] == '}':
+				i++
+			case c == '{':
+				e := strings.IndexByte(tok[i+1:], '}')
+				if e < 0 {
+					i = len(tok)
+					continue
+				}
+				if name := tok[i+1 : i+1+e]; !slices.Contains(out, name) {
+					out = append(out, name)
+				}
+				i += e + 1
+			}
+		}
+	}
+	return out
 }
 
 func main() {
+	if len(os.Args) == 2 && (os.Args[1] == "--version" || os.Args[1] == "-version") {
+		printVersion()
+		return
+	}
+
+	// first, so that even config errors come out where and how chosen
+	logFormat := getenv("LOG_FORMAT", "text")
+	level, err := parseLevel(getenv("LOG_LEVEL", "info"))
+	if err != nil {
+		log.Fatalf("LOG_LEVEL: %v", err)
+	}
+	levelState.base = level
+	logLevel.Set(level)
+	logOut := io.Writer(os.Stderr)
+	var sink logSink
+	logFile, logSyslog, logJournald := getenv("LOG_FILE", ""), getenv("LOG_SYSLOG", ""), getenv("LOG_JOURNALD", "") == "1"
+	n := 0
+	for _, set := range []bool{logFile != "", logSyslog != "", logJournald} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		log.Fatalf("LOG_FILE, LOG_SYSLOG and LOG_JOURNALD are alternatives, set one")
+	}
+	switch {
+	case logFile != "":
+		f, err := openLogFile(logFile)
+		if err != nil {
+			log.Fatalf("LOG_FILE: %v", err)
+		}
+		logOut = f
+	case logSyslog != "":
+		ss, err := newSyslogSink(logSyslog, getenv("LOG_SYSLOG_FACILITY", "daemon"), getenv("LOG_TAG", "shhoook"), logFormat == "json")
+		if err != nil {
+			log.Fatalf("LOG_SYSLOG: %v", err)
+		}
+		sink = ss
+	case logJournald:
+		js, err := newJournalSink(getenv("LOG_TAG", "shhoook"))
+		if err != nil {
+			log.Fatalf("LOG_JOURNALD: %v", err)
+		}
+		sink = js
+	}
+	if err := setupLogging(logFormat, logOut, sink); err != nil {
+		log.Fatalf("LOG_FORMAT: %v", err)
+	}
 	listen := getenv("LISTEN_ADDR", "10.8.0.1:8080")
 	confDir := getenv("CONFIG_DIR", "./conf")
+	tlsCert := getenv("TLS_CERT_FILE", "")
+	tlsKey := getenv("TLS_KEY_FILE", "")
+	h2c := getenv("H2C", "") == "1"
+	h3 := getenv("HTTP3", "") == "1"
+	pidFile := getenv("PID_FILE", "")
+	redirectAddr := getenv("REDIRECT_ADDR", "")
+	acmeWebroot := getenv("ACME_WEBROOT", "")
+	drain := getduration("SHUTDOWN_TIMEOUT", "30s")
+	// 0 disables a timeout; scripts may run for minutes, so only the
+	// header timeout is set by default
+	readHeaderTimeout := getduration("READ_HEADER_TIMEOUT", "5s")
+	readTimeout := getduration("READ_TIMEOUT", "0")
+	writeTimeout := getduration("WRITE_TIMEOUT", "0")
+	idleTimeout := getduration("IDLE_TIMEOUT", "0")
+	maxHeaderBytes := getint("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)
+	maxConns := getint("MAX_CONNS", 0)
+	keepAlive := getenv("KEEP_ALIVE", "1") != "0"
+	basePath := strings.TrimRight(getenv("BASE_PATH", ""), "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
 
-	// strictly IP:port to listen
-	if host, _, err := net.SplitHostPort(listen); err != nil || net.ParseIP(host) == nil {
-		log.Fatalf("LISTEN_ADDR must be IP:port, got %q", listen)
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatalf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if h3 && (tlsCert == "" || !http3Available) {
+		log.Fatalf("HTTP3=1 needs TLS_CERT_FILE/TLS_KEY_FILE and a binary built with -tags http3")
+	}
+	if redirectAddr != "" {
+		if tlsCert == "" {
+			log.Fatalf("REDIRECT_ADDR needs TLS_CERT_FILE/TLS_KEY_FILE")
+		}
+		if err := checkAddr(redirectAddr); err != nil {
+			log.Fatalf("REDIRECT_ADDR: %v", err)
+		}
+	}
+	scheme := "http"
+	if tlsCert != "" {
+		scheme = "https"
+	}
+
+	// systemd socket activation takes precedence over LISTEN_ADDR
+	listeners, err := activatedListeners()
+	if err != nil {
+		log.Fatalf("socket activation: %v", err)
+	}
+	// REDIRECT_ADDR's socket comes along under its own name
+	redirect := listenSpec{name: redirectListener, addr: redirectAddr}
+	if i := slices.IndexFunc(listeners, func(l listenSpec) bool { return l.name == redirectListener }); i >= 0 && redirectAddr != "" {
+		redirect.ln = listeners[i].ln
+		listeners = slices.Delete(listeners, i, i+1)
+	}
+	if len(listeners) == 0 {
+		if listeners, err = parseListeners(listen); err != nil {
+			log.Fatalf("LISTEN_ADDR: %v", err)
+		}
+	}
+	if redirectAddr != "" && hasListener(listeners, redirectListener) {
+		log.Fatalf("LISTEN_ADDR: listener name %q is taken by REDIRECT_ADDR", redirectListener)
+	}
+
+	if dsn, webhook := getenv("SENTRY_DSN", ""), getenv("ERROR_WEBHOOK", ""); dsn != "" || webhook != "" {
+		if reporting, err = newReporter(dsn, getenv("SENTRY_ENVIRONMENT", ""), webhook); err != nil {
+			log.Fatal(err)
+		}
+		go reporting.run()
+		log.Printf("reporting errors (sentry: %t, webhook: %t)", dsn != "", webhook != "")
 	}
 
 	eps, err := loadEndpoints(confDir)
 	if err != nil {
+		// there is no config reload: a bad config only shows at start
+		reporting.reportNow(&errorReport{Kind: "config", Message: fmt.Sprintf("load endpoints: %v", err)})
 		log.Fatalf("load endpoints: %v", err)
 	}
-	log.Printf("loaded %d endpoints", len(eps))
+	configSum, err := configDigest(confDir)
+	if err != nil {
+		log.Fatalf("load endpoints: %v", err)
+	}
+	log.Printf("loaded %d endpoints (shhoook %s, config sha256 %.12s)", len(eps), version, configSum)
+	s3, err := newS3Store()
+	if err != nil {
+		log.Fatalf("S3_ENDPOINT: %v", err)
+	}
+	for _, ep := range eps {
+		for _, l := range ep.Listeners {
+			if !hasListener(listeners, l) {
+				log.Fatalf("endpoint %s %s: unknown listener %q", ep.Method, ep.URI, l)
+			}
+		}
+		if ep.Upload != nil && s3 == nil {
+			log.Fatalf("endpoint %s %s: upload needs S3_ENDPOINT", ep.Method, ep.URI)
+		}
+		if ep.Resume != "" && getenv("JOBS_DIR", "") == "" {
+			log.Fatalf("endpoint %s %s: resume needs JOBS_DIR", ep.Method, ep.URI)
+		}
+	}
+	var jobs *jobStore
+	if slices.ContainsFunc(eps, func(ep *Endpoint) bool { return ep.Async }) {
+		if jobs, err = newJobStore(getint("JOBS_KEEP", 1000), getenv("JOBS_DIR", ""), getenv("JOBS_LOG_DIR", ""), eps); err != nil {
+			log.Fatalf("jobs: %v", err)
+		}
+	}
 
-	mux := http.NewServeMux()
+	var adminHeader, adminToken string
+	if a := getenv("ADMIN_AUTH", ""); a != "" {
+		if adminHeader, adminToken, err = parseAuth(a); err != nil {
+			log.Fatalf("ADMIN_AUTH: %v", err)
+		}
+	}
+	pprofOn := getenv("PPROF", "") == "1"
+	if pprofOn && adminHeader == "" {
+		log.Fatalf("PPROF needs ADMIN_AUTH")
+	}
+	if v := getenv("METRICS_BUCKETS", ""); v != "" {
+		if stats.buckets, err = parseBuckets(v); err != nil {
+			log.Fatalf("METRICS_BUCKETS: %v", err)
+		}
+	}
+	var metricsHeader, metricsToken string
+	if a := getenv("METRICS_AUTH", ""); a != "" {
+		if metricsHeader, metricsToken, err = parseAuth(a); err != nil {
+			log.Fatalf("METRICS_AUTH: %v", err)
+		}
+	}
 
-	// health
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
-	})
+	if tracing, err = newTracer(); err != nil {
+		log.Fatal(err)
+	}
+	if tracing != nil {
+		go tracing.export()
+		log.Printf("exporting traces to %s", tracing.url)
+	}
 
-	// single handler: we select the first matching ep by method and uri
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		var ep *Endpoint
-		var pv map[string]string
-		for _, e := range eps {
-			if r.Method != e.Method {
-				continue
+	if addr := getenv("STATSD_ADDR", ""); addr != "" {
+		if statsd, err = newStatsd(addr, getenv("STATSD_PREFIX", "shhoook."), getenv("STATSD_FORMAT", "dogstatsd"), getenv("STATSD_TAGS", "")); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("sending metrics to statsd at %s", addr)
+	}
+
+	var access *accessLog
+	if dest := getenv("ACCESS_LOG", ""); dest != "" {
+		if access, err = newAccessLog(dest, getenv("ACCESS_LOG_FORMAT", "combined")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	resultsDir := getenv("RESULTS_DIR", "")
+	if resultsDir != "" {
+		if err := os.MkdirAll(resultsDir, 0o700); err != nil {
+			log.Fatalf("RESULTS_DIR: %v", err)
+		}
+	}
+
+	errPages, err := loadErrorPages(getenv("ERROR_PAGES", ""))
+	if err != nil {
+		log.Fatalf("ERROR_PAGES: %v", err)
+	}
+	health, ready, err := loadHealthChecks(getenv("HEALTH_CHECKS", ""))
+	if err != nil {
+		log.Fatalf("HEALTH_CHECKS: %v", err)
+	}
+
+	s := &server{
+		eps:             eps,
+		configSum:       configSum,
+		router:          newRouter(eps),
+		errors:          errPages,
+		basePath:        basePath,
+		collapseSlashes: getenv("PATH_COLLAPSE_SLASHES", "") == "1",
+		stripSlash:      getenv("PATH_TRAILING_SLASH", "") == "strip",
+		rawMatch:        getenv("PATH_MATCH", "decoded") == "raw",
+		adminHeader:     adminHeader,
+		adminToken:      adminToken,
+		pprof:           pprofOn,
+		health:          health,
+		ready:           ready,
+		openAPI:         getenv("OPENAPI", "") == "1",
+		metrics:         getenv("METRICS", "") == "1",
+		metricsHeader:   metricsHeader,
+		metricsToken:    metricsToken,
+		access:          access,
+		maxBody:         int64(getint("MAX_BODY_BYTES", 10<<20)),
+		resultsDir:      resultsDir,
+		s3:              s3,
+		jobs:            jobs,
+		callbacks:       &http.Client{Timeout: getduration("CALLBACK_TIMEOUT", "10s")},
+		callbackTries:   max(1, getint("CALLBACK_ATTEMPTS", 3)),
+		queue:           newExecQueue(getint("MAX_QUEUE", 0), getint("WORKERS", 0), getduration("QUEUE_RETRY_AFTER", "10s")),
+	}
+	if u := getenv("REDIS_URL", ""); u != "" {
+		timeout := getduration("REDIS_TIMEOUT", "5s")
+		rc, err := newRedisClient(u, timeout)
+		if err != nil {
+			log.Fatalf("REDIS_URL: %v", err)
+		}
+		// claimed jobs run in the worker pool; without one, 4 at a time
+		slots := getint("WORKERS", 0)
+		if slots <= 0 {
+			slots = 4
+		}
+		s.shared = newSharedQueue(rc, getenv("REDIS_PREFIX", "shhoook:"), getduration("REDIS_LEASE", "30s"), getduration("REDIS_JOB_TTL", "168h"), slots)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = s.shared.ping(ctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("REDIS_URL: %v", err)
+		}
+		if jobs != nil {
+			jobs.publish = func(info jobInfo) {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				if err := s.shared.publish(ctx, info); err != nil {
+					errorf(context.Background(), "jobs: publish %s: %v", info.ID, err)
+				}
+			}
+		}
+		log.Printf("shared job queue at %s", rc.addr)
+	}
+	handler := s.routes()
+
+	ret := retention{
+		jobsMaxAge:      getduration("JOBS_MAX_AGE", "0"),
+		jobsMaxBytes:    int64(getint("JOBS_MAX_BYTES", 0)),
+		resultsMaxAge:   getduration("RESULTS_MAX_AGE", "0"),
+		resultsMaxBytes: int64(getint("RESULTS_MAX_BYTES", 0)),
+	}
+	if ret != (retention{}) {
+		go s.sweeper(getduration("SWEEP_INTERVAL", "1m"), ret)
+	}
+	if jobs != nil {
+		s.resumeJobs()
+	}
+	stopSchedules := make(chan struct{})
+	scheduled := s.runSchedules(stopSchedules)
+	if s.shared != nil && jobs != nil {
+		go s.consume(stopSchedules)
+	}
+
+	// HTTP/2 is always on with TLS; h2c (HTTP/2 without TLS) is opt-in
+	protos := new(http.Protocols)
+	protos.SetHTTP1(true)
+	protos.SetHTTP2(true)
+	protos.SetUnencryptedHTTP2(h2c && tlsCert == "")
+
+	// MAX_CONNS is shared by all listeners
+	var connSem chan struct{}
+	if maxConns > 0 {
+		connSem = make(chan struct{}, maxConns)
+	}
+
+	var servers []drainer
+	errc := make(chan error, 2*len(listeners))
+	for i := range listeners {
+		l := &listeners[i]
+		if l.ln == nil {
+			ln, err := net.Listen("tcp", l.addr)
+			if err != nil {
+				log.Fatalf("listen %s: %v", l.addr, err)
 			}
-			if vars, ok := pathVars(e, r.URL.Path); ok {
-				ep = e
-				pv = vars
-				break
+			l.ln = ln
+		}
+		lh := withListener(l.name, handler)
+		if h3 {
+			if l.pc == nil {
+				pc, err := net.ListenPacket("udp", l.addr)
+				if err != nil {
+					log.Fatalf("listen %s (udp): %v", l.addr, err)
+				}
+				l.pc = pc
 			}
+			servers = append(servers, serveHTTP3(l.pc, lh, tlsCert, tlsKey, errc))
+			lh = advertiseHTTP3(l.addr, lh)
 		}
-		if ep == nil {
-			http.NotFound(w, r)
-			return
+		srv := &http.Server{
+			Addr:              l.addr,
+			Handler:           lh,
+			ReadHeaderTimeout: readHeaderTimeout,
+			ReadTimeout:       readTimeout,
+			WriteTimeout:      writeTimeout,
+			IdleTimeout:       idleTimeout,
+			MaxHeaderBytes:    maxHeaderBytes,
+			Protocols:         protos,
 		}
-		// auth
-		if r.Header.Get(ep.header) != ep.token {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
+		srv.SetKeepAlivesEnabled(keepAlive)
+		servers = append(servers, srv)
+		if l.name != l.addr {
+			log.Printf("listening on %s://%s%s (%s)", scheme, l.addr, basePath, l.name)
+		} else {
+			log.Printf("listening on %s://%s%s", scheme, l.addr, basePath)
 		}
-		// params
-		params := mergeParams(ep, pv, r)
-		argv, err := applyTemplate(ep.Script, params)
-		if err != nil {
-			http.Error(w, "bad template: "+err.Error(), http.StatusBadRequest)
+		go func() {
+			if tlsCert != "" {
+				errc <- srv.ServeTLS(limitListen(l.ln, connSem), tlsCert, tlsKey)
+				return
+			}
+			errc <- srv.Serve(limitListen(l.ln, connSem))
+		}()
+	}
+
+	// the sockets SIGUSR2 hands on
+	handoff := listeners
+	if redirectAddr != "" {
+		if redirect.ln == nil {
+			ln, err := net.Listen("tcp", redirectAddr)
+			if err != nil {
+				log.Fatalf("listen %s: %v", redirectAddr, err)
+			}
+			redirect.ln = ln
+		}
+		handoff = append(slices.Clip(listeners), redirect)
+		// redirect to the port of the first TLS listener
+		_, httpsPort, _ := net.SplitHostPort(listeners[0].addr)
+		srv := &http.Server{
+			Addr:              redirectAddr,
+			Handler:           redirectHandler(httpsPort, acmeWebroot),
+			ReadHeaderTimeout: readHeaderTimeout,
+			IdleTimeout:       idleTimeout,
+			MaxHeaderBytes:    maxHeaderBytes,
+		}
+		servers = append(servers, srv)
+		log.Printf("redirecting http://%s to https (port %s)", redirectAddr, httpsPort)
+		go func() { errc <- srv.Serve(redirect.ln) }()
+	}
+
+	if pidFile != "" {
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			log.Fatalf("PID_FILE: %v", err)
+		}
+	}
+	// we are accepting: if we took over the sockets, let the old process go
+	releaseParent()
+
+	// SIGUSR2 hands the sockets to a new copy of the binary (zero-downtime
+	// upgrade); SIGUSR1 toggles debug logging; SIGINT/SIGTERM drain and exit
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+wait:
+	for {
+		select {
+		case err := <-errc:
+			log.Fatal(err)
+		case sig := <-sigc:
+			if sig == syscall.SIGUSR1 {
+				log.Printf("log level %s", levelName(toggleDebug()))
+				continue
+			}
+			if sig == syscall.SIGUSR2 {
+				if err := upgrade(handoff); err != nil {
+					errorf(context.Background(), "upgrade: %v", err)
+				} else {
+					log.Printf("upgrade: started new process, waiting for it to take over")
+				}
+				continue
+			}
+			log.Printf("%s: draining in-flight requests (up to %s)", sig, drain)
+			break wait
+		}
+	}
+	close(stopSchedules)
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := shutdown(ctx, servers); err != nil {
+		warnf(context.Background(), "shutdown: %v", err)
+		// ctx is over: this closes the streams and kills their scripts
+		_ = s.ws.drain(ctx)
+		return
+	}
+	if err := s.ws.drain(ctx); err != nil {
+		warnf(context.Background(), "shutdown: websocket streams still running, closed them: %v", err)
+		return
+	}
+	if err := waitGroup(ctx, scheduled); err != nil {
+		warnf(context.Background(), "shutdown: scheduled runs still running: %v", err)
+		return
+	}
+	if jobs != nil {
+		if err := jobs.wait(ctx); err != nil {
+			warnf(context.Background(), "shutdown: jobs still running: %v", err)
 			return
 		}
-		ctx, cancel := context.WithTimeout(r.Context(), ep.timeout)
-		defer cancel()
-		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
-		// minimal PATH, empty environment
-		cmd.Env = []string{"PATH=/usr/sbin:/usr/bin:/sbin:/bin"}
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-    // non-zero code/timeout → return ep.Error with the output body
-		    w.WriteHeader(ep.Error)
-		    _, _ = w.Write(out)
-		    if errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
-		        _, _ = w.Write([]byte("\n(timeout)\n"))
-		    }
-		    return
-		}
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(out)
-	})
+	}
+	if tracing != nil {
+		tracing.shutdown(ctx)
+	}
+	if statsd != nil {
+		statsd.shutdown()
+	}
+	if reporting != nil {
+		reporting.shutdown(ctx)
+	}
+	log.Printf("stopped")
+}
+
+// waitGroup waits for wg until ctx expires.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drainer is a server that shutdown can drain: *http.Server, or the
+// HTTP/3 one.
+type drainer interface {
+	Shutdown(ctx context.Context) error
+}
 
-	srv := &http.Server{
-		Addr:              listen,
-		Handler:           mux,
-		ReadHeaderTimeout: 5 * time.Second,
+// shutdown stops all servers from accepting new requests and waits for
+// in-flight ones (and their scripts) until ctx expires.
+func shutdown(ctx context.Context, servers []drainer) error {
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() { errs <- srv.Shutdown(ctx) }()
+	}
+	var first error
+	for range servers {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
 	}
-	log.Printf("listening on http://%s", listen)
-	log.Fatal(srv.ListenAndServe())
+	return first
 }
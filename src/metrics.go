@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricSet holds the server's metrics, served in the Prometheus text
+// format on /metrics (METRICS=1). Series are created on first use.
+type metricSet struct {
+	mu       sync.Mutex
+	families []*metricFamily
+	buckets  []float64 // of the duration histogram, in seconds (METRICS_BUCKETS)
+}
+
+// metricFamily is one metric; values are keyed by series, i.e. name,
+// suffix and labels as written out, and listed in the order they
+// appeared (so histogram buckets stay ascending).
+type metricFamily struct {
+	name, typ, help string
+	values          map[string]float64
+	order           []string
+}
+
+// stats is shared by everything that runs scripts, like proxyTransport.
+var stats = &metricSet{buckets: defaultBuckets}
+
+var defaultBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+var (
+	mRequests = stats.family("shhoook_requests_total", "counter", "HTTP requests by endpoint (uri template, empty for other paths), method, status code and, for endpoints with named tokens, token.")
+	mAuthFail = stats.family("shhoook_auth_failures_total", "counter", "Requests rejected for a missing or wrong token, by endpoint.")
+	mInflight = stats.family("shhoook_inflight_executions", "gauge", "Scripts running now, by endpoint.")
+	mDuration = stats.family("shhoook_script_duration_seconds", "histogram", "Script run time, by endpoint.")
+	mOutcomes = stats.family("shhoook_outcomes_total", "counter", "Script runs by endpoint and outcome (success, error, timeout, canceled), and requests rejected (unauthorized) or filtered out (skipped).")
+	mExits    = stats.family("shhoook_script_exits_total", "counter", "Finished script runs by endpoint and exit code (-1: killed).")
+	mTimeouts = stats.family("shhoook_script_timeouts_total", "counter", "Script runs killed for running past their ttl, by endpoint.")
+	mSlow     = stats.family("shhoook_slow_executions_total", "counter", "Script runs still going after their endpoint's slow threshold, by endpoint.")
+)
+
+func (m *metricSet) family(name, typ, help string) *metricFamily {
+	f := &metricFamily{name: name, typ: typ, help: help, values: map[string]float64{}}
+	m.families = append(m.families, f)
+	return f
+}
+
+// add adds v to the series of f with suffix ("" or e.g. "_sum") and
+// labels, given as name, value pairs, and returns its new value.
+func (m *metricSet) add(f *metricFamily, suffix string, v float64, labels ...string) float64 {
+	var b strings.Builder
+	b.WriteString(f.name + suffix)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			b.WriteByte('{')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+	}
+	if len(labels) > 0 {
+		b.WriteByte('}')
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := b.String()
+	if _, ok := f.values[k]; !ok {
+		f.order = append(f.order, k)
+	}
+	f.values[k] += v
+	return f.values[k]
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string { return labelEscaper.Replace(v) }
+
+// write renders all metrics in the text exposition format.
+func (m *metricSet) write(w *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.families {
+		w.WriteString("# HELP " + f.name + " " + f.help + "\n")
+		w.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+		for _, s := range f.order {
+			w.WriteString(s + " " + strconv.FormatFloat(f.values[s], 'g', -1, 64) + "\n")
+		}
+	}
+}
+
+// runStarted and runFinished account for one script run of ep.
+func runStarted(ep *Endpoint) {
+	statsd.gauge("inflight", stats.add(mInflight, "", 1, "endpoint", ep.URI), "endpoint", ep.URI)
+}
+
+func runFinished(ctx context.Context, ep *Endpoint, res *runResult, canceled bool) {
+	runHistory.record(ctx, ep, res, canceled)
+	statsd.gauge("inflight", stats.add(mInflight, "", -1, "endpoint", ep.URI), "endpoint", ep.URI)
+	statsd.timing("script.duration", res.duration, "endpoint", ep.URI)
+	statsd.count("script.exits", 1, "endpoint", ep.URI, "code", strconv.Itoa(res.exitCode))
+	secs := res.duration.Seconds()
+	// every bucket exists from the first run, as histogram_quantile wants
+	for _, b := range stats.buckets {
+		v := 0.0
+		if secs <= b {
+			v = 1
+		}
+		stats.add(mDuration, "_bucket", v, "endpoint", ep.URI, "le", strconv.FormatFloat(b, 'g', -1, 64))
+	}
+	stats.add(mDuration, "_bucket", 1, "endpoint", ep.URI, "le", "+Inf")
+	stats.add(mDuration, "_sum", secs, "endpoint", ep.URI)
+	stats.add(mDuration, "_count", 1, "endpoint", ep.URI)
+	stats.add(mExits, "", 1, "endpoint", ep.URI, "code", strconv.Itoa(res.exitCode))
+	outcome := "success"
+	switch {
+	case res.timedOut:
+		outcome = "timeout"
+		stats.add(mTimeouts, "", 1, "endpoint", ep.URI)
+		statsd.count("script.timeouts", 1, "endpoint", ep.URI)
+	case canceled:
+		outcome = "canceled"
+	case res.err != nil:
+		outcome = "error"
+	}
+	stats.add(mOutcomes, "", 1, "endpoint", ep.URI, "outcome", outcome)
+	statsd.count("outcomes", 1, "endpoint", ep.URI, "outcome", outcome)
+}
+
+// parseBuckets reads METRICS_BUCKETS: ascending upper bounds in seconds,
+// comma-separated.
+func parseBuckets(v string) ([]float64, error) {
+	var out []float64
+	for _, f := range strings.Split(v, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || b <= 0 || len(out) > 0 && b <= out[len(out)-1] {
+			return nil, fmt.Errorf("want ascending positive seconds, got %q", v)
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// metricsTag carries the endpoint a request was routed to, its method,
+// and the name of the token it came with, for the request counter and
+// log.
+type metricsTag struct{ endpoint, method, token string }
+
+type metricsTagKey struct{}
+
+// tagEndpoint labels the request's metrics with ep.
+func tagEndpoint(ctx context.Context, ep *Endpoint) {
+	if t, ok := ctx.Value(metricsTagKey{}).(*metricsTag); ok {
+		t.endpoint, t.method = ep.URI, ep.Method
+	}
+}
+
+// metricMethods are the methods counted under their own name.
+var metricMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// metricMethod is the method label of a request. Any token is a method,
+// so one neither standard nor the endpoint's own counts as "other",
+// lest callers make up series at will.
+func metricMethod(r *http.Request, tag *metricsTag) string {
+	if r.Method == tag.method || slices.Contains(metricMethods, r.Method) {
+		return r.Method
+	}
+	return "other"
+}
+
+// tagToken labels the request's metrics with the name of its token, for
+// endpoints with named tokens.
+func tagToken(ctx context.Context, name string) {
+	if t, ok := ctx.Value(metricsTagKey{}).(*metricsTag); ok {
+		t.token = name
+	}
+}
+
+// statusWriter records the response status and size.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusWriter) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// countRequests counts every request by endpoint, method and status, logs
+// those routed to an endpoint, and writes every one to access if set.
+func countRequests(h http.Handler, access *accessLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		tag := &metricsTag{}
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), metricsTagKey{}, tag)))
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK // nothing written, or hijacked
+		}
+		labels := []string{"endpoint", tag.endpoint, "method", metricMethod(r, tag), "code", strconv.Itoa(status)}
+		if tag.token != "" {
+			// only endpoints with named tokens get the label
+			labels = append(labels, "token", tag.token)
+		}
+		stats.add(mRequests, "", 1, labels...)
+		statsd.count("requests", 1, labels...)
+		statsd.timing("request.duration", time.Since(start), append(labels[:4:4], labels[6:]...)...)
+		if tag.endpoint != "" {
+			logRequest(r, tag.endpoint, status, time.Since(start), sw.Header().Get("X-Exit-Code"))
+		}
+		if access != nil {
+			access.log(r, sw, status, start, tag.endpoint)
+		}
+	})
+}
+
+// serveMetrics handles /metrics, guarded by METRICS_AUTH if set.
+func (s *server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.metricsHeader != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(s.metricsHeader)), []byte(s.metricsToken)) != 1 {
+		s.fail(w, r, nil, errorData{Kind: "unauthorized", Status: http.StatusUnauthorized, Message: "unauthorized"})
+		return
+	}
+	var b strings.Builder
+	stats.write(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(b.String()))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// builtinParams are set by the server, never by the caller.
+var builtinParams = []string{"uuid", "unix_ts", "iso8601", "counter", "__body", "__body_file", "__output_file"}
+
+type oaParam struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required,omitempty"`
+	Schema   map[string]any `json:"schema"`
+}
+
+// openAPIPath turns "/run/:name/*rest" into "/run/{name}/{rest}".
+func openAPIPath(ep *Endpoint) string {
+	var b strings.Builder
+	for _, sg := range ep.segs {
+		b.WriteByte('/')
+		if sg.kind == segStatic {
+			b.WriteString(sg.text)
+		} else {
+			b.WriteString("{" + sg.text + "}")
+		}
+	}
+	if b.Len() == 0 {
+		return "/"
+	}
+	return b.String()
+}
+
+func stringSchema(def string, hasDef bool) map[string]any {
+	s := map[string]any{"type": "string"}
+	if hasDef {
+		s["default"] = def
+	}
+	return s
+}
+
+// openAPIParams lists path, header, cookie and query parameters of ep.
+// Script (or upstream) placeholders not declared anywhere else are
+// assumed to come from the query string (under their incoming name, see
+// param_map).
+func openAPIParams(ep *Endpoint) []oaParam {
+	var ps []oaParam
+	known := map[string]bool{}
+	for _, sg := range ep.segs {
+		if sg.kind != segStatic {
+			ps = append(ps, oaParam{Name: sg.text, In: "path", Required: true, Schema: stringSchema("", false)})
+			known[sg.text] = true
+		}
+	}
+	for _, src := range []struct {
+		in   string
+		vals map[string]string
+	}{{"header", ep.Headers}, {"cookie", ep.Cookies}, {"query", ep.Query}} {
+		names := make([]string, 0, len(src.vals))
+		for k := range src.vals {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			ps = append(ps, oaParam{Name: k, In: src.in, Schema: stringSchema(src.vals[k], true)})
+			known[paramName(ep, k)] = true
+		}
+	}
+	for k := range ep.Body {
+		known[paramName(ep, k)] = true
+	}
+	if ep.schema != nil {
+		for k := range ep.schema.Properties {
+			known[paramName(ep, k)] = true
+		}
+	}
+	for k := range ep.Computed {
+		known[k] = true
+	}
+	incoming := map[string]string{}
+	for from, to := range ep.ParamMap {
+		incoming[to] = from
+	}
+	tokens := ep.Script
+	if ep.Type == "proxy" {
+		tokens = []string{ep.Upstream}
+	}
+	for _, name := range placeholders(tokens) {
+		if known[name] || slices.Contains(builtinParams, name) || slices.ContainsFunc(deliveryParams(ep), func(p string) bool { ok, _ := path.Match(p, name); return ok }) {
+			continue
+		}
+		if from, ok := incoming[name]; ok {
+			name = from
+		}
+		ps = append(ps, oaParam{Name: name, In: "query", Schema: stringSchema("", false)})
+	}
+	return ps
+}
+
+// openAPIBody describes the request body: the endpoint schema if there
+// is one, else an object with the body defaults.
+func openAPIBody(ep *Endpoint) map[string]any {
+	var schema any
+	if ep.schema != nil {
+		schema = ep.schema.raw
+	} else if len(ep.Body) > 0 {
+		props := map[string]any{}
+		for k, v := range ep.Body {
+			props[k] = stringSchema(v, true)
+		}
+		schema = map[string]any{"type": "object", "properties": props}
+	} else {
+		return nil
+	}
+	content := map[string]any{}
+	switch ep.BodyFormat {
+	case "raw":
+		content["application/octet-stream"] = map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}
+	case "form":
+		content["application/x-www-form-urlencoded"] = map[string]any{"schema": schema}
+	case "multipart":
+		content["multipart/form-data"] = map[string]any{"schema": schema}
+	case "xml":
+		content["application/xml"] = map[string]any{"schema": schema}
+	case "json":
+		content["application/json"] = map[string]any{"schema": schema}
+	default:
+		content["application/json"] = map[string]any{"schema": schema}
+		content["application/x-www-form-urlencoded"] = map[string]any{"schema": schema}
+	}
+	return map[string]any{"required": ep.schema != nil, "content": content}
+}
+
+// openAPIDoc builds an OpenAPI 3 document for the loaded endpoints.
+func (s *server) openAPIDoc() map[string]any {
+	paths := map[string]map[string]any{}
+	schemes := map[string]any{}
+	for _, ep := range s.eps {
+		p := openAPIPath(ep)
+		if paths[p] == nil {
+			paths[p] = map[string]any{}
+		}
+		method := strings.ToLower(ep.Method)
+		if _, dup := paths[p][method]; dup {
+			// host- or listener-bound variants of the same route
+			continue
+		}
+		text := map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}}
+		op := map[string]any{
+			"summary":  ep.About,
+			"security": []map[string][]string{{ep.header: {}}},
+			"responses": map[string]any{
+				strconv.Itoa(ep.Status): map[string]any{"description": "script output", "content": text},
+				"401":                   map[string]any{"description": "missing or bad token"},
+				strconv.Itoa(ep.Error):  map[string]any{"description": "script failed or timed out", "content": text},
+			},
+		}
+		if ep.Async {
+			op["responses"] = map[string]any{
+				"202": map[string]any{"description": "job accepted", "content": map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object"}}}},
+				"401": map[string]any{"description": "missing or bad token"},
+			}
+		}
+		if ep.About == "" {
+			delete(op, "summary")
+		}
+		if ps := openAPIParams(ep); len(ps) > 0 {
+			op["parameters"] = ps
+		}
+		if body := openAPIBody(ep); body != nil && ep.Method != http.MethodGet && ep.Method != http.MethodHead {
+			op["requestBody"] = body
+		}
+		paths[p][method] = op
+		if ep.header != "" {
+			schemes[ep.header] = map[string]any{"type": "apiKey", "in": "header", "name": ep.header}
+		} else if q, ok := strings.CutPrefix(deliveryCredential(ep), "?"); ok {
+			op["security"] = []map[string][]string{{"query " + q: {}}}
+			schemes["query "+q] = map[string]any{"type": "apiKey", "in": "query", "name": q}
+		}
+	}
+	doc := map[string]any{
+		"openapi":    "3.0.3",
+		"info":       map[string]any{"title": "shhoook", "version": "1"},
+		"paths":      paths,
+		"components": map[string]any{"securitySchemes": schemes},
+	}
+	if s.basePath != "" {
+		doc["servers"] = []map[string]string{{"url": s.basePath}}
+	}
+	return doc
+}
+
+func (s *server) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		s.fail(w, r, nil, errorData{Kind: "method_not_allowed", Status: http.StatusMethodNotAllowed, Message: "method not allowed"})
+		return
+	}
+	b, err := json.Marshal(s.openAPIDoc())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
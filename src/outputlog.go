@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// outputLineMax is how much of a line of output goes in one log line.
+const outputLineMax = 4096
+
+type jobIDKey struct{}
+
+// jobID is the ID of the job ctx runs, "" outside jobs.
+func jobID(ctx context.Context) string {
+	id, _ := ctx.Value(jobIDKey{}).(string)
+	return id
+}
+
+// outputLogger copies one stream of a script's output to the server log,
+// a log line per line of output (log_output), under the request ID and,
+// in a job, the job ID, so concurrent runs can be told apart.
+type outputLogger struct {
+	ctx    context.Context
+	ep     *Endpoint
+	stream string // stdout or stderr
+	line   []byte
+}
+
+func newOutputLogger(ctx context.Context, ep *Endpoint, stream string) *outputLogger {
+	return &outputLogger{ctx: ctx, ep: ep, stream: stream}
+}
+
+func (l *outputLogger) Write(p []byte) (int, error) {
+	for rest := p; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		chunk := rest
+		if i >= 0 {
+			chunk, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = nil
+		}
+		for len(l.line)+len(chunk) > outputLineMax {
+			n := outputLineMax - len(l.line)
+			l.line = append(l.line, chunk[:n]...)
+			chunk = chunk[n:]
+			l.emit()
+		}
+		l.line = append(l.line, chunk...)
+		if i >= 0 {
+			l.emit()
+		}
+	}
+	return len(p), nil
+}
+
+// flush logs a last line that had no newline.
+func (l *outputLogger) flush() {
+	if len(l.line) > 0 {
+		l.emit()
+	}
+}
+
+func (l *outputLogger) emit() {
+	line := string(bytes.TrimSuffix(l.line, []byte("\r")))
+	l.line = l.line[:0]
+	attrs := []slog.Attr{slog.String("endpoint", l.ep.URI), slog.String("stream", l.stream)}
+	who := l.ep.Method + " " + l.ep.URI
+	if id := jobID(l.ctx); id != "" {
+		who = "job " + id
+		attrs = append(attrs, slog.String("job_id", id))
+	}
+	logAttrs(l.ctx, slog.LevelInfo, who+" "+l.stream+": "+line, attrs...)
+}
+
+// linePrefixer starts every line written through it with prefix
+// (prefix_output), for job output that is shipped elsewhere. stdout and
+// stderr may write at once.
+type linePrefixer struct {
+	w      io.Writer
+	prefix []byte
+
+	mu     sync.Mutex
+	inLine bool // the last write ended mid-line
+}
+
+func (p *linePrefixer) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]byte, 0, len(b)+len(p.prefix))
+	for rest := b; len(rest) > 0; {
+		if !p.inLine {
+			out = append(out, p.prefix...)
+		}
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			out = append(out, rest...)
+			p.inLine = true
+			break
+		}
+		out = append(out, rest[:i+1]...)
+		rest = rest[i+1:]
+		p.inLine = false
+	}
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// lockedWriter makes one writer safe for stdout and stderr to share once
+// they are different writers on top of it.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanics answers a request whose handler panicked with a 500
+// and logs the panic with its stack, instead of dropping the connection.
+// A panic after the response started can't be answered; the connection
+// is then aborted as net/http would.
+func (s *server) recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v) // deliberate: the handler wants the connection dropped
+			}
+			logPanic(r.Context(), fmt.Sprintf("%s %s", r.Method, r.URL.Path), v)
+			if sw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			s.fail(sw, r, nil, errorData{Kind: "error", Status: http.StatusInternalServerError, Message: "internal error"})
+		}()
+		h.ServeHTTP(sw, r)
+	})
+}
+
+// recoverPanic, deferred first thing in a goroutine, logs a panic there
+// with its stack rather than letting it take down the process.
+func recoverPanic(ctx context.Context, what string) {
+	if v := recover(); v != nil {
+		logPanic(ctx, what, v)
+	}
+}
+
+// logPanic logs a recovered panic; the stack is a field of its own in
+// structured logs.
+func logPanic(ctx context.Context, what string, v any) {
+	msg := fmt.Sprintf("panic in %s: %v", what, v)
+	stack := string(debug.Stack())
+	if !structuredLogs {
+		msg += "\n" + stack
+	}
+	logAttrs(ctx, slog.LevelError, msg, slog.String("stack", stack))
+	reportPanic(ctx, what, v, stack)
+}
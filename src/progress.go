@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jobProgress is what a script last reported about how far it got, with
+// stdout lines like "PROGRESS: 42 copying tables", "PROGRESS: 3/10" or
+// "PROGRESS: almost done".
+type jobProgress struct {
+	Percent float64 `json:"percent"`
+	Message string  `json:"message,omitempty"`
+}
+
+const progressPrefix = "PROGRESS:"
+
+// progressLineMax caps how much of a line progressWriter looks at.
+const progressLineMax = 4096
+
+// progressSaveEvery is how often progress updates are written to the job
+// record on disk (and the shared queue); memory is always current.
+const progressSaveEvery = time.Second
+
+// parseProgress reads a progress line. A line without a percentage keeps
+// prev's.
+func parseProgress(line string, prev jobProgress) (jobProgress, bool) {
+	rest, ok := strings.CutPrefix(line, progressPrefix)
+	if !ok {
+		return prev, false
+	}
+	rest = strings.TrimSpace(rest)
+	p := jobProgress{Percent: prev.Percent, Message: rest}
+	first, msg, _ := strings.Cut(rest, " ")
+	if pct, ok := parsePercent(first); ok {
+		p.Percent, p.Message = pct, strings.TrimSpace(msg)
+	}
+	return p, true
+}
+
+// parsePercent reads "42", "42.5%" or "3/10" as a percentage from 0 to
+// 100.
+func parsePercent(s string) (float64, bool) {
+	var pct float64
+	if n, m, ok := strings.Cut(s, "/"); ok {
+		a, err1 := strconv.ParseFloat(n, 64)
+		b, err2 := strconv.ParseFloat(m, 64)
+		if err1 != nil || err2 != nil || b <= 0 {
+			return 0, false
+		}
+		pct = a / b * 100
+	} else {
+		var err error
+		if pct, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64); err != nil {
+			return 0, false
+		}
+	}
+	if math.IsNaN(pct) { // "nan", "inf/inf": JSON can't carry it
+		return 0, false
+	}
+	return min(max(pct, 0), 100), true
+}
+
+// progressWriter watches a job's stdout for progress lines.
+type progressWriter struct {
+	st   *jobStore
+	j    *job
+	line []byte // start of the current line, up to progressLineMax
+	long bool   // the current line went past progressLineMax
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	for rest := p; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		chunk := rest
+		if i >= 0 {
+			chunk, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = nil
+		}
+		if room := progressLineMax - len(w.line); len(chunk) > room {
+			chunk, w.long = chunk[:room], true
+		}
+		w.line = append(w.line, chunk...)
+		if i < 0 {
+			break
+		}
+		if !w.long {
+			w.st.setProgress(w.j, strings.TrimSuffix(string(w.line), "\r"))
+		}
+		w.line, w.long = w.line[:0], false
+	}
+	return len(p), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// proxyTransport is shared by all proxy endpoints; per-request timeouts
+// come from the endpoint ttl.
+var proxyTransport = http.DefaultTransport.(*http.Transport).Clone()
+
+// proxy forwards the request to the endpoint's upstream, expanded with
+// params. The body is the one already read for param parsing; the auth
+// header is not passed on. hdrs override upstream response headers.
+func (s *server) proxy(w http.ResponseWriter, r *http.Request, ep *Endpoint, params map[string]string, body *requestBody, hdrs http.Header) {
+	raw, _, err := expandToken(ep.Upstream, params)
+	if err != nil {
+		s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: "bad template: " + err.Error()})
+		return
+	}
+	target, err := url.Parse(raw)
+	if err != nil || target.Host == "" {
+		s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: "bad upstream url: " + raw})
+		return
+	}
+	if target.RawQuery == "" {
+		target.RawQuery = r.URL.RawQuery
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), ep.timeout)
+	defer cancel()
+	rp := &httputil.ReverseProxy{
+		Transport: proxyTransport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL = target
+			pr.Out.Host = ""
+			pr.Out.Header.Del(ep.header)
+			pr.Out.Body = io.NopCloser(bytes.NewReader(body.raw))
+			pr.Out.ContentLength = int64(len(body.raw))
+			pr.SetXForwarded()
+			if sp := spanFrom(pr.In.Context()); sp != nil {
+				pr.Out.Header.Set("traceparent", sp.traceparent())
+			}
+		},
+		ModifyResponse: func(res *http.Response) error {
+			// the response already carries ours
+			res.Header.Del(requestIDHeader)
+			for k, v := range hdrs {
+				res.Header[k] = v
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			warnf(r.Context(), "proxy %s %s: %v", ep.Method, ep.URI, err)
+			d := errorData{Kind: "error", Status: http.StatusBadGateway, Message: err.Error(), Output: "bad gateway\n"}
+			if errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
+				d.Status, d.Message, d.Output, d.Timeout = http.StatusGatewayTimeout, "timeout", "", true
+			}
+			s.fail(w, r, ep, d)
+		},
+	}
+	rp.ServeHTTP(w, r.WithContext(ctx))
+}
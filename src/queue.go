@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// execQueue bounds how many script runs may be pending — waiting or
+// running — overall (MAX_QUEUE) and per endpoint (max_queue), so a burst
+// of requests can't start an unbounded number of processes. Of those, a
+// pool of WORKERS (per endpoint: workers) run at a time; the rest wait
+// for a free worker, highest queue_priority first, then in arrival
+// order.
+type execQueue struct {
+	mu         sync.Mutex
+	depth      int // 0 = no limit
+	pending    int
+	perEp      map[*Endpoint]int
+	retryAfter time.Duration // sent with 429s
+
+	workers   int // 0 = no limit
+	running   int
+	runningEp map[*Endpoint]int
+	waiting   []*waiter
+}
+
+// waiter is a run waiting for a worker; ready is closed when it has one.
+type waiter struct {
+	ep    *Endpoint
+	ready chan struct{}
+}
+
+func newExecQueue(depth, workers int, retryAfter time.Duration) *execQueue {
+	return &execQueue{
+		depth:      depth,
+		perEp:      map[*Endpoint]int{},
+		retryAfter: retryAfter,
+		workers:    workers,
+		runningEp:  map[*Endpoint]int{},
+	}
+}
+
+// admit takes a slot for a run of ep; false if a limit is reached. Every
+// admitted run must be released.
+func (q *execQueue) admit(ep *Endpoint) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.depth > 0 && q.pending >= q.depth || ep.MaxQueue > 0 && q.perEp[ep] >= ep.MaxQueue {
+		return false
+	}
+	q.pending++
+	q.perEp[ep]++
+	return true
+}
+
+// load reports the runs admitted now and MAX_QUEUE (0 = no limit).
+func (q *execQueue) load() (pending, depth int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending, q.depth
+}
+
+// take is admit without the limits, for runs accepted before (resumed
+// jobs).
+func (q *execQueue) take(ep *Endpoint) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending++
+	q.perEp[ep]++
+}
+
+func (q *execQueue) release(ep *Endpoint) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending--
+	if q.perEp[ep]--; q.perEp[ep] == 0 {
+		delete(q.perEp, ep)
+	}
+}
+
+// idle reports whether a run of ep could start now. Called with q.mu
+// held.
+func (q *execQueue) idle(ep *Endpoint) bool {
+	return (q.workers == 0 || q.running < q.workers) && (ep.Workers == 0 || q.runningEp[ep] < ep.Workers)
+}
+
+// acquire waits for a worker for a run of ep. It fails only if ctx is
+// done first; otherwise the worker must be given back with done.
+func (q *execQueue) acquire(ctx context.Context, ep *Endpoint) error {
+	q.mu.Lock()
+	if q.idle(ep) {
+		q.running++
+		q.runningEp[ep]++
+		q.mu.Unlock()
+		return nil
+	}
+	w := &waiter{ep: ep, ready: make(chan struct{})}
+	// behind every waiter of the same or a higher priority
+	i := len(q.waiting)
+	for i > 0 && q.waiting[i-1].ep.QueuePrio < ep.QueuePrio {
+		i--
+	}
+	q.waiting = slices.Insert(q.waiting, i, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, o := range q.waiting {
+		if o == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return ctx.Err()
+		}
+	}
+	// handed a worker just as ctx ended: pass it on
+	q.free(ep)
+	return ctx.Err()
+}
+
+// done gives back a worker taken by acquire.
+func (q *execQueue) done(ep *Endpoint) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.free(ep)
+}
+
+// free releases a worker and hands it, and any other that became usable,
+// to the first waiting runs that can take them. Called with q.mu held.
+func (q *execQueue) free(ep *Endpoint) {
+	q.running--
+	if q.runningEp[ep]--; q.runningEp[ep] == 0 {
+		delete(q.runningEp, ep)
+	}
+	for i := 0; i < len(q.waiting); {
+		w := q.waiting[i]
+		if !q.idle(w.ep) {
+			i++
+			continue
+		}
+		q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+		q.running++
+		q.runningEp[w.ep]++
+		close(w.ready)
+	}
+}
+
+// rejectBusy answers 429 with Retry-After.
+func (s *server) rejectBusy(w http.ResponseWriter, r *http.Request, ep *Endpoint) {
+	secs := max(1, int(s.queue.retryAfter.Round(time.Second).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	s.fail(w, r, ep, errorData{Kind: "busy", Status: http.StatusTooManyRequests, Message: "too many pending runs, retry later"})
+}
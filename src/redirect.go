@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const acmePrefix = "/.well-known/acme-challenge/"
+
+// redirectHandler answers plain-HTTP requests with a 301 to the same
+// URL over HTTPS on httpsPort. If webroot is set, ACME HTTP-01
+// challenges are served from webroot/.well-known/acme-challenge/.
+func redirectHandler(httpsPort, webroot string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if webroot != "" && strings.HasPrefix(r.URL.Path, acmePrefix) {
+			token := strings.TrimPrefix(r.URL.Path, acmePrefix)
+			if token == "" || strings.ContainsAny(token, "/\\") || strings.HasPrefix(token, ".") {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeFile(w, r, filepath.Join(webroot, filepath.FromSlash(acmePrefix), token))
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6 literal
+		}
+		if httpsPort != "443" {
+			host += ":" + httpsPort
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
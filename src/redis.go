@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisClient is a minimal RESP2 client, enough for the shared job
+// queue: commands in, replies out, over a small pool of connections.
+type redisClient struct {
+	addr     string
+	tls      bool
+	user     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// maximum idle connections kept
+const redisIdleMax = 8
+
+// newRedisClient parses redis://[user:password@]host[:port][/db]
+// (rediss:// for TLS).
+func newRedisClient(raw string, timeout time.Duration) (*redisClient, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Hostname() == "" {
+		return nil, fmt.Errorf("want redis://host:port/db, got %q", raw)
+	}
+	c := &redisClient{addr: u.Host, tls: u.Scheme == "rediss", timeout: timeout}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+		if c.password != "" {
+			c.user = u.User.Username()
+		} else {
+			c.password = u.User.Username() // redis://:secret@ or redis://secret@
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, fmt.Errorf("bad db %q", db)
+		}
+	}
+	return c, nil
+}
+
+func (c *redisClient) dial(ctx context.Context) (*redisConn, error) {
+	d := &net.Dialer{Timeout: c.timeout}
+	var nc net.Conn
+	var err error
+	if c.tls {
+		host, _, _ := net.SplitHostPort(c.addr)
+		nc, err = (&tls.Dialer{NetDialer: d, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		nc, err = d.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &redisConn{nc: nc, r: bufio.NewReader(nc)}
+	var setup [][]any
+	if c.password != "" {
+		if c.user != "" {
+			setup = append(setup, []any{"AUTH", c.user, c.password})
+		} else {
+			setup = append(setup, []any{"AUTH", c.password})
+		}
+	}
+	if c.db != 0 {
+		setup = append(setup, []any{"SELECT", c.db})
+	}
+	for _, args := range setup {
+		if _, err := c.roundTrip(cn, args); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// do sends one command and returns its reply: string (status), int64,
+// []byte (bulk), []any (array), or nil. Error replies are redisErrors.
+func (c *redisClient) do(ctx context.Context, args ...any) (any, error) {
+	c.mu.Lock()
+	var cn *redisConn
+	if n := len(c.idle); n > 0 {
+		cn, c.idle = c.idle[n-1], c.idle[:n-1]
+	}
+	c.mu.Unlock()
+	if cn == nil {
+		var err error
+		if cn, err = c.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(cn, args)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		cn.nc.Close() // the stream may be out of step
+		return nil, err
+	}
+	c.mu.Lock()
+	if len(c.idle) < redisIdleMax {
+		c.idle = append(c.idle, cn)
+		cn = nil
+	}
+	c.mu.Unlock()
+	if cn != nil {
+		cn.nc.Close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) roundTrip(cn *redisConn, args []any) (any, error) {
+	_ = cn.nc.SetDeadline(time.Now().Add(c.timeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		var s string
+		switch v := a.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		default:
+			s = fmt.Sprint(v)
+		}
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(s), s)
+	}
+	if _, err := io.WriteString(cn.nc, b.String()); err != nil {
+		return nil, err
+	}
+	return readReply(cn.r)
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: bad reply line")
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err // nil bulk
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err // nil array
+		}
+		arr := make([]any, n)
+		for i := range arr {
+			if arr[i], err = readReply(r); err != nil {
+				var rerr redisError
+				if !errors.As(err, &rerr) {
+					return nil, err
+				}
+				arr[i] = rerr
+			}
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// redisBytes is a bulk or status reply as bytes; nil for a nil reply.
+func redisBytes(reply any, err error) ([]byte, error) {
+	switch v := reply.(type) {
+	case []byte:
+		return v, err
+	case string:
+		return []byte(v), err
+	}
+	return nil, err
+}
+
+func redisInt(reply any, err error) (int64, error) {
+	n, _ := reply.(int64)
+	return n, err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// registryFilter is an endpoint's registry block: image pushes from
+// Docker Hub, Harbor, GitHub Container Registry or a registry speaking
+// the Distribution notification format run the script, others are
+// skipped.
+type registryFilter struct {
+	Tags   []string `json:"tags"`   // globs: "v*", "latest"
+	Repos  []string `json:"repos"`  // globs: "acme/app", "library/*"
+	Secret string   `json:"secret"` // GHCR: the GitHub webhook's secret, checked in X-Hub-Signature-256
+	Token  string   `json:"token"`  // Docker Hub, which can't sign or set headers: a secret the hook URL carries in ?token=
+}
+
+func (f *registryFilter) params() []string {
+	return []string{"registry_source", "registry_image", "registry_repo", "registry_tag", "registry_digest"}
+}
+
+func (f *registryFilter) credential() string {
+	switch {
+	case f.Secret != "":
+		return "X-Hub-Signature-256"
+	case f.Token != "":
+		return "?token"
+	}
+	return ""
+}
+
+func (f *registryFilter) verify(r *http.Request, raw []byte) error {
+	if f.Secret != "" {
+		return verifyHMAC(r, "X-Hub-Signature-256", f.Secret, raw)
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(f.Token)) != 1 {
+		return errors.New("missing or bad ?token")
+	}
+	return nil
+}
+
+func (f *registryFilter) validate() error {
+	if f.Secret != "" && f.Token != "" {
+		return errors.New("secret and token don't mix")
+	}
+	if err := checkPatterns("tag", f.Tags); err != nil {
+		return err
+	}
+	return checkPatterns("repo", f.Repos)
+}
+
+// check reads the pushed image from whichever payload came, and filters
+// it by tag and repository.
+func (f *registryFilter) check(r *http.Request, body *requestBody) (map[string]string, string) {
+	payload := deliveryPayload(body)
+	p := map[string]string{}
+	switch event := r.Header.Get("X-GitHub-Event"); {
+	case event == "package" || event == "registry_package":
+		pkg := event
+		if action := jsonPath(payload, "action"); action != "published" {
+			return nil, fmt.Sprintf("package %s, not published", action)
+		}
+		if typ := strings.ToLower(jsonPath(payload, pkg+".package_type")); typ != "container" && typ != "docker" {
+			return nil, fmt.Sprintf("%s package, not a container image", typ)
+		}
+		owner := jsonPath(payload, pkg+".namespace")
+		if owner == "" {
+			owner = jsonPath(payload, pkg+".owner.login")
+		}
+		p["registry_source"] = "ghcr"
+		p["registry_repo"] = strings.ToLower(owner + "/" + jsonPath(payload, pkg+".name"))
+		p["registry_image"] = "ghcr.io/" + p["registry_repo"]
+		p["registry_tag"] = jsonPath(payload, pkg+".package_version.container_metadata.tag.name")
+		p["registry_digest"] = jsonPath(payload, pkg+".package_version.container_metadata.tag.digest")
+		if p["registry_digest"] == "" {
+			p["registry_digest"] = jsonPath(payload, pkg+".package_version.version")
+		}
+	case event != "":
+		return nil, fmt.Sprintf("GitHub %s event, not a package", event)
+	case jsonPath(payload, "event_data.repository.repo_full_name") != "":
+		if typ := jsonPath(payload, "type"); typ != "PUSH_ARTIFACT" {
+			return nil, fmt.Sprintf("Harbor %s, not a push", typ)
+		}
+		p["registry_source"] = "harbor"
+		p["registry_repo"] = jsonPath(payload, "event_data.repository.repo_full_name")
+		host, _, _ := strings.Cut(jsonPath(payload, "event_data.resources.0.resource_url"), "/")
+		p["registry_image"] = host + "/" + p["registry_repo"]
+		p["registry_tag"] = jsonPath(payload, "event_data.resources.0.tag")
+		p["registry_digest"] = jsonPath(payload, "event_data.resources.0.digest")
+	case jsonPath(payload, "repository.repo_name") != "":
+		p["registry_source"] = "dockerhub"
+		p["registry_repo"] = jsonPath(payload, "repository.repo_name")
+		p["registry_image"] = "docker.io/" + p["registry_repo"]
+		p["registry_tag"] = jsonPath(payload, "push_data.tag")
+		p["registry_digest"] = "" // Docker Hub doesn't send it
+	case jsonPath(payload, "events.0.target.repository") != "":
+		// a registry's notification endpoint may get a batch; the first
+		// event stands for it
+		if action := jsonPath(payload, "events.0.action"); action != "push" {
+			return nil, fmt.Sprintf("registry %s, not a push", action)
+		}
+		p["registry_source"] = "distribution"
+		p["registry_repo"] = jsonPath(payload, "events.0.target.repository")
+		p["registry_image"] = jsonPath(payload, "events.0.request.host") + "/" + p["registry_repo"]
+		p["registry_tag"] = jsonPath(payload, "events.0.target.tag")
+		p["registry_digest"] = jsonPath(payload, "events.0.target.digest")
+	default:
+		return nil, "not a registry event"
+	}
+	if len(f.Tags) > 0 {
+		if p["registry_tag"] == "" {
+			return nil, "push without a tag"
+		}
+		if !matchAny(f.Tags, p["registry_tag"]) {
+			return nil, fmt.Sprintf("tag %s not in tags", p["registry_tag"])
+		}
+	}
+	if len(f.Repos) > 0 && !matchAny(f.Repos, p["registry_repo"]) {
+		return nil, fmt.Sprintf("repo %s not in repos", p["registry_repo"])
+	}
+	return p, ""
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errorReport is a failure worth a human's attention: a script that
+// failed or timed out, a panic, endpoint configs that don't load. It is
+// what ERROR_WEBHOOK gets, and what a Sentry event is made of.
+type errorReport struct {
+	Kind       string    `json:"kind"` // failure, timeout, panic or config
+	Message    string    `json:"message"`
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	Version    string    `json:"version"`
+	Endpoint   string    `json:"endpoint,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	JobID      string    `json:"job_id,omitempty"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	DurationMs int64     `json:"duration_ms,omitempty"`
+	Command    []string  `json:"command,omitempty"` // argv, secrets masked
+	Output     string    `json:"output,omitempty"`  // the last reportOutputMax bytes, secrets masked
+	Stack      string    `json:"stack,omitempty"`
+	Suppressed int       `json:"suppressed,omitempty"` // like reports left out since the last one
+}
+
+// reportOutputMax is how much output, from the end, a report carries.
+const reportOutputMax = 1024
+
+// reportEvery is how often reports with the same kind and endpoint go
+// out at most; those in between are only counted.
+const reportEvery = time.Minute
+
+// reporter sends errorReports to Sentry (SENTRY_DSN) and/or a webhook
+// (ERROR_WEBHOOK), in the background.
+type reporter struct {
+	sentryURL   string // envelope endpoint
+	sentryAuth  string // X-Sentry-Auth
+	sentryDSN   string
+	environment string // SENTRY_ENVIRONMENT
+	webhook     string
+	client      *http.Client
+	host        string
+
+	mu   sync.Mutex
+	last map[string]time.Time // by fingerprint
+	held map[string]int       // suppressed since last
+
+	queue chan *errorReport
+	flush chan chan struct{}
+}
+
+// reporting is nil unless SENTRY_DSN or ERROR_WEBHOOK is set; like
+// stats, it is shared by everything that runs scripts.
+var reporting *reporter
+
+const reportQueue = 256
+
+func newReporter(dsn, environment, webhook string) (*reporter, error) {
+	host, _ := os.Hostname()
+	rp := &reporter{
+		environment: environment,
+		webhook:     webhook,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		host:        host,
+		last:        map[string]time.Time{},
+		held:        map[string]int{},
+		queue:       make(chan *errorReport, reportQueue),
+		flush:       make(chan chan struct{}),
+	}
+	if dsn != "" {
+		u, err := url.Parse(dsn)
+		if err != nil || u.User == nil || u.User.Username() == "" || u.Host == "" {
+			return nil, fmt.Errorf("SENTRY_DSN: want https://KEY@HOST/PROJECT, got %q", dsn)
+		}
+		dir, project := path.Split(strings.TrimSuffix(u.Path, "/"))
+		if project == "" {
+			return nil, fmt.Errorf("SENTRY_DSN: no project in %q", dsn)
+		}
+		rp.sentryURL = u.Scheme + "://" + u.Host + strings.TrimSuffix(dir, "/") + "/api/" + project + "/envelope/"
+		rp.sentryAuth = "Sentry sentry_version=7, sentry_client=shhoook/" + version + ", sentry_key=" + u.User.Username()
+		rp.sentryDSN = dsn
+	}
+	if webhook != "" {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("ERROR_WEBHOOK: bad url %q", webhook)
+		}
+	}
+	return rp, nil
+}
+
+// report queues r, unless one like it went out within reportEvery. A
+// nil reporter does nothing.
+func (rp *reporter) report(r *errorReport) {
+	if rp == nil {
+		return
+	}
+	if !rp.admit(r) {
+		return
+	}
+	select {
+	case rp.queue <- r:
+	default:
+		stderrf("error report dropped, queue full: %s", r.Message)
+	}
+}
+
+// admit throttles reports by fingerprint, counting those held back.
+func (rp *reporter) admit(r *errorReport) bool {
+	fp := r.Kind + " " + r.Method + " " + r.Endpoint
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if time.Since(rp.last[fp]) < reportEvery {
+		rp.held[fp]++
+		return false
+	}
+	rp.last[fp] = time.Now()
+	r.Suppressed, rp.held[fp] = rp.held[fp], 0
+	return true
+}
+
+func (rp *reporter) fill(ctx context.Context, r *errorReport) *errorReport {
+	r.Time, r.Host, r.Version = time.Now().UTC(), rp.host, version
+	if ctx != nil {
+		r.RequestID, r.JobID = requestID(ctx), jobID(ctx)
+	}
+	return r
+}
+
+// reportRun reports a failed or timed-out script run, per the endpoint's
+// report setting.
+func reportRun(ctx context.Context, ep *Endpoint, sc *scriptCmd, res *runResult, output []byte) {
+	if reporting == nil || ep.Report == "off" || ep.Report == "timeouts" && !res.timedOut {
+		return
+	}
+	r := &errorReport{Kind: "failure", Endpoint: ep.URI, Method: ep.Method, DurationMs: res.duration.Milliseconds()}
+	code := res.exitCode
+	r.ExitCode = &code
+	r.Message = fmt.Sprintf("%s %s: exit code %d", ep.Method, ep.URI, code)
+	if res.timedOut {
+		r.Kind, r.Message = "timeout", fmt.Sprintf("%s %s: timed out after %s", ep.Method, ep.URI, ep.timeout)
+	}
+	if res.failedStep > 0 {
+		r.Message += fmt.Sprintf(" (step %d)", res.failedStep)
+	}
+	argv := sc.argv
+	if res.failedStep > 1 {
+		argv = sc.steps[res.failedStep-2]
+	}
+	// arguments are shown only when the secrets among them are known,
+	// which they aren't for jobs resumed after a restart
+	r.Command = argv[:1]
+	if sc.secrets != nil {
+		r.Command = make([]string, len(argv))
+		for i, a := range argv {
+			r.Command[i] = redact(a, sc.secrets)
+		}
+	}
+	r.Output = maskSecrets(string(bytes.ToValidUTF8(output, nil)), sc.secrets)
+	reporting.report(reporting.fill(ctx, r))
+}
+
+// reportPanic reports a recovered panic.
+func reportPanic(ctx context.Context, what string, v any, stack string) {
+	if reporting == nil {
+		return
+	}
+	reporting.report(reporting.fill(ctx, &errorReport{Kind: "panic", Message: fmt.Sprintf("panic in %s: %v", what, v), Stack: stack}))
+}
+
+// reportNow sends r at once, for errors the server is about to exit on.
+func (rp *reporter) reportNow(r *errorReport) {
+	if rp == nil {
+		return
+	}
+	rp.send(rp.fill(nil, r))
+}
+
+// run sends queued reports, for good.
+func (rp *reporter) run() {
+	for {
+		select {
+		case r := <-rp.queue:
+			rp.send(r)
+		case done := <-rp.flush:
+			for len(rp.queue) > 0 {
+				rp.send(<-rp.queue)
+			}
+			close(done)
+		}
+	}
+}
+
+// shutdown sends the reports still queued, waiting until ctx is done at
+// most.
+func (rp *reporter) shutdown(ctx context.Context) {
+	done := make(chan struct{})
+	select {
+	case rp.flush <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// send delivers r; problems go to stderr rather than the log, which may
+// be what is being reported on.
+func (rp *reporter) send(r *errorReport) {
+	if rp.webhook != "" {
+		body, _ := json.Marshal(r)
+		if err := rp.post(rp.webhook, "application/json", nil, body); err != nil {
+			stderrf("error webhook: %v", err)
+		}
+	}
+	if rp.sentryURL != "" {
+		if err := rp.post(rp.sentryURL, "application/x-sentry-envelope", http.Header{"X-Sentry-Auth": {rp.sentryAuth}}, rp.envelope(r)); err != nil {
+			stderrf("sentry: %v", err)
+		}
+	}
+}
+
+func (rp *reporter) post(u, contentType string, h http.Header, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "shhoook/"+version)
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// envelope renders r as a Sentry envelope with one event. Reports of the
+// same kind, endpoint and exit code are grouped into one issue.
+func (rp *reporter) envelope(r *errorReport) []byte {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	eventID := hex.EncodeToString(id[:])
+	tags := map[string]string{"kind": r.Kind}
+	extra := map[string]any{}
+	fingerprint := []string{r.Kind}
+	if r.Endpoint != "" {
+		tags["endpoint"], tags["method"] = r.Endpoint, r.Method
+		fingerprint = append(fingerprint, r.Method, r.Endpoint)
+	}
+	if r.ExitCode != nil {
+		tags["exit_code"] = strconv.Itoa(*r.ExitCode)
+		fingerprint = append(fingerprint, tags["exit_code"])
+	}
+	if r.Kind == "panic" || r.Kind == "config" {
+		fingerprint = append(fingerprint, r.Message)
+	}
+	if r.RequestID != "" {
+		tags["request_id"] = r.RequestID
+	}
+	if r.JobID != "" {
+		tags["job_id"] = r.JobID
+	}
+	if r.Command != nil {
+		extra["command"] = r.Command
+	}
+	for k, v := range map[string]string{"output": r.Output, "stack": r.Stack} {
+		if v != "" {
+			extra[k] = v
+		}
+	}
+	if r.DurationMs > 0 {
+		extra["duration_ms"] = r.DurationMs
+	}
+	if r.Suppressed > 0 {
+		extra["suppressed"] = r.Suppressed
+	}
+	level := "error"
+	if r.Kind == "panic" || r.Kind == "config" {
+		level = "fatal"
+	}
+	event := map[string]any{
+		"event_id":    eventID,
+		"timestamp":   r.Time.Format(time.RFC3339Nano),
+		"platform":    "other",
+		"level":       level,
+		"logger":      "shhoook",
+		"server_name": r.Host,
+		"release":     "shhoook@" + r.Version,
+		"message":     map[string]string{"formatted": r.Message},
+		"tags":        tags,
+		"extra":       extra,
+		"fingerprint": fingerprint,
+	}
+	if rp.environment != "" {
+		event["environment"] = rp.environment
+	}
+	var b bytes.Buffer
+	hdr, _ := json.Marshal(map[string]string{"event_id": eventID, "dsn": rp.sentryDSN, "sent_at": time.Now().UTC().Format(time.RFC3339Nano)})
+	ev, _ := json.Marshal(event)
+	b.Write(hdr)
+	b.WriteString("\n" + `{"type":"event"}` + "\n")
+	b.Write(ev)
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	b   []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.b = append(t.b, p...)
+	if over := len(t.b) - t.max; over > 0 {
+		t.b = append(t.b[:0], t.b[over:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return bytes.Clone(t.b)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// responseData is what a response_template sees.
+type responseData struct {
+	Status     int // the endpoint's success or error status
+	Ok         bool
+	ExitCode   int
+	TimedOut   bool
+	DurationMs int64
+	Output     string            // stdout and stderr interleaved
+	Truncated  bool              // Output was cut by max_output_bytes
+	OutputSize int64             // bytes produced, including cut ones
+	Params     map[string]string // merged params, computed ones included
+	Method     string
+	Path       string
+	Endpoint   string // uri template
+	Host       string
+	Query      map[string]string // first value of each query param
+	Header     http.Header       // {{.Header.Get "User-Agent"}}
+}
+
+var responseFuncs = template.FuncMap{
+	"json": errorFuncs["json"],
+	"trim": strings.TrimSpace,
+	// lines splits output into lines, without a trailing empty one
+	"lines": func(s string) []string {
+		s = strings.TrimSuffix(s, "\n")
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, "\n")
+	},
+}
+
+func compileResponseTemplate(src string) (*template.Template, error) {
+	return template.New("response").Funcs(responseFuncs).Parse(src)
+}
+
+// writeTemplated renders the endpoint's response_template for a
+// finished run, success or failure.
+func writeTemplated(w http.ResponseWriter, r *http.Request, ep *Endpoint, params map[string]string, res *runResult, out []byte) {
+	d := responseData{
+		Status:     ep.Status,
+		Ok:         res.err == nil,
+		ExitCode:   res.exitCode,
+		TimedOut:   res.timedOut,
+		DurationMs: res.duration.Milliseconds(),
+		Output:     string(out),
+		Truncated:  res.truncated,
+		OutputSize: res.outputBytes,
+		Params:     params,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Endpoint:   ep.URI,
+		Host:       r.Host,
+		Query:      map[string]string{},
+		Header:     r.Header,
+	}
+	if !d.Ok {
+		d.Status = ep.Error
+	}
+	for k, v := range r.URL.Query() {
+		d.Query[k] = v[0]
+	}
+	var buf bytes.Buffer
+	if err := ep.respTmpl.Execute(&buf, d); err != nil {
+		http.Error(w, "response template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType(ep, buf.Bytes()))
+	w.WriteHeader(d.Status)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// outputFile returns the path a response: "file" script writes to: the
+// expanded output_file, or a fresh temp file the caller removes.
+func outputFile(ep *Endpoint, params map[string]string) (string, error) {
+	if ep.OutputFile != "" {
+		p, _, err := expandToken(ep.OutputFile, params)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(p) {
+			return "", fmt.Errorf("%q is not an absolute path", p)
+		}
+		return filepath.Clean(p), nil
+	}
+	f, err := os.CreateTemp("", "shhoook-out-*")
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// sendFile answers with the file a script produced. The type comes from
+// content_type, else the file extension, else sniffing; the download
+// name is the file's base name unless response_headers sets one.
+func (s *server) sendFile(w http.ResponseWriter, r *http.Request, ep *Endpoint, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		s.fail(w, r, ep, errorData{Kind: "error", Status: http.StatusInternalServerError, Message: "output file: " + err.Error(), Output: "no output file\n"})
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		s.fail(w, r, ep, errorData{Kind: "error", Status: http.StatusInternalServerError, Message: "output file: not a regular file", Output: "no output file\n"})
+		return
+	}
+	h := w.Header()
+	switch {
+	case ep.ContentType != "" && ep.ContentType != "auto":
+		h.Set("Content-Type", ep.ContentType)
+	case mime.TypeByExtension(filepath.Ext(path)) != "":
+		h.Set("Content-Type", mime.TypeByExtension(filepath.Ext(path)))
+	}
+	if h.Get("Content-Disposition") == "" && ep.OutputFile != "" {
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)}))
+	} else if h.Get("Content-Disposition") == "" {
+		h.Set("Content-Disposition", "attachment")
+	}
+	// ServeContent sniffs when Content-Type is unset, and handles
+	// Range and HEAD
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// redirectTo answers a successful run with a 302 to the expanded
+// redirect URL. Param values are query-escaped.
+func (s *server) redirectTo(w http.ResponseWriter, r *http.Request, ep *Endpoint, params map[string]string) {
+	esc := make(map[string]string, len(params))
+	for k, v := range params {
+		esc[k] = url.QueryEscape(v)
+	}
+	loc, _, err := expandToken(ep.Redirect, esc)
+	if err != nil {
+		s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: "bad redirect: " + err.Error()})
+		return
+	}
+	http.Redirect(w, r, loc, http.StatusFound)
+}
+
+// responseHeaders expands the endpoint's response_headers with params.
+func responseHeaders(ep *Endpoint, params map[string]string) (http.Header, error) {
+	h := http.Header{}
+	for k, tmpl := range ep.RespHeaders {
+		v, _, err := expandToken(tmpl, params)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		h.Set(k, v)
+	}
+	return h, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// scriptReply is what a response: "result" script prints as the last
+// line of stdout (or after result_delimiter) to shape its response.
+type scriptReply struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"` // string: sent as is; other JSON: encoded; absent: the output before the result
+}
+
+// headers a script can't set: framing is up to the server
+var replyHopHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// parseReply splits stdout into the output before the result and the
+// result itself.
+func parseReply(stdout []byte, delim string) (out []byte, rep *scriptReply, err error) {
+	var raw []byte
+	if delim == "" {
+		trimmed := bytes.TrimRight(stdout, "\r\n\t ")
+		i := bytes.LastIndexByte(trimmed, '\n')
+		out, raw = trimmed[:i+1], trimmed[i+1:]
+	} else {
+		mark := []byte(delim + "\n")
+		i := bytes.LastIndex(stdout, mark)
+		if i < 0 || (i > 0 && stdout[i-1] != '\n') {
+			return nil, nil, fmt.Errorf("no %q line in output", delim)
+		}
+		out, raw = stdout[:i], stdout[i+len(mark):]
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, nil, errors.New("no result in output")
+	}
+	rep = &scriptReply{}
+	if err := json.Unmarshal(raw, rep); err != nil {
+		return nil, nil, fmt.Errorf("bad result: %v", err)
+	}
+	if rep.Status != 0 && (rep.Status < 200 || rep.Status > 599) {
+		return nil, nil, fmt.Errorf("bad result status %d", rep.Status)
+	}
+	for k, v := range rep.Headers {
+		if k == "" || strings.ContainsAny(k, " \t\r\n:") || strings.ContainsAny(v, "\r\n") {
+			return nil, nil, fmt.Errorf("bad result header %q", k)
+		}
+	}
+	return out, rep, nil
+}
+
+// writeReply answers with the response the script described. A run that
+// timed out, or failed without printing a result, gets the usual error
+// response; a successful run without a valid result is an error too.
+func (s *server) writeReply(w http.ResponseWriter, r *http.Request, ep *Endpoint, res *runResult, stdout, stderr []byte) {
+	out, rep, err := parseReply(stdout, ep.ResultDelim)
+	if res.timedOut || (err != nil && res.err != nil) {
+		s.writeOutput(w, r, ep, res, append(stdout[:len(stdout):len(stdout)], stderr...))
+		return
+	}
+	if err != nil {
+		s.fail(w, r, ep, errorData{Kind: "error", Status: ep.Error, Message: err.Error(), Output: string(append(stdout[:len(stdout):len(stdout)], stderr...))})
+		return
+	}
+	status := rep.Status
+	if status == 0 {
+		status = ep.Status
+		if res.err != nil {
+			status = ep.Error
+		}
+	}
+	var body []byte
+	ctype := ""
+	switch {
+	case len(rep.Body) == 0 || string(rep.Body) == "null":
+		body = out
+		ctype = contentType(ep, body)
+	case rep.Body[0] == '"':
+		var str string
+		_ = json.Unmarshal(rep.Body, &str)
+		body = []byte(str)
+		ctype = contentType(ep, body)
+	default:
+		body = append(rep.Body, '\n')
+		ctype = "application/json"
+	}
+	h := w.Header()
+	h.Set("Content-Type", ctype)
+	for k, v := range rep.Headers {
+		if k = http.CanonicalHeaderKey(k); !replyHopHeaders[k] {
+			h.Set(k, v)
+		}
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type segKind int
+
+const (
+	segStatic segKind = iota
+	segParam          // :name — one non-empty segment
+	segWild           // *name — the rest of the path, must be last
+)
+
+type uriSeg struct {
+	kind segKind
+	text string // literal for static, param name otherwise
+}
+
+// parseURI splits a "/run/:name/*rest" template into segments.
+// Empty segments are ignored.
+func parseURI(pattern string) ([]uriSeg, error) {
+	parts := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	var segs []uriSeg
+	for i, s := range parts {
+		switch {
+		case s == "":
+			continue
+		case strings.HasPrefix(s, ":"):
+			segs = append(segs, uriSeg{segParam, s[1:]})
+		case strings.HasPrefix(s, "*"):
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("wildcard must be last")
+			}
+			segs = append(segs, uriSeg{segWild, s[1:]})
+		default:
+			segs = append(segs, uriSeg{segStatic, s})
+		}
+	}
+	return segs, nil
+}
+
+// router is a segment trie over all endpoints. A lookup walks static,
+// param and wildcard branches at once and returns every endpoint whose
+// path matches, in the global specificity order; method, host and
+// listener are checked by the caller.
+type router struct {
+	root  *rnode
+	order map[*Endpoint]int
+}
+
+type rnode struct {
+	static map[string]*rnode
+	param  *rnode
+	here   []*Endpoint // templates ending at this node
+	wild   []*Endpoint // templates with *rest after this node
+}
+
+type routeMatch struct {
+	ep   *Endpoint
+	vars map[string]string
+}
+
+// newRouter builds the trie; eps must already be sorted by moreSpecific.
+func newRouter(eps []*Endpoint) *router {
+	rt := &router{root: &rnode{}, order: map[*Endpoint]int{}}
+	for i, ep := range eps {
+		rt.order[ep] = i
+		n := rt.root
+		for _, sg := range ep.segs {
+			switch sg.kind {
+			case segStatic:
+				if n.static == nil {
+					n.static = map[string]*rnode{}
+				}
+				if n.static[sg.text] == nil {
+					n.static[sg.text] = &rnode{}
+				}
+				n = n.static[sg.text]
+			case segParam:
+				if n.param == nil {
+					n.param = &rnode{}
+				}
+				n = n.param
+			case segWild:
+				n.wild = append(n.wild, ep)
+			}
+		}
+		if len(ep.segs) == 0 || ep.segs[len(ep.segs)-1].kind != segWild {
+			n.here = append(n.here, ep)
+		}
+	}
+	return rt
+}
+
+// match returns the endpoints whose template matches path.
+func (rt *router) match(path string) []routeMatch {
+	if !strings.HasPrefix(path, "/") {
+		return nil
+	}
+	parts := strings.Split(path[1:], "/")
+	var found []*Endpoint
+	var walk func(n *rnode, i int)
+	walk = func(n *rnode, i int) {
+		if len(parts) > i {
+			// *rest needs the slash after the prefix, rest may be empty
+			found = append(found, n.wild...)
+		}
+		if i == len(parts) {
+			found = append(found, n.here...)
+			return
+		}
+		if c := n.static[parts[i]]; c != nil {
+			walk(c, i+1)
+		}
+		if n.param != nil && parts[i] != "" {
+			walk(n.param, i+1)
+		}
+	}
+	walk(rt.root, 0)
+	sort.Slice(found, func(i, j int) bool { return rt.order[found[i]] < rt.order[found[j]] })
+
+	out := make([]routeMatch, 0, len(found))
+	for _, ep := range found {
+		vars := map[string]string{}
+		for i, sg := range ep.segs {
+			switch sg.kind {
+			case segParam:
+				vars[sg.text] = parts[i]
+			case segWild:
+				vars[sg.text] = strings.Join(parts[i:], "/")
+			}
+		}
+		out = append(out, routeMatch{ep, vars})
+	}
+	return out
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// runStats keeps a summary of every endpoint's script runs since start,
+// for /admin/stats: an overview without a metrics stack.
+type runStats struct {
+	mu    sync.Mutex
+	start time.Time
+	eps   map[*Endpoint]*endpointRuns
+}
+
+// runWindow is how many recent run times the percentiles are over.
+const runWindow = 1000
+
+type endpointRuns struct {
+	runs, success, errors, timeouts, canceled int
+	durations                                 []time.Duration // ring of the last runWindow
+	next                                      int
+	max                                       time.Duration
+	last                                      time.Time
+	lastError                                 *runError
+}
+
+// runError is the last failed run of an endpoint.
+type runError struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	ExitCode   int       `json:"exit_code"`
+	TimedOut   bool      `json:"timed_out,omitempty"`
+	FailedStep int       `json:"failed_step,omitempty"`
+	Error      string    `json:"error"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+var runHistory = &runStats{start: time.Now(), eps: map[*Endpoint]*endpointRuns{}}
+
+// record adds a finished run of ep.
+func (rs *runStats) record(ctx context.Context, ep *Endpoint, res *runResult, canceled bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	e := rs.eps[ep]
+	if e == nil {
+		e = &endpointRuns{}
+		rs.eps[ep] = e
+	}
+	e.runs++
+	e.last = time.Now()
+	switch {
+	case canceled:
+		e.canceled++
+	case res.timedOut:
+		e.timeouts++
+	case res.err != nil:
+		e.errors++
+	default:
+		e.success++
+	}
+	if !canceled && res.err != nil {
+		e.lastError = &runError{
+			Time:       e.last.UTC(),
+			RequestID:  requestID(ctx),
+			ExitCode:   res.exitCode,
+			TimedOut:   res.timedOut,
+			FailedStep: res.failedStep,
+			Error:      res.err.Error(),
+			DurationMs: res.duration.Milliseconds(),
+		}
+	}
+	if len(e.durations) < runWindow {
+		e.durations = append(e.durations, res.duration)
+	} else {
+		e.durations[e.next] = res.duration
+		e.next = (e.next + 1) % runWindow
+	}
+	e.max = max(e.max, res.duration)
+}
+
+// endpointSummary is one endpoint in /admin/stats.
+type endpointSummary struct {
+	Endpoint    string     `json:"endpoint"`
+	Method      string     `json:"method"`
+	Runs        int        `json:"runs"`
+	Success     int        `json:"success"`
+	Errors      int        `json:"errors"`
+	Timeouts    int        `json:"timeouts"`
+	Canceled    int        `json:"canceled"`
+	SuccessRate *float64   `json:"success_rate"` // of runs that ended by themselves; null before any
+	P50Ms       *int64     `json:"p50_ms"`
+	P95Ms       *int64     `json:"p95_ms"`
+	MaxMs       *int64     `json:"max_ms"`
+	LastRun     *time.Time `json:"last_run"`
+	LastError   *runError  `json:"last_error"`
+}
+
+type statsReport struct {
+	Since     time.Time         `json:"since"`
+	Window    int               `json:"window"` // runs p50/p95 are over, at most
+	Endpoints []endpointSummary `json:"endpoints"`
+}
+
+// summary reports on eps, in that order.
+func (rs *runStats) summary(eps []*Endpoint) statsReport {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rep := statsReport{Since: rs.start.UTC(), Window: runWindow, Endpoints: []endpointSummary{}}
+	for _, ep := range eps {
+		if ep.Type != "" {
+			continue // proxy and static endpoints run nothing
+		}
+		sum := endpointSummary{Endpoint: ep.URI, Method: ep.Method}
+		if e := rs.eps[ep]; e != nil {
+			sum.Runs, sum.Success, sum.Errors, sum.Timeouts, sum.Canceled = e.runs, e.success, e.errors, e.timeouts, e.canceled
+			if ended := e.success + e.errors + e.timeouts; ended > 0 {
+				rate := float64(e.success) / float64(ended)
+				sum.SuccessRate = &rate
+			}
+			d := slices.Clone(e.durations)
+			slices.Sort(d)
+			sum.P50Ms, sum.P95Ms = percentileMs(d, 50), percentileMs(d, 95)
+			maxMs := e.max.Milliseconds()
+			sum.MaxMs = &maxMs
+			last := e.last.UTC()
+			sum.LastRun, sum.LastError = &last, e.lastError
+		}
+		rep.Endpoints = append(rep.Endpoints, sum)
+	}
+	return rep
+}
+
+// percentileMs is the nearest-rank p-th percentile of sorted d.
+func percentileMs(d []time.Duration, p int) *int64 {
+	if len(d) == 0 {
+		return nil
+	}
+	i := (len(d)*p + 99) / 100
+	ms := d[max(i, 1)-1].Milliseconds()
+	return &ms
+}
+
+// serveStats answers /admin/stats.
+func (s *server) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		s.fail(w, r, nil, errorData{Kind: "method_not_allowed", Status: http.StatusMethodNotAllowed, Message: "method not allowed"})
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, runHistory.summary(s.eps))
+}
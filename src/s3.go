@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Store puts objects into an S3-compatible bucket (AWS, MinIO, ...)
+// with path-style URLs and a hand-rolled SigV4 signature.
+type s3Store struct {
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// uploadConfig is an endpoint's "upload" section.
+type uploadConfig struct {
+	Bucket    string            `json:"bucket"`
+	Key       string            `json:"key"`       // object key of the output, with {placeholders}
+	Artifacts map[string]string `json:"artifacts"` // object key -> file path, both with {placeholders}
+}
+
+// uploadResult reports one stored object.
+type uploadResult struct {
+	Key   string `json:"key"`
+	URL   string `json:"url,omitempty"`
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+// newS3Store reads S3_* settings; nil if S3_ENDPOINT is not set.
+func newS3Store() (*s3Store, error) {
+	ep := getenv("S3_ENDPOINT", "")
+	if ep == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(strings.TrimRight(ep, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("want an http(s) url, got %q", ep)
+	}
+	st := &s3Store{
+		endpoint:  u,
+		region:    getenv("S3_REGION", "us-east-1"),
+		accessKey: getenv("S3_ACCESS_KEY", ""),
+		secretKey: getenv("S3_SECRET_KEY", ""),
+		client:    &http.Client{Timeout: getduration("S3_TIMEOUT", "60s")},
+	}
+	if st.accessKey == "" || st.secretKey == "" {
+		return nil, fmt.Errorf("S3_ACCESS_KEY and S3_SECRET_KEY are required")
+	}
+	return st, nil
+}
+
+// objectURL is the path-style URL of bucket/key.
+func (st *s3Store) objectURL(bucket, key string) string {
+	return st.endpoint.String() + "/" + s3Escape(bucket) + "/" + s3Escape(key)
+}
+
+// put uploads body (size bytes, SHA-256 sum) and returns the object URL.
+func (st *s3Store) put(ctx context.Context, bucket, key string, body io.Reader, size int64, sum []byte) (string, error) {
+	u := st.objectURL(bucket, key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, body)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	st.sign(req, hex.EncodeToString(sum), time.Now().UTC())
+	resp, err := st.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return u, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header.
+func (st *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(signed))
+	for k := range signed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + signed[k] + "\n")
+	}
+	signedNames := strings.Join(names, ";")
+	canon := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signedNames,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + st.region + "/s3/aws4_request"
+	h := sha256.Sum256([]byte(canon))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	k := hmacSHA256([]byte("AWS4"+st.secretKey), day)
+	k = hmacSHA256(k, st.region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+st.accessKey+"/"+scope+", SignedHeaders="+signedNames+", Signature="+sig)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// s3Escape percent-encodes a key the way SigV4 expects: everything but
+// unreserved characters and "/".
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// putFile uploads a file, hashing it first (SigV4 signs the payload).
+func (st *s3Store) putFile(ctx context.Context, bucket, key, path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	u, err := st.put(ctx, bucket, key, f, size, h.Sum(nil))
+	return u, size, err
+}
+
+// upload stores the output and artifacts of a finished run as configured
+// by the endpoint, and reports the output URL in X-Upload-Url. Failures
+// are logged and reported, but don't change the response status: the
+// script has run either way.
+func (s *server) upload(ctx context.Context, h http.Header, ep *Endpoint, params map[string]string, res *runResult, out []byte) {
+	up := ep.Upload
+	// a client hanging up should not lose the log
+	ctx = context.WithoutCancel(ctx)
+	record := func(key string, size int64, u string, err error) {
+		r := uploadResult{Key: key, URL: u, Size: size}
+		if err != nil {
+			errorf(ctx, "upload %s %s: %s/%s: %v", ep.Method, ep.URI, up.Bucket, key, err)
+			r.URL, r.Error = "", err.Error()
+		}
+		res.uploads = append(res.uploads, r)
+	}
+	if up.Key != "" {
+		var u string
+		key, _, err := expandToken(up.Key, params)
+		if err == nil {
+			sum := sha256.Sum256(out)
+			u, err = s.s3.put(ctx, up.Bucket, key, bytes.NewReader(out), int64(len(out)), sum[:])
+		}
+		record(key, int64(len(out)), u, err)
+		if err == nil {
+			h.Set("X-Upload-Url", u)
+		}
+	}
+	keys := make([]string, 0, len(up.Artifacts))
+	for k := range up.Artifacts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		key, _, err := expandToken(k, params)
+		if err != nil {
+			record(k, 0, "", err)
+			continue
+		}
+		path, _, err := expandToken(up.Artifacts[k], params)
+		if err != nil {
+			record(key, 0, "", err)
+			continue
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue // the script didn't produce it, e.g. it failed early
+		}
+		u, size, err := s.s3.putFile(ctx, up.Bucket, key, path)
+		record(key, size, u, err)
+	}
+}
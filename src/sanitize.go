@@ -0,0 +1,90 @@
+package main
+
+import "io"
+
+// sanitizer drops ANSI escape sequences (CSI, OSC, two-byte escapes)
+// and control characters other than tab and newline from a byte
+// stream. A lone carriage return becomes a newline, CRLF becomes LF.
+// It keeps state between writes, so sequences split across writes are
+// still removed.
+type sanitizer struct {
+	w     io.Writer
+	state int
+	cr    bool // previous byte was \r
+}
+
+const (
+	sanNormal  = iota
+	sanEsc     // after ESC
+	sanCharset // ESC ( or ESC ): one more byte
+	sanCSI     // ESC [ ... final byte 0x40-0x7E
+	sanOSC     // ESC ] ... BEL or ESC \
+	sanOSCEsc  // ESC inside OSC
+)
+
+func (s *sanitizer) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for _, c := range p {
+		if s.cr {
+			s.cr = false
+			if c != '\n' {
+				out = append(out, '\n')
+			}
+		}
+		switch s.state {
+		case sanNormal:
+			switch {
+			case c == 0x1b:
+				s.state = sanEsc
+			case c == '\r':
+				s.cr = true
+			case c == '\n' || c == '\t' || c >= 0x20 && c != 0x7f:
+				out = append(out, c)
+			}
+		case sanEsc:
+			switch c {
+			case '[':
+				s.state = sanCSI
+			case ']':
+				s.state = sanOSC
+			case '(', ')':
+				s.state = sanCharset
+			default:
+				s.state = sanNormal
+			}
+		case sanCharset:
+			s.state = sanNormal
+		case sanCSI:
+			if c >= 0x40 && c <= 0x7e {
+				s.state = sanNormal
+			}
+		case sanOSC:
+			switch c {
+			case 0x07:
+				s.state = sanNormal
+			case 0x1b:
+				s.state = sanOSCEsc
+			}
+		case sanOSCEsc:
+			if c == '\\' {
+				s.state = sanNormal
+			} else {
+				s.state = sanOSC
+			}
+		}
+	}
+	if _, err := s.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// sanitizeWriters wraps stdout and stderr, keeping them one writer if
+// they were one (so their writes stay serialized).
+func sanitizeWriters(stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	so := &sanitizer{w: stdout}
+	if stdout == stderr {
+		return so, so
+	}
+	return so, &sanitizer{w: stderr}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cronSpec is a parsed five-field cron expression: minute, hour, day of
+// month, month, day of week. Each field is a bit set of allowed values.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// with both day fields restricted, either one matching is enough
+	domAny, dowAny bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+	dayNames   = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+)
+
+// parseCron parses "*/15 * * * *", "0 3 * * mon-fri", "@daily" and the
+// like, in the usual crontab syntax.
+func parseCron(expr string) (*cronSpec, error) {
+	if m, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = m
+	}
+	f := strings.Fields(expr)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("want 5 fields, got %d", len(f))
+	}
+	c := &cronSpec{domAny: f[2][0] == '*', dowAny: f[4][0] == '*'}
+	var err error
+	if c.minute, err = parseCronField(f[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if c.hour, err = parseCronField(f[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if c.dom, err = parseCronField(f[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if c.month, err = parseCronField(f[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if c.dow, err = parseCronField(f[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday too
+	}
+	return c, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges (a-b),
+// "*" and steps (*/n, a-b/n, a/n) into a bit set.
+func parseCronField(f string, lo, hi int, names map[string]int) (uint64, error) {
+	num := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < lo || n > hi {
+			return 0, fmt.Errorf("bad value %q", s)
+		}
+		return n, nil
+	}
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step %q", stepStr)
+			}
+			step = n
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = num(a); err != nil {
+				return 0, err
+			}
+			switch {
+			case isRange:
+				if to, err = num(b); err != nil {
+					return 0, err
+				}
+				if to < from {
+					return 0, fmt.Errorf("bad range %q", rng)
+				}
+			case !hasStep:
+				to = from
+			}
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first matching minute after t, in t's location; zero
+// if there is none within five years (e.g. "0 0 30 2 *").
+func (c *cronSpec) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// runSchedules fires every endpoint with a schedule until stop is
+// closed. The returned WaitGroup covers scheduled runs in progress.
+func (s *server) runSchedules(stop <-chan struct{}) *sync.WaitGroup {
+	runs := &sync.WaitGroup{}
+	for _, ep := range s.eps {
+		if ep.sched == nil {
+			continue
+		}
+		log.Printf("schedule %s %s: %q, next run %s", ep.Method, ep.URI, ep.Schedule, ep.sched.next(time.Now()).Format(time.RFC3339))
+		go func() {
+			for {
+				next := ep.sched.next(time.Now())
+				if next.IsZero() {
+					warnf(context.Background(), "schedule %s %s: %q never matches", ep.Method, ep.URI, ep.Schedule)
+					return
+				}
+				t := time.NewTimer(time.Until(next))
+				select {
+				case <-stop:
+					t.Stop()
+					return
+				case <-t.C:
+				}
+				// with a shared queue, one instance fires each tick
+				if s.shared != nil && !s.shared.lockTick(context.Background(), ep, next) {
+					continue
+				}
+				// a run that overlaps the next tick makes that tick skip
+				runs.Add(1)
+				s.runScheduled(ep)
+				runs.Done()
+			}
+		}()
+	}
+	return runs
+}
+
+// runScheduled runs ep once with its default params, as a job for async
+// endpoints. The result is logged under a fresh request ID.
+func (s *server) runScheduled(ep *Endpoint) {
+	ctx := context.WithValue(context.Background(), requestIDKey{}, newUUID())
+	defer recoverPanic(ctx, "schedule "+ep.Method+" "+ep.URI)
+	params := map[string]string{}
+	for _, m := range []map[string]string{ep.Query, ep.Body, ep.Cookies, ep.Headers} {
+		for k, v := range m {
+			params[k] = v
+		}
+	}
+	addBuiltins(params)
+	if err := applyComputed(ep, params); err != nil {
+		warnf(ctx, "schedule %s %s: bad computed param: %v", ep.Method, ep.URI, err)
+		return
+	}
+	sc, err := newScriptCmd(ctx, ep, params)
+	if err != nil {
+		warnf(ctx, "schedule %s %s: bad template: %v", ep.Method, ep.URI, err)
+		return
+	}
+	if !s.queue.admit(ep) {
+		warnf(ctx, "schedule %s %s: skipped, too many pending runs", ep.Method, ep.URI)
+		return
+	}
+	if ep.Async {
+		cb, err := callbackURL(ep, params, "")
+		if err != nil {
+			warnf(ctx, "schedule %s %s: %v", ep.Method, ep.URI, err)
+		}
+		j := s.startJob(ctx, ep, sc, params, nil, jobOptions{callback: cb})
+		logf(ctx, "schedule %s %s: started job %s", ep.Method, ep.URI, j.ID)
+		return
+	}
+	defer s.queue.release(ep)
+	sc.pool = s.queue
+	var out bytes.Buffer
+	res := runScript(ctx, ep, sc, &out, &out)
+	if ep.Upload != nil {
+		s.upload(ctx, http.Header{}, ep, params, res, out.Bytes())
+	}
+	if res.err != nil {
+		logAttrs(ctx, slog.LevelWarn, fmt.Sprintf("schedule %s %s: failed, exit code %d in %dms: %s", ep.Method, ep.URI, res.exitCode, res.duration.Milliseconds(), bytes.TrimSpace(tailLines(out.Bytes(), 5))), runAttrs(ep, res)...)
+		return
+	}
+	logAttrs(ctx, slog.LevelInfo, fmt.Sprintf("schedule %s %s: exit code 0 in %dms", ep.Method, ep.URI, res.duration.Milliseconds()), runAttrs(ep, res)...)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is the subset of JSON Schema used to validate request
+// bodies: type, enum, const, properties/required/additionalProperties,
+// items, string/number/array bounds, pattern and allOf/anyOf/oneOf/not.
+// $ref and format are not supported.
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Const                json.RawMessage        `json:"const"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	ExclusiveMinimum     *float64               `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64               `json:"exclusiveMaximum"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	AllOf                []*jsonSchema          `json:"allOf"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+	OneOf                []*jsonSchema          `json:"oneOf"`
+	Not                  *jsonSchema            `json:"not"`
+
+	// compiled
+	raw        json.RawMessage // the document as loaded, for /openapi.json
+	patternRe  *regexp.Regexp
+	noAdditnl  bool
+	additional *jsonSchema
+	constVal   any
+	hasConst   bool
+}
+
+// schemaTypes accepts "type": "string" as well as "type": ["string", "null"].
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return fmt.Errorf("type must be a string or array of strings")
+	}
+	*t = many
+	return nil
+}
+
+// loadSchema reads an endpoint "schema" value: either an inline schema
+// object or a path to a schema file, relative to the endpoint config.
+func loadSchema(raw json.RawMessage, confPath string) (*jsonSchema, error) {
+	var file string
+	if err := json.Unmarshal(raw, &file); err == nil {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(confPath), file)
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		raw = b
+	}
+	var s jsonSchema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+	s.raw = raw
+	return &s, nil
+}
+
+func (s *jsonSchema) compile() error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern: %v", err)
+		}
+		s.patternRe = re
+	}
+	if len(s.AdditionalProperties) > 0 {
+		var b bool
+		if err := json.Unmarshal(s.AdditionalProperties, &b); err == nil {
+			s.noAdditnl = !b
+		} else {
+			var sub jsonSchema
+			if err := json.Unmarshal(s.AdditionalProperties, &sub); err != nil {
+				return fmt.Errorf("additionalProperties: %v", err)
+			}
+			s.additional = &sub
+		}
+	}
+	if len(s.Const) > 0 {
+		var v any
+		if err := json.Unmarshal(s.Const, &v); err != nil {
+			return fmt.Errorf("const: %v", err)
+		}
+		s.constVal, s.hasConst = v, true
+	}
+	subs := []*jsonSchema{s.Items, s.Not, s.additional}
+	for _, p := range s.Properties {
+		subs = append(subs, p)
+	}
+	subs = append(subs, s.AllOf...)
+	subs = append(subs, s.AnyOf...)
+	subs = append(subs, s.OneOf...)
+	for _, sub := range subs {
+		if sub == nil {
+			continue
+		}
+		if err := sub.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate returns one message per violation; empty means valid.
+// Numbers are expected as json.Number or float64.
+func (s *jsonSchema) validate(v any, at string) []string {
+	var errs []string
+	fail := func(f string, a ...any) { errs = append(errs, at+": "+fmt.Sprintf(f, a...)) }
+
+	if len(s.Type) > 0 {
+		ok := false
+		for _, t := range s.Type {
+			ok = ok || schemaHasType(v, t)
+		}
+		if !ok {
+			fail("expected %s, got %s", strings.Join(s.Type, " or "), schemaTypeOf(v))
+			return errs
+		}
+	}
+	if len(s.Enum) > 0 {
+		ok := false
+		for _, e := range s.Enum {
+			ok = ok || schemaEqual(v, e)
+		}
+		if !ok {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if s.hasConst && !schemaEqual(v, s.constVal) {
+		fail("value does not match const")
+	}
+
+	switch t := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(t)
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("shorter than %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("longer than %d characters", *s.MaxLength)
+		}
+		if s.patternRe != nil && !s.patternRe.MatchString(t) {
+			fail("does not match pattern %q", s.Pattern)
+		}
+	case json.Number, float64:
+		f := schemaFloat(v)
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("must be >= %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			fail("must be <= %v", *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && f <= *s.ExclusiveMinimum {
+			fail("must be > %v", *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && f >= *s.ExclusiveMaximum {
+			fail("must be < %v", *s.ExclusiveMaximum)
+		}
+	case []any:
+		if s.MinItems != nil && len(t) < *s.MinItems {
+			fail("fewer than %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(t) > *s.MaxItems {
+			fail("more than %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, it := range t {
+				errs = append(errs, s.Items.validate(it, fmt.Sprintf("%s[%d]", at, i))...)
+			}
+		}
+	case map[string]any:
+		for _, k := range s.Required {
+			if _, ok := t[k]; !ok {
+				fail("missing required property %q", k)
+			}
+		}
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p, ok := s.Properties[k]; ok {
+				errs = append(errs, p.validate(t[k], at+"."+k)...)
+			} else if s.noAdditnl {
+				fail("unexpected property %q", k)
+			} else if s.additional != nil {
+				errs = append(errs, s.additional.validate(t[k], at+"."+k)...)
+			}
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		errs = append(errs, sub.validate(v, at)...)
+	}
+	if len(s.AnyOf) > 0 {
+		ok := false
+		for _, sub := range s.AnyOf {
+			ok = ok || len(sub.validate(v, at)) == 0
+		}
+		if !ok {
+			fail("does not match any of anyOf")
+		}
+	}
+	if len(s.OneOf) > 0 {
+		n := 0
+		for _, sub := range s.OneOf {
+			if len(sub.validate(v, at)) == 0 {
+				n++
+			}
+		}
+		if n != 1 {
+			fail("matches %d of oneOf, want exactly 1", n)
+		}
+	}
+	if s.Not != nil && len(s.Not.validate(v, at)) == 0 {
+		fail("must not match schema in not")
+	}
+	return errs
+}
+
+func schemaTypeOf(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number, float64:
+		f := schemaFloat(t)
+		if f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+func schemaHasType(v any, want string) bool {
+	got := schemaTypeOf(v)
+	return got == want || want == "number" && got == "integer"
+}
+
+func schemaFloat(v any) float64 {
+	switch t := v.(type) {
+	case json.Number:
+		f, _ := t.Float64()
+		return f
+	case float64:
+		return t
+	}
+	return math.NaN()
+}
+
+func schemaEqual(a, b any) bool {
+	if schemaTypeOf(a) == "integer" || schemaTypeOf(a) == "number" {
+		return schemaFloat(a) == schemaFloat(b)
+	}
+	ab, _ := json.Marshal(a)
+	bb, _ := json.Marshal(b)
+	return string(ab) == string(bb)
+}
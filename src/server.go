@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+type server struct {
+	eps       []*Endpoint
+	configSum string // sha256 of the endpoint configs, for /version
+	router    *router
+	basePath  string
+	errors    errorPages // global error bodies, ERROR_PAGES
+
+	// path normalization before matching
+	collapseSlashes bool // "/run//foo" → "/run/foo"
+	stripSlash      bool // "/run/foo/" → "/run/foo"
+	rawMatch        bool // match the still-escaped path, unescape vars after
+
+	// ADMIN_AUTH; /admin/* is not mounted when empty
+	adminHeader string
+	adminToken  string
+	pprof       bool          // PPROF=1: serve /admin/debug/pprof/
+	openAPI     bool          // OPENAPI=1: serve /openapi.json
+	health      *healthChecks // HEALTH_CHECKS; nil = /health just says ok
+	ready       *healthChecks // HEALTH_CHECKS /ready runs
+
+	metrics       bool // METRICS=1: serve /metrics
+	metricsHeader string
+	metricsToken  string     // METRICS_AUTH; "" = open
+	access        *accessLog // ACCESS_LOG; nil = off
+	maxBody       int64      // MAX_BODY_BYTES; 0 = no limit
+
+	resultsDir string    // RESULTS_DIR: spooled outputs, served under /results/
+	s3         *s3Store  // S3_ENDPOINT: where upload endpoints store output
+	jobs       *jobStore // async endpoints' jobs; nil if there are none
+	queue      *execQueue
+	shared     *sharedQueue // REDIS_URL: async jobs go through Redis
+
+	callbacks     *http.Client
+	callbackTries int
+
+	ws wsStreams // in progress, for shutdown to wait for
+}
+
+type listenerKey struct{}
+
+// withListener tags requests with the name of the listener they came in on.
+func withListener(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerKey{}, name)))
+	})
+}
+
+func listenerName(ctx context.Context) string {
+	name, _ := ctx.Value(listenerKey{}).(string)
+	return name
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	// health
+	mux.HandleFunc("/health", s.serveHealth)
+	mux.HandleFunc("/ready", s.serveReady)
+	mux.HandleFunc("/version", s.serveVersion)
+
+	if s.openAPI {
+		mux.HandleFunc("/openapi.json", s.serveOpenAPI)
+	}
+	if s.metrics {
+		mux.HandleFunc("/metrics", s.serveMetrics)
+	}
+	if s.resultsDir != "" {
+		mux.HandleFunc("/results/", s.serveResult)
+	}
+	if s.jobs != nil {
+		mux.HandleFunc("/jobs", s.listJobs)
+		mux.HandleFunc("/jobs/", s.serveJob)
+	}
+	if s.adminHeader != "" {
+		mux.HandleFunc("/admin/endpoints", s.admin(s.catalog))
+		mux.HandleFunc("/admin/log-level", s.admin(s.serveLogLevel))
+		mux.HandleFunc("/admin/stats", s.admin(s.serveStats))
+		if s.pprof {
+			mux.HandleFunc("/admin/debug/pprof/", s.admin(servePprof))
+		}
+	}
+
+	// single handler: we select the first matching ep by method and uri
+	mux.HandleFunc("/", s.serveEndpoint)
+
+	h := s.recoverPanics(s.normalize(mux))
+	if tracing != nil {
+		h = traceRequests(h)
+	}
+
+	// mount everything under BASE_PATH, stripped before matching
+	if s.basePath == "" {
+		return withRequestID(countRequests(h, s.access))
+	}
+	strip := http.StripPrefix(s.basePath, h)
+	return withRequestID(countRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, s.basePath+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		strip.ServeHTTP(w, r)
+	}), s.access))
+}
+
+// normalize rewrites the request path according to the server's
+// normalization options, working on the escaped form so %2F survives.
+func (s *server) normalize(h http.Handler) http.Handler {
+	if !s.collapseSlashes && !s.stripSlash {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.EscapedPath()
+		if s.collapseSlashes {
+			for strings.Contains(p, "//") {
+				p = strings.ReplaceAll(p, "//", "/")
+			}
+		}
+		if s.stripSlash && len(p) > 1 {
+			p = strings.TrimRight(p, "/")
+			if p == "" {
+				p = "/"
+			}
+		}
+		if p != r.URL.EscapedPath() {
+			dec, err := url.PathUnescape(p)
+			if err != nil {
+				http.Error(w, "bad path", http.StatusBadRequest)
+				return
+			}
+			r2 := new(http.Request)
+			*r2 = *r
+			u := *r.URL
+			u.Path, u.RawPath = dec, p
+			r2.URL = &u
+			r = r2
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// route finds the first endpoint matching the request. If none matches,
+// the endpoints matching only the path (with other methods) are returned.
+func (s *server) route(r *http.Request) (ep *Endpoint, pv map[string]string, others []*Endpoint) {
+	listener := listenerName(r.Context())
+	path := r.URL.Path
+	if s.rawMatch {
+		path = r.URL.EscapedPath()
+	}
+	for _, m := range s.router.match(path) {
+		e, vars := m.ep, m.vars
+		if !hostMatches(e, r.Host) || !e.servedOn(listener) {
+			continue
+		}
+		if s.rawMatch {
+			for k, v := range vars {
+				if dec, err := url.PathUnescape(v); err == nil {
+					vars[k] = dec
+				}
+			}
+		}
+		// HEAD is served by GET endpoints
+		if r.Method == e.Method || r.Method == http.MethodHead && e.Method == http.MethodGet {
+			return e, vars, nil
+		}
+		others = append(others, e)
+	}
+	return nil, nil, others
+}
+
+// allowedMethods lists the methods of eps, sorted and deduplicated.
+func allowedMethods(eps []*Endpoint) []string {
+	var out []string
+	for _, e := range eps {
+		out = append(out, e.Method)
+		if e.Method == http.MethodGet {
+			out = append(out, http.MethodHead)
+		}
+	}
+	sort.Strings(out)
+	return slices.Compact(out)
+}
+
+func (s *server) serveEndpoint(w http.ResponseWriter, r *http.Request) {
+	ep, pv, others := s.route(r)
+	if ep == nil {
+		if len(others) == 0 {
+			s.fail(w, r, nil, errorData{Kind: "not_found", Status: http.StatusNotFound, Message: "404 page not found"})
+			return
+		}
+		allowed := allowedMethods(others)
+		if r.Method == http.MethodOptions {
+			serveOptions(w, r, others, allowed)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		s.fail(w, r, nil, errorData{Kind: "method_not_allowed", Status: http.StatusMethodNotAllowed, Message: "method not allowed"})
+		return
+	}
+	tagEndpoint(r.Context(), ep)
+	traceRoute(r.Context(), ep)
+	setCORS(w, r, ep)
+	if ep.Compress && ep.Stream != "websocket" && r.Method != http.MethodHead {
+		if enc := acceptedEncoding(r); enc != "" {
+			cw := newCompressWriter(w, enc, ep.CompressMin)
+			defer cw.close()
+			w = cw
+		}
+	}
+	// auth; browsers can only pass a WebSocket token as a subprotocol.
+	// Endpoints without auth check a signature once the body is read.
+	if ep.token != "" {
+		tok := r.Header.Get(ep.header)
+		if tok == "" && ep.Stream == "websocket" {
+			tok = wsToken(r)
+		}
+		name, ok := ep.checkToken(tok)
+		if !ok {
+			s.fail(w, r, ep, errorData{Kind: "unauthorized", Status: http.StatusUnauthorized, Message: "unauthorized"})
+			return
+		}
+		tagToken(r.Context(), name)
+	}
+	if ep.Stream == "websocket" {
+		if !isWebSocket(r) {
+			w.Header().Set("Upgrade", "websocket")
+			s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusUpgradeRequired, Message: "websocket upgrade required"})
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && len(ep.CORS) > 0 && !corsAllowed(ep, origin) {
+			s.fail(w, r, ep, errorData{Kind: "unauthorized", Status: http.StatusForbidden, Message: "origin not allowed"})
+			return
+		}
+	}
+	if ep.Type == "static" {
+		s.serveStatic(w, r, ep, pv)
+		return
+	}
+	if r.Method == http.MethodHead && ep.Head == "skip" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	// params
+	body, err := readBody(ep, w, r, s.maxBody)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("body over %d bytes", tooLarge.Limit)})
+		return
+	}
+	if err != nil {
+		s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: "bad body: " + err.Error()})
+		return
+	}
+	if err := verifyDelivery(ep, r, body.wire); err != nil {
+		debugf(r.Context(), "%s %s: %v", ep.Method, ep.URI, err)
+		s.fail(w, r, ep, errorData{Kind: "unauthorized", Status: http.StatusUnauthorized, Message: "unauthorized"})
+		return
+	}
+	if err := body.decode(ep, r); err != nil {
+		s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: "bad body: " + err.Error()})
+		return
+	}
+	delivered, skip := checkDelivery(ep, r, body)
+	if skip != "" {
+		s.skipDelivery(w, r, ep, skip)
+		return
+	}
+	if items, ok := body.data.([]any); ok && ep.Batch > 0 && body.format == "json" {
+		s.serveBatch(w, r, ep, pv, items, delivered)
+		return
+	}
+	if ep.schema != nil {
+		if errs := ep.schema.validate(body.data, "body"); len(errs) > 0 {
+			s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusUnprocessableEntity, Message: strings.Join(errs, "\n")})
+			return
+		}
+	}
+	if src, ok := ep.filter.(alertSource); ok && src.perAlert() {
+		s.serveAlerts(w, r, ep, src, pv, body, delivered)
+		return
+	}
+	var opts jobOptions
+	if ep.Async {
+		if opts.delay, err = requestDelay(r, ep); err != nil {
+			s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+	}
+	params, err := mergeParams(ep, pv, r, body)
+	if err != nil {
+		s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
+	maps.Copy(params, delivered)
+	addBuiltins(params)
+	// temp files go with the request, or with the job for async endpoints
+	var tmp []string
+	defer func() {
+		for _, f := range tmp {
+			os.Remove(f)
+		}
+	}()
+	if ep.BodyTo == "file" {
+		f, err := os.CreateTemp("", "shhoook-body-*")
+		if err != nil {
+			s.fail(w, r, ep, errorData{Kind: "error", Status: http.StatusInternalServerError, Message: "body file: " + err.Error()})
+			return
+		}
+		tmp = append(tmp, f.Name())
+		_, werr := f.Write(body.raw)
+		if cerr := f.Close(); werr == nil {
+			werr = cerr
+		}
+		if werr != nil {
+			s.fail(w, r, ep, errorData{Kind: "error", Status: http.StatusInternalServerError, Message: "body file: " + werr.Error()})
+			return
+		}
+		params["__body_file"] = f.Name()
+	}
+	if err := applyComputed(ep, params); err != nil {
+		s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: "bad computed param: " + err.Error()})
+		return
+	}
+	hdrs, err := responseHeaders(ep, params)
+	if err != nil {
+		s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: "bad response header: " + err.Error()})
+		return
+	}
+	if ep.Type == "proxy" {
+		s.proxy(w, r, ep, params, body, hdrs)
+		return
+	}
+	for k, v := range hdrs {
+		w.Header()[k] = v
+	}
+	var outFile string
+	if ep.Response == "file" {
+		if outFile, err = outputFile(ep, params); err != nil {
+			s.fail(w, r, ep, errorData{Kind: "error", Status: http.StatusInternalServerError, Message: "output file: " + err.Error()})
+			return
+		}
+		if ep.OutputFile == "" {
+			defer os.Remove(outFile)
+		}
+		params["__output_file"] = outFile
+	}
+	sc, err := newScriptCmd(r.Context(), ep, params)
+	if err != nil {
+		s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: "bad template: " + err.Error()})
+		return
+	}
+	if outFile != "" {
+		sc.env = append(sc.env, "SHHOOOK_OUTPUT_FILE="+outFile)
+	}
+	if ep.BodyTo == "stdin" {
+		sc.stdin = bytes.NewReader(body.raw)
+	}
+	if ep.Async {
+		if opts.callback, err = callbackURL(ep, params, r.Header.Get("X-Callback-Url")); err != nil {
+			s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+	}
+	var dedupKey string
+	if ep.dedup != nil {
+		dedupKey = cacheKey(sc, body.raw)
+		if ep.Dedup.Key != "" {
+			if dedupKey, _, err = expandToken(ep.Dedup.Key, params); err != nil {
+				s.fail(w, r, ep, errorData{Kind: "bad_request", Status: http.StatusBadRequest, Message: "bad dedup key: " + err.Error()})
+				return
+			}
+		}
+	}
+	if ep.Async && ep.dedup != nil {
+		j, shared, err := ep.dedup.job(dedupKey, func() (*job, error) {
+			if !s.queue.admit(ep) {
+				return nil, errBusy
+			}
+			j := s.startJob(r.Context(), ep, sc, params, tmp, opts)
+			tmp = nil
+			return j, nil
+		})
+		if err != nil {
+			s.rejectBusy(w, r, ep)
+			return
+		}
+		if shared {
+			w.Header().Set("X-Deduplicated", "1")
+		}
+		s.writeAccepted(w, j)
+		return
+	}
+	if !s.queue.admit(ep) {
+		s.rejectBusy(w, r, ep)
+		return
+	}
+	if ep.Async {
+		// the job releases its slot when it is over, and waits for a
+		// worker itself so it shows as queued meanwhile
+		j := s.startJob(r.Context(), ep, sc, params, tmp, opts)
+		tmp = nil
+		s.writeAccepted(w, j)
+		return
+	}
+	defer s.queue.release(ep)
+	sc.pool = s.queue
+	switch {
+	case ep.Stream == "chunked":
+		streamOutput(w, r, ep, sc)
+		return
+	case ep.Stream == "sse":
+		streamSSE(w, r, ep, sc)
+		return
+	case ep.Stream == "websocket":
+		s.streamWebSocket(w, r, ep, sc)
+		return
+	case ep.Response == "json":
+		if e, done := runCached(w, r, ep, sc, body.raw, dedupKey); !done {
+			if ep.Upload != nil {
+				s.upload(r.Context(), w.Header(), ep, params, e.res, append(e.stdout[:len(e.stdout):len(e.stdout)], e.stderr...))
+			}
+			writeResult(w, ep, e.res, e.stdout, e.stderr)
+		}
+		return
+	case ep.Response == "result":
+		if e, done := runCached(w, r, ep, sc, body.raw, dedupKey); !done {
+			s.writeReply(w, r, ep, e.res, e.stdout, e.stderr)
+		}
+		return
+	}
+	if ep.SpoolBytes > 0 && s.resultsDir != "" && ep.respTmpl == nil && outFile == "" {
+		sp := &spoolWriter{dir: s.resultsDir, limit: ep.SpoolBytes}
+		res := runScript(r.Context(), ep, sc, sp, sp)
+		setResultHeaders(w.Header(), res)
+		if err := sp.finish(ep, res); err != nil {
+			errorf(r.Context(), "spool %s %s: %v", ep.Method, ep.URI, err)
+			s.fail(w, r, ep, errorData{Kind: "error", Status: http.StatusInternalServerError, Message: "spool: " + err.Error(), Output: "output too large, and storing it failed\n"})
+			return
+		}
+		if sp.spooled() {
+			s.writeSpooled(w, ep, res, sp)
+			return
+		}
+		s.writeOutput(w, r, ep, res, sp.buf.Bytes())
+		return
+	}
+	e, done := runCached(w, r, ep, sc, body.raw, dedupKey)
+	if !done && ep.Upload != nil {
+		s.upload(r.Context(), w.Header(), ep, params, e.res, e.out)
+	}
+	switch {
+	case done:
+	case ep.respTmpl != nil:
+		writeTemplated(w, r, ep, params, e.res, e.out)
+	case e.res.err == nil && outFile != "":
+		s.sendFile(w, r, ep, outFile)
+	case e.res.err == nil && ep.Redirect != "":
+		s.redirectTo(w, r, ep, params)
+	default:
+		s.writeOutput(w, r, ep, e.res, e.out)
+	}
+}
+
+// writeOutput answers with the script output as text: the success
+// status on success, the endpoint's error response otherwise.
+func (s *server) writeOutput(w http.ResponseWriter, r *http.Request, ep *Endpoint, res *runResult, out []byte) {
+	if res.truncated {
+		out = append(out[:len(out):len(out)], truncationMarker(res)...)
+	}
+	if res.err != nil {
+		// non-zero code/timeout → return ep.Error with the output body
+		msg := res.err.Error()
+		if res.timedOut {
+			msg = "timeout"
+		}
+		if res.failedStep > 0 {
+			msg = fmt.Sprintf("step %d (%s): %s", res.failedStep, res.steps[res.failedStep-1].Command, msg)
+		}
+		s.fail(w, r, ep, errorData{Kind: "error", Status: ep.Error, Message: msg, Output: string(out), Timeout: res.timedOut})
+		return
+	}
+	w.Header().Set("Content-Type", contentType(ep, out))
+	w.WriteHeader(ep.Status)
+	_, _ = w.Write(out)
+}
+
+// contentType picks the Content-Type of script output: the endpoint's
+// content_type, or with "auto" JSON if the output parses as JSON and
+// net/http's sniffing otherwise.
+func contentType(ep *Endpoint, out []byte) string {
+	switch ep.ContentType {
+	case "":
+		return "text/plain; charset=utf-8"
+	case "auto":
+		if len(bytes.TrimSpace(out)) > 0 && json.Valid(out) {
+			return "application/json"
+		}
+		return http.DetectContentType(out)
+	}
+	return ep.ContentType
+}
+
+// scriptResult is the body of response: "json" endpoints.
+type scriptResult struct {
+	ExitCode    int    `json:"exit_code"`
+	Stdout      string `json:"stdout"`
+	Stderr      string `json:"stderr"`
+	DurationMs  int64  `json:"duration_ms"`
+	TimedOut    bool   `json:"timed_out"`
+	Truncated   bool   `json:"truncated,omitempty"`
+	OutputBytes int64  `json:"output_bytes,omitempty"` // set when truncated
+
+	Steps      []stepResult `json:"steps,omitempty"`       // endpoints with steps
+	FailedStep int          `json:"failed_step,omitempty"` // 1-based
+
+	Uploads []uploadResult `json:"uploads,omitempty"` // endpoints with upload
+}
+
+// writeResult answers with the JSON envelope: the success status on
+// exit code 0, the endpoint's error status otherwise.
+func writeResult(w http.ResponseWriter, ep *Endpoint, res *runResult, stdout, stderr []byte) {
+	status := ep.Status
+	if res.err != nil {
+		status = ep.Error
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	v := scriptResult{
+		ExitCode:   res.exitCode,
+		Stdout:     string(stdout),
+		Stderr:     string(stderr),
+		DurationMs: res.duration.Milliseconds(),
+		TimedOut:   res.timedOut,
+		Truncated:  res.truncated,
+	}
+	if res.truncated {
+		v.OutputBytes = res.outputBytes
+	}
+	v.Steps, v.FailedStep = res.steps, res.failedStep
+	v.Uploads = res.uploads
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sharedQueue is the Redis-backed job queue several instances share
+// (REDIS_URL). An async request is stored and pushed to a list; any
+// instance claims it with a lease it keeps renewing while the script
+// runs. Jobs whose lease lapses, because their instance died, go back
+// to the queue: delivery is at least once, never twice while the owner
+// is alive.
+type sharedQueue struct {
+	r      *redisClient
+	prefix string
+	owner  string        // this instance in lease values
+	lease  time.Duration // how long a claim holds without renewal
+	keep   time.Duration // how long job records stay after the last update
+	slots  chan struct{} // claimed jobs run here at once
+}
+
+// sharedJob is what an instance needs to run a job another one accepted.
+type sharedJob struct {
+	Info jobInfo `json:"info"`
+	Run  jobRun  `json:"run"`
+}
+
+// the queue's atomic steps; "-- name" keeps them apart in MONITOR
+const (
+	claimScript = `-- claim
+local id = redis.call('RPOPLPUSH', KEYS[1], KEYS[2])
+if id then redis.call('SET', ARGV[1] .. id, ARGV[2], 'PX', ARGV[3]) end
+return id`
+	renewScript = `-- renew
+if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('PEXPIRE', KEYS[1], ARGV[2]) end
+return 0`
+	reapScript = `-- reap
+local n = 0
+for _, id in ipairs(redis.call('LRANGE', KEYS[2], 0, -1)) do
+  if redis.call('EXISTS', ARGV[1] .. id) == 0 then
+    redis.call('LREM', KEYS[2], 1, id)
+    redis.call('RPUSH', KEYS[1], id)
+    n = n + 1
+  end
+end
+return n`
+	// the job leaves processing with its lease, so reap can't requeue it
+	// in between; the output, if given, is stored in the same step
+	completeScript = `-- complete
+redis.call('LREM', KEYS[1], 1, ARGV[1])
+redis.call('DEL', KEYS[2], KEYS[3], KEYS[4])
+if #ARGV > 1 then redis.call('SET', KEYS[5], ARGV[2], 'PX', ARGV[3]) end
+return 1`
+)
+
+// sharedOutputMax is how much output, from the end, other instances can
+// read once a job is over.
+const sharedOutputMax = 1 << 20
+
+func newSharedQueue(r *redisClient, prefix string, lease, keep time.Duration, slots int) *sharedQueue {
+	host, _ := os.Hostname()
+	return &sharedQueue{
+		r:      r,
+		prefix: prefix,
+		owner:  fmt.Sprintf("%s:%d:%s", host, os.Getpid(), newUUID()[:8]),
+		lease:  lease,
+		keep:   keep,
+		slots:  make(chan struct{}, slots),
+	}
+}
+
+func (q *sharedQueue) key(k string) string { return q.prefix + k }
+
+func (q *sharedQueue) ping(ctx context.Context) error {
+	_, err := q.r.do(ctx, "PING")
+	return err
+}
+
+// enqueue stores j and pushes it to the queue.
+func (q *sharedQueue) enqueue(ctx context.Context, j *job, run jobRun) error {
+	b, _ := json.Marshal(sharedJob{Info: j.jobInfo, Run: run})
+	ms := q.keep.Milliseconds()
+	if _, err := q.r.do(ctx, "SET", q.key("run:"+j.ID), b, "PX", ms); err != nil {
+		return err
+	}
+	if err := q.publish(ctx, j.jobInfo); err != nil {
+		return err
+	}
+	_, err := q.r.do(ctx, "LPUSH", q.key("queue"), j.ID)
+	return err
+}
+
+// publish stores a job's record for every instance to see.
+func (q *sharedQueue) publish(ctx context.Context, info jobInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = q.r.do(ctx, "SET", q.key("job:"+info.ID), b, "PX", q.keep.Milliseconds())
+	return err
+}
+
+// info returns a job's record and, once it is over, its output; false
+// if Redis doesn't know the job.
+func (q *sharedQueue) info(ctx context.Context, id string) (jobInfo, []byte, bool) {
+	var info jobInfo
+	b, err := redisBytes(q.r.do(ctx, "GET", q.key("job:"+id)))
+	if err != nil || b == nil || json.Unmarshal(b, &info) != nil {
+		return info, nil, false
+	}
+	out, _ := redisBytes(q.r.do(ctx, "GET", q.key("out:"+id)))
+	return info, out, true
+}
+
+// claim takes the next job and a lease on it; "" if the queue is empty.
+func (q *sharedQueue) claim(ctx context.Context) (string, error) {
+	b, err := redisBytes(q.r.do(ctx, "EVAL", claimScript, 2, q.key("queue"), q.key("processing"), q.key("lease:"), q.owner, q.lease.Milliseconds()))
+	return string(b), err
+}
+
+// load reads the job a claim returned.
+func (q *sharedQueue) load(ctx context.Context, id string) (*sharedJob, error) {
+	b, err := redisBytes(q.r.do(ctx, "GET", q.key("run:"+id)))
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("job %s: no run record", id)
+	}
+	sj := &sharedJob{}
+	if err := json.Unmarshal(b, sj); err != nil {
+		return nil, fmt.Errorf("job %s: bad run record: %v", id, err)
+	}
+	return sj, nil
+}
+
+// renew extends the lease on id; false if it is no longer ours.
+func (q *sharedQueue) renew(ctx context.Context, id string) (bool, error) {
+	n, err := redisInt(q.r.do(ctx, "EVAL", renewScript, 1, q.key("lease:"+id), q.owner, q.lease.Milliseconds()))
+	return n == 1, err
+}
+
+// cancel asks whichever instance runs id to stop it.
+func (q *sharedQueue) cancel(ctx context.Context, id string) error {
+	_, err := q.r.do(ctx, "SET", q.key("cancel:"+id), "1", "PX", q.keep.Milliseconds())
+	return err
+}
+
+func (q *sharedQueue) canceled(ctx context.Context, id string) bool {
+	n, _ := redisInt(q.r.do(ctx, "EXISTS", q.key("cancel:"+id)))
+	return n == 1
+}
+
+// complete stores the output of a finished job and drops it from the
+// queue.
+func (q *sharedQueue) complete(ctx context.Context, id string, out []byte) error {
+	if len(out) > sharedOutputMax {
+		out = out[len(out)-sharedOutputMax:]
+	}
+	return q.finish(ctx, id, out, q.keep.Milliseconds())
+}
+
+// drop takes a job that can't run off the queue, leaving any output
+// stored for it alone: a job requeued after it finished elsewhere comes
+// back without a run record.
+func (q *sharedQueue) drop(ctx context.Context, id string) error {
+	return q.finish(ctx, id)
+}
+
+func (q *sharedQueue) finish(ctx context.Context, id string, out ...any) error {
+	args := []any{"EVAL", completeScript, 5, q.key("processing"), q.key("run:" + id), q.key("lease:" + id), q.key("cancel:" + id), q.key("out:" + id), id}
+	_, err := q.r.do(ctx, append(args, out...)...)
+	return err
+}
+
+// reap puts jobs whose lease lapsed back in the queue.
+func (q *sharedQueue) reap(ctx context.Context) (int64, error) {
+	return redisInt(q.r.do(ctx, "EVAL", reapScript, 2, q.key("queue"), q.key("processing"), q.key("lease:")))
+}
+
+// lockTick makes sure only one instance fires a schedule tick.
+func (q *sharedQueue) lockTick(ctx context.Context, ep *Endpoint, tick time.Time) bool {
+	k := q.key("tick:" + ep.Method + " " + ep.Host + ep.URI + ":" + strconv.FormatInt(tick.Unix(), 10))
+	reply, err := q.r.do(ctx, "SET", k, q.owner, "NX", "PX", (10 * time.Minute).Milliseconds())
+	if err != nil {
+		errorf(ctx, "schedule %s %s: redis: %v; running anyway", ep.Method, ep.URI, err)
+		return true
+	}
+	return reply != nil
+}
+
+// consume claims jobs from the shared queue while there is room, until
+// stop is closed, and puts lapsed ones back.
+func (s *server) consume(stop <-chan struct{}) {
+	q := s.shared
+	go func() {
+		t := time.NewTicker(q.lease)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+			if n, err := q.reap(context.Background()); err != nil {
+				errorf(context.Background(), "shared queue: reap: %v", err)
+			} else if n > 0 {
+				log.Printf("shared queue: %d jobs with a lapsed lease queued again", n)
+			}
+		}
+	}()
+	idle := time.NewTimer(0)
+	defer idle.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case q.slots <- struct{}{}:
+		}
+		id, err := q.claim(context.Background())
+		if err != nil || id == "" {
+			<-q.slots
+			if err != nil {
+				errorf(context.Background(), "shared queue: claim: %v", err)
+			}
+			idle.Reset(time.Second)
+			select {
+			case <-stop:
+				return
+			case <-idle.C:
+			}
+			continue
+		}
+		go func() {
+			defer func() { <-q.slots }()
+			defer recoverPanic(context.Background(), "shared job "+id)
+			s.runShared(id)
+		}()
+	}
+}
+
+// runShared runs a claimed job here, renewing its lease and watching for
+// a cancel from another instance until it is over.
+func (s *server) runShared(id string) {
+	q := s.shared
+	bg := context.Background()
+	sj, err := q.load(bg, id)
+	if err != nil {
+		errorf(bg, "shared queue: %v", err)
+		_ = q.drop(bg, id)
+		return
+	}
+	j := &job{jobInfo: sj.Info, out: s.jobs.newOutput(id)}
+	j.ServerPID = os.Getpid()
+	ctx := context.WithValue(bg, requestIDKey{}, j.RequestID)
+	j.ep = findEndpoint(s.eps, j.jobInfo)
+	sc, err := sj.Run.apply(j)
+	if j.ep == nil && err == nil {
+		err = fmt.Errorf("no endpoint %s %s here", j.Method, j.URI)
+	}
+	if err != nil {
+		now := time.Now().UTC()
+		j.State, j.Error, j.Finished = jobFailed, "can't run: "+err.Error(), &now
+		_ = q.publish(bg, j.jobInfo)
+		_ = q.drop(bg, id)
+		warnf(ctx, "job %s %s %s: can't run: %v", j.ID, j.Method, j.URI, err)
+		return
+	}
+	if j.ep.DeadLetter {
+		s.jobs.keepRun(j, sj.Run)
+	}
+	ctx, j.cancel = context.WithCancel(ctx)
+	s.jobs.add(j)
+	s.queue.take(j.ep)
+	s.jobs.running.Add(1)
+	logf(ctx, "job %s %s %s: claimed from the shared queue", j.ID, j.Method, j.URI)
+	if q.canceled(bg, id) {
+		s.jobs.cancel(j) // canceled while it waited in the queue
+	}
+
+	done := make(chan struct{})
+	// deferred, so a panicking run doesn't keep its lease alive
+	defer func() {
+		close(done)
+		if err := q.complete(bg, id, j.out.bytes()); err != nil {
+			errorf(ctx, "job %s: shared queue: %v", id, err)
+		}
+	}()
+	go func() {
+		t := time.NewTicker(q.lease / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			if ok, err := q.renew(bg, id); err == nil && !ok {
+				warnf(ctx, "job %s: lost the lease, stopping it", id)
+				s.jobs.cancel(j)
+				return
+			}
+			if q.canceled(bg, id) && s.jobs.cancel(j) {
+				logf(ctx, "job %s %s %s: cancel requested", j.ID, j.Method, j.URI)
+			}
+		}
+	}()
+	s.runJob(ctx, j, sc)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// slowNotice is POSTed to an endpoint's slow_notify URL when a run is
+// still going after its slow threshold.
+type slowNotice struct {
+	Event       string    `json:"event"` // "slow"
+	Endpoint    string    `json:"endpoint"`
+	Method      string    `json:"method"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Host        string    `json:"host"`
+	Started     time.Time `json:"started"`
+	ElapsedMs   int64     `json:"elapsed_ms"`
+	ThresholdMs int64     `json:"threshold_ms"`
+	TTLMs       int64     `json:"ttl_ms"`
+}
+
+// slowClient delivers slow notices; one try each.
+var slowClient = &http.Client{Timeout: 10 * time.Second}
+
+// slowRun reports a run of ep, started at start, that passed ep.slow:
+// a warning, a count in shhoook_slow_executions_total and, if set, a
+// notice to slow_notify. The run itself carries on.
+func slowRun(ctx context.Context, ep *Endpoint, start time.Time) {
+	elapsed := time.Since(start)
+	stats.add(mSlow, "", 1, "endpoint", ep.URI)
+	statsd.count("script.slow", 1, "endpoint", ep.URI)
+	warnf(ctx, "%s %s: still running after %s (slow: %s, ttl: %s)", ep.Method, ep.URI, elapsed.Round(time.Millisecond), ep.slow, ep.timeout)
+	if ep.SlowNotify == "" {
+		return
+	}
+	host, _ := os.Hostname()
+	body, _ := json.Marshal(slowNotice{
+		Event:       "slow",
+		Endpoint:    ep.URI,
+		Method:      ep.Method,
+		RequestID:   requestID(ctx),
+		Host:        host,
+		Started:     start.UTC(),
+		ElapsedMs:   elapsed.Milliseconds(),
+		ThresholdMs: ep.slow.Milliseconds(),
+		TTLMs:       ep.timeout.Milliseconds(),
+	})
+	// the run may end before the notice is out
+	if err := postSlowNotice(context.WithoutCancel(ctx), ep.SlowNotify, body); err != nil {
+		warnf(ctx, "%s %s: slow notice: %v", ep.Method, ep.URI, err)
+	}
+}
+
+func postSlowNotice(ctx context.Context, u string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "shhoook")
+	if id := requestID(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	resp, err := slowClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
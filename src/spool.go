@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// spoolWriter keeps output in memory up to limit bytes, then moves it
+// to <dir>/<id>.log and keeps writing there.
+type spoolWriter struct {
+	dir   string
+	limit int
+	buf   bytes.Buffer
+	id    string
+	f     *os.File
+	size  int64
+	err   error // first write error on the file
+}
+
+func (s *spoolWriter) Write(p []byte) (int, error) {
+	s.size += int64(len(p))
+	if s.f == nil && s.buf.Len()+len(p) <= s.limit {
+		return s.buf.Write(p)
+	}
+	if s.f == nil && s.err == nil {
+		s.id = newUUID()
+		s.f, s.err = os.OpenFile(filepath.Join(s.dir, s.id+".log"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if s.err == nil {
+			_, s.err = s.f.Write(s.buf.Bytes())
+		}
+		s.buf.Reset()
+	}
+	if s.err == nil {
+		_, s.err = s.f.Write(p)
+	}
+	// the script must not fail because the spool did
+	return len(p), nil
+}
+
+// spooled reports whether output went to disk.
+func (s *spoolWriter) spooled() bool { return s.id != "" }
+
+// resultMeta is stored next to a spooled log, <id>.json.
+type resultMeta struct {
+	Method   string    `json:"method"`
+	URI      string    `json:"uri"`
+	Host     string    `json:"host,omitempty"`
+	Size     int64     `json:"size"`
+	ExitCode int       `json:"exit_code"`
+	Created  time.Time `json:"created"`
+}
+
+// finish closes the log and writes its metadata.
+func (s *spoolWriter) finish(ep *Endpoint, res *runResult) error {
+	if s.f == nil {
+		return s.err
+	}
+	if err := s.f.Close(); s.err == nil {
+		s.err = err
+	}
+	if s.err != nil {
+		os.Remove(s.f.Name())
+		return s.err
+	}
+	b, _ := json.Marshal(resultMeta{Method: ep.Method, URI: ep.URI, Host: ep.Host, Size: s.size, ExitCode: res.exitCode, Created: time.Now().UTC()})
+	return os.WriteFile(filepath.Join(s.dir, s.id+".json"), b, 0o600)
+}
+
+// writeSpooled answers with a short notice pointing at the stored log.
+func (s *server) writeSpooled(w http.ResponseWriter, ep *Endpoint, res *runResult, sp *spoolWriter) {
+	link := s.basePath + "/results/" + sp.id
+	status := ep.Status
+	if res.err != nil {
+		status = ep.Error
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Location", link)
+	w.Header().Set("X-Result-Id", sp.id)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "output is %d bytes, stored as result %s (exit code %d)\nGET %s\n", sp.size, sp.id, res.exitCode, link)
+}
+
+var resultID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// serveResult returns a spooled log. It takes the auth of the endpoint
+// that produced it (or ADMIN_AUTH).
+func (s *server) serveResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		s.fail(w, r, nil, errorData{Kind: "method_not_allowed", Status: http.StatusMethodNotAllowed, Message: "method not allowed"})
+		return
+	}
+	id := r.URL.Path[len("/results/"):]
+	notFound := errorData{Kind: "not_found", Status: http.StatusNotFound, Message: "404 page not found"}
+	if !resultID.MatchString(id) {
+		s.fail(w, r, nil, notFound)
+		return
+	}
+	b, err := os.ReadFile(filepath.Join(s.resultsDir, id+".json"))
+	if err != nil {
+		s.fail(w, r, nil, notFound)
+		return
+	}
+	var meta resultMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		s.fail(w, r, nil, notFound)
+		return
+	}
+	var ep *Endpoint
+	for _, e := range s.eps {
+		if e.Method == meta.Method && e.URI == meta.URI && e.Host == meta.Host {
+			ep = e
+			break
+		}
+	}
+	if !s.authorizedFor(r, ep) {
+		s.fail(w, r, nil, errorData{Kind: "unauthorized", Status: http.StatusUnauthorized, Message: "unauthorized"})
+		return
+	}
+	f, err := os.Open(filepath.Join(s.resultsDir, id+".log"))
+	if err != nil {
+		s.fail(w, r, nil, notFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Exit-Code", fmt.Sprint(meta.ExitCode))
+	http.ServeContent(w, r, "", meta.Created, f)
+}
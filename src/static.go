@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// serveStatic serves a file (or directory listing) from ep.Root. The
+// path below root is the value of the uri's *wildcard, or "/" if it has
+// none. Lookups go through os.Root, so neither ".." nor symlinks can
+// leave the directory; dotfiles are hidden.
+func (s *server) serveStatic(w http.ResponseWriter, r *http.Request, ep *Endpoint, pv map[string]string) {
+	rel := "/"
+	if n := len(ep.segs); n > 0 && ep.segs[n-1].kind == segWild {
+		rel = "/" + pv[ep.segs[n-1].text]
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") {
+			s.fail(w, r, ep, errorData{Kind: "not_found", Status: http.StatusNotFound, Message: "404 page not found"})
+			return
+		}
+	}
+	root, err := os.OpenRoot(ep.Root)
+	if err != nil {
+		s.fail(w, r, ep, errorData{Kind: "error", Status: http.StatusInternalServerError, Message: "static root unavailable"})
+		return
+	}
+	defer root.Close()
+	if name := strings.Trim(path.Clean(rel), "/"); name != "" {
+		if _, err := root.Stat(name); errors.Is(err, fs.ErrNotExist) {
+			s.fail(w, r, ep, errorData{Kind: "not_found", Status: http.StatusNotFound, Message: "404 page not found"})
+			return
+		}
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path, u.RawPath = rel, ""
+	r2.URL = &u
+	http.FileServerFS(noDotFS{root.FS()}).ServeHTTP(w, r2)
+}
+
+// noDotFS hides dotfiles from directory listings.
+type noDotFS struct{ fs.FS }
+
+func (f noDotFS) Open(name string) (fs.File, error) {
+	file, err := f.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := file.Stat(); err == nil && fi.IsDir() {
+		if d, ok := file.(fs.ReadDirFile); ok {
+			return noDotDir{d}, nil
+		}
+	}
+	return file, nil
+}
+
+type noDotDir struct{ fs.ReadDirFile }
+
+func (d noDotDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	es, err := d.ReadDirFile.ReadDir(n)
+	out := es[:0]
+	for _, e := range es {
+		if !strings.HasPrefix(e.Name(), ".") {
+			out = append(out, e)
+		}
+	}
+	return out, err
+}
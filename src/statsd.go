@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// statsdClient pushes the metrics /metrics serves to a StatsD or
+// DogStatsD agent (STATSD_ADDR), for pipelines that don't scrape.
+// Datagrams are filled up to statsdPacket and sent at least every
+// statsdEvery. A nil *statsdClient does nothing.
+type statsdClient struct {
+	conn   net.Conn
+	addr   string
+	prefix string   // STATSD_PREFIX, e.g. "shhoook."
+	dog    bool     // DogStatsD tags; plain StatsD puts tag values in the name
+	tags   []string // STATSD_TAGS, added to every metric (DogStatsD only)
+
+	mu   sync.Mutex
+	buf  []byte
+	stop chan struct{}
+	done chan struct{}
+}
+
+// statsd is nil unless STATSD_ADDR is set; like stats, it is shared by
+// everything that runs scripts.
+var statsd *statsdClient
+
+const (
+	statsdPacket = 1432 // fits an Ethernet MTU with IPv6 and UDP headers
+	statsdEvery  = time.Second
+)
+
+// newStatsd reads STATSD_ADDR: host:port over UDP, or unix:///path for a
+// datagram socket such as DogStatsD's.
+func newStatsd(addr, prefix, format, tags string) (*statsdClient, error) {
+	c := &statsdClient{addr: addr, prefix: prefix, stop: make(chan struct{}), done: make(chan struct{})}
+	switch format {
+	case "dogstatsd":
+		c.dog = true
+	case "statsd":
+	default:
+		return nil, fmt.Errorf("STATSD_FORMAT: want dogstatsd or statsd, got %q", format)
+	}
+	for _, t := range strings.Split(tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			c.tags = append(c.tags, tagEscaper.Replace(t))
+		}
+	}
+	var err error
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		c.conn, err = net.Dial("unixgram", path)
+	} else {
+		if _, _, err = net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("STATSD_ADDR: want host:port or unix:///path, got %q", addr)
+		}
+		c.conn, err = net.Dial("udp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("STATSD_ADDR: %v", err)
+	}
+	go c.run()
+	return c, nil
+}
+
+// count, gauge and timing send a metric; tags are name, value pairs like
+// the labels of metricSet.add.
+func (c *statsdClient) count(name string, v int, tags ...string) {
+	c.emit(name, strconv.Itoa(v), "c", tags)
+}
+
+func (c *statsdClient) gauge(name string, v float64, tags ...string) {
+	c.emit(name, strconv.FormatFloat(v, 'g', -1, 64), "g", tags)
+}
+
+func (c *statsdClient) timing(name string, d time.Duration, tags ...string) {
+	c.emit(name, strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', -1, 64), "ms", tags)
+}
+
+// tagEscaper keeps the separators of the line format out of tags.
+var tagEscaper = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+
+func (c *statsdClient) emit(name, value, typ string, tags []string) {
+	if c == nil {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(c.prefix + name)
+	if !c.dog {
+		// shhoook.requests.deploy_app.POST.200
+		for i := 1; i < len(tags); i += 2 {
+			b.WriteString("." + statsdName(tags[i]))
+		}
+	}
+	b.WriteString(":" + value + "|" + typ)
+	if c.dog {
+		sep := "|#"
+		for i := 0; i+1 < len(tags); i += 2 {
+			if tags[i+1] != "" {
+				b.WriteString(sep + tags[i] + ":" + tagEscaper.Replace(tags[i+1]))
+				sep = ","
+			}
+		}
+		for _, t := range c.tags {
+			b.WriteString(sep + t)
+			sep = ","
+		}
+	}
+	line := b.String()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.buf) > 0 && len(c.buf)+1+len(line) > statsdPacket {
+		c.send()
+	}
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, line...)
+}
+
+// statsdName makes a tag value one segment of a dotted metric name:
+// "/deploy/:app" is "deploy_app", "" is "none".
+func statsdName(v string) string {
+	b := []byte(strings.Trim(v, "/"))
+	for i, ch := range b {
+		if !('a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9' || ch == '-' || ch == '_') {
+			b[i] = '_'
+		}
+	}
+	s := strings.Trim(strings.ReplaceAll(string(b), "__", "_"), "_")
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// send writes out the buffer; c.mu is held. A missing agent only costs
+// the datagrams.
+func (c *statsdClient) send() {
+	if len(c.buf) == 0 {
+		return
+	}
+	if _, err := c.conn.Write(c.buf); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+		warnf(context.Background(), "statsd: %v", err)
+	}
+	c.buf = c.buf[:0]
+}
+
+func (c *statsdClient) run() {
+	defer close(c.done)
+	tick := time.NewTicker(statsdEvery)
+	defer tick.Stop()
+	for stopping := false; !stopping; {
+		select {
+		case <-tick.C:
+		case <-c.stop:
+			stopping = true
+		}
+		c.mu.Lock()
+		c.send()
+		c.mu.Unlock()
+	}
+}
+
+// shutdown sends what is buffered.
+func (c *statsdClient) shutdown() {
+	close(c.stop)
+	<-c.done
+	c.conn.Close()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// streamMode accepts "stream": true as well as a mode name.
+type streamMode string
+
+func (m *streamMode) UnmarshalJSON(b []byte) error {
+	switch string(b) {
+	case "true":
+		*m = "chunked"
+	case "false", "null":
+		*m = ""
+	default:
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return fmt.Errorf("stream: want true, false or a mode name")
+		}
+		*m = streamMode(s)
+	}
+	return nil
+}
+
+// flushWriter flushes the response after every write, so script output
+// reaches the caller as it is produced.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		err = f.rc.Flush()
+	}
+	return n, err
+}
+
+// streamOutput runs the script with its output sent as it is produced.
+// The status is sent before the script finishes, so the result is
+// reported in trailers, the headers setResultHeaders sets (and a
+// "(timeout)" line).
+func streamOutput(w http.ResponseWriter, r *http.Request, ep *Endpoint, sc *scriptCmd) {
+	h := w.Header()
+	h.Set("Content-Type", contentType(ep, nil))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("X-Accel-Buffering", "no") // nginx: don't buffer
+	h.Set("Trailer", "X-Exit-Code, X-Duration-Ms, X-Output-Truncated, X-Output-Bytes, X-Failed-Step")
+	w.WriteHeader(ep.Status)
+	fw := flushWriter{w, http.NewResponseController(w)}
+	_ = fw.rc.Flush()
+	res := runScript(r.Context(), ep, sc, fw, fw)
+	if res.truncated {
+		_, _ = io.WriteString(w, truncationMarker(res))
+	}
+	if res.timedOut {
+		_, _ = w.Write([]byte("\n(timeout)\n"))
+	}
+	setResultHeaders(h, res)
+}
+
+// lineWriter calls emit once per complete output line. Writers that
+// share mu never emit concurrently.
+type lineWriter struct {
+	mu   *sync.Mutex
+	emit func(line string) error
+	buf  []byte // incomplete last line
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := strings.TrimSuffix(string(l.buf[:i]), "\r")
+		l.buf = l.buf[i+1:]
+		if err := l.emit(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// close emits a last line without a trailing newline.
+func (l *lineWriter) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) > 0 {
+		_ = l.emit(string(l.buf))
+		l.buf = nil
+	}
+}
+
+// sseEvent writes one server-sent event; name "" is a plain message.
+func sseEvent(w io.Writer, rc *http.ResponseController, name, data string) error {
+	var b strings.Builder
+	if name != "" {
+		b.WriteString("event: " + name + "\n")
+	}
+	b.WriteString("data: " + data + "\n\n")
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// streamSSE runs the script as an event stream: stdout lines are
+// "message" events (PROGRESS: lines "progress" events), stderr lines
+// "stderr" events, and the final "exit" event carries {"exit_code": N,
+// "duration_ms": N, "timed_out": bool}.
+func streamSSE(w http.ResponseWriter, r *http.Request, ep *Endpoint, sc *scriptCmd) {
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(ep.Status)
+	rc := http.NewResponseController(w)
+	_ = rc.Flush()
+	mu := new(sync.Mutex)
+	var progress jobProgress
+	stdout := &lineWriter{mu: mu, emit: func(l string) error {
+		p, ok := parseProgress(l, progress)
+		if !ok {
+			return sseEvent(w, rc, "", l)
+		}
+		progress = p
+		b, _ := json.Marshal(p)
+		return sseEvent(w, rc, "progress", string(b))
+	}}
+	stderr := &lineWriter{mu: mu, emit: func(l string) error { return sseEvent(w, rc, "stderr", l) }}
+	res := runScript(r.Context(), ep, sc, stdout, stderr)
+	stdout.close()
+	stderr.close()
+	exit := map[string]any{"exit_code": res.exitCode, "duration_ms": res.duration.Milliseconds(), "timed_out": res.timedOut}
+	if res.truncated {
+		exit["truncated"], exit["output_bytes"] = true, res.outputBytes
+	}
+	if res.failedStep > 0 {
+		exit["failed_step"] = res.failedStep
+	}
+	b, _ := json.Marshal(exit)
+	_ = sseEvent(w, rc, "exit", string(b))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// retention limits for finished jobs and spooled results; 0 = none
+type retention struct {
+	jobsMaxAge      time.Duration
+	jobsMaxBytes    int64
+	resultsMaxAge   time.Duration
+	resultsMaxBytes int64
+}
+
+// sweeper prunes finished jobs and spooled results every interval.
+func (s *server) sweeper(interval time.Duration, ret retention) {
+	for range time.Tick(interval) {
+		if s.jobs != nil {
+			if n := s.jobs.sweep(ret.jobsMaxAge, ret.jobsMaxBytes); n > 0 {
+				log.Printf("sweep: removed %d jobs", n)
+			}
+		}
+		if s.resultsDir != "" {
+			if n := sweepResults(s.resultsDir, ret.resultsMaxAge, ret.resultsMaxBytes); n > 0 {
+				log.Printf("sweep: removed %d results", n)
+			}
+		}
+	}
+}
+
+// sweepResults deletes spooled results older than maxAge, then the
+// oldest ones until the rest add up to at most maxBytes.
+func sweepResults(dir string, maxAge time.Duration, maxBytes int64) int {
+	if maxAge <= 0 && maxBytes <= 0 {
+		return 0
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return 0
+	}
+	type stored struct {
+		id   string
+		meta resultMeta
+	}
+	var all []stored
+	var total int64
+	for _, f := range files {
+		id := strings.TrimSuffix(filepath.Base(f), ".json")
+		if !resultID.MatchString(id) {
+			continue
+		}
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var m resultMeta
+		if json.Unmarshal(b, &m) != nil {
+			continue
+		}
+		all = append(all, stored{id, m})
+		total += m.Size
+	}
+	sort.Slice(all, func(a, b int) bool { return all[a].meta.Created.Before(all[b].meta.Created) })
+	cutoff := time.Now().Add(-maxAge)
+	n := 0
+	for _, r := range all {
+		old := maxAge > 0 && r.meta.Created.Before(cutoff)
+		if !old && (maxBytes <= 0 || total <= maxBytes) {
+			break
+		}
+		os.Remove(filepath.Join(dir, r.id+".json"))
+		os.Remove(filepath.Join(dir, r.id+".log"))
+		total -= r.meta.Size
+		n++
+	}
+	return n
+}
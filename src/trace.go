@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracer exports spans as OTLP/HTTP JSON (OTEL_EXPORTER_OTLP_ENDPOINT):
+// one for every request and one for every script run, in the caller's
+// trace when it sent a traceparent.
+type tracer struct {
+	url     string
+	headers http.Header
+	service string
+	client  *http.Client
+
+	spans chan *span
+	flush chan chan struct{}
+}
+
+// tracing is nil unless an OTLP endpoint is set; like stats, it is
+// shared by everything that runs scripts.
+var tracing *tracer
+
+const (
+	traceBatch = 512             // spans per export
+	traceQueue = 4 * traceBatch  // finished spans waiting; more are dropped
+	traceEvery = 5 * time.Second // export at least this often
+)
+
+// OTLP span kinds
+const (
+	spanInternal = 1
+	spanServer   = 2
+)
+
+// span is one timed operation. A nil *span does nothing, so callers
+// don't need to check whether tracing is on.
+type span struct {
+	trace   [16]byte
+	id      [8]byte
+	parent  [8]byte // zero for a root span
+	sampled bool
+	name    string
+	kind    int
+	start   time.Time
+
+	mu     sync.Mutex
+	attrs  []otlpAttr
+	failed string // error status message; "" = unset
+	end    time.Time
+}
+
+type spanKey struct{}
+
+// newTracer reads the OTEL_* settings; nil if no endpoint is set.
+func newTracer() (*tracer, error) {
+	u := getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if u == "" {
+		if base := getenv("OTEL_EXPORTER_OTLP_ENDPOINT", ""); base != "" {
+			u = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if u == "" {
+		return nil, nil
+	}
+	if p := getenv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/json"); p != "http/json" {
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_PROTOCOL: only http/json is supported, got %q", p)
+	}
+	if pu, err := url.Parse(u); err != nil || pu.Host == "" {
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_ENDPOINT: bad url %q", u)
+	}
+	hdrs := http.Header{}
+	if v := getenv("OTEL_EXPORTER_OTLP_HEADERS", ""); v != "" {
+		for _, kv := range strings.Split(v, ",") {
+			k, val, ok := strings.Cut(kv, "=")
+			if !ok {
+				return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: want key=value,..., got %q", v)
+			}
+			k, _ = url.QueryUnescape(strings.TrimSpace(k))
+			val, _ = url.QueryUnescape(strings.TrimSpace(val))
+			hdrs.Set(k, val)
+		}
+	}
+	return &tracer{
+		url:     u,
+		headers: hdrs,
+		service: getenv("OTEL_SERVICE_NAME", "shhoook"),
+		client:  &http.Client{Timeout: getduration("OTEL_EXPORTER_OTLP_TIMEOUT", "10s")},
+		spans:   make(chan *span, traceQueue),
+		flush:   make(chan chan struct{}),
+	}, nil
+}
+
+// parseTraceparent reads a W3C traceparent header.
+func parseTraceparent(v string) (trace [16]byte, parent [8]byte, sampled, ok bool) {
+	parts := strings.Split(v, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+	flags, err1 := hex.DecodeString(parts[3])
+	_, err2 := hex.Decode(trace[:], []byte(parts[1]))
+	_, err3 := hex.Decode(parent[:], []byte(parts[2]))
+	if err1 != nil || err2 != nil || err3 != nil || trace == [16]byte{} || parent == [8]byte{} {
+		return
+	}
+	return trace, parent, flags[0]&1 == 1, true
+}
+
+// startSpan starts a span as a child of the one in ctx, if any; nil when
+// tracing is off.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracing == nil {
+		return ctx, nil
+	}
+	sp := &span{name: name, kind: kind, start: time.Now(), sampled: true}
+	if p, ok := ctx.Value(spanKey{}).(*span); ok {
+		sp.trace, sp.parent, sp.sampled = p.trace, p.id, p.sampled
+	} else {
+		_, _ = rand.Read(sp.trace[:])
+	}
+	_, _ = rand.Read(sp.id[:])
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+func spanFrom(ctx context.Context) *span {
+	sp, _ := ctx.Value(spanKey{}).(*span)
+	return sp
+}
+
+func (sp *span) set(k string, v any) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.attrs = append(sp.attrs, otlpAttr{Key: k, Value: otlpValue(v)})
+}
+
+func (sp *span) rename(name string) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.name = name
+}
+
+// fail sets the span's status to error.
+func (sp *span) fail(msg string) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.failed = msg
+}
+
+// finish ends the span and queues it for export, unless the caller's
+// trace isn't sampled.
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	sp.end = time.Now()
+	sp.mu.Unlock()
+	if !sp.sampled {
+		return
+	}
+	select {
+	case tracing.spans <- sp:
+	default: // the collector can't keep up; drop rather than block
+	}
+}
+
+// traceparent is the header value (and TRACEPARENT env var) that makes
+// the receiver's spans children of this one.
+func (sp *span) traceparent() string {
+	flags := "00"
+	if sp.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sp.trace[:]) + "-" + hex.EncodeToString(sp.id[:]) + "-" + flags
+}
+
+// traceRequests gives every request a server span, in the caller's
+// trace if it sent a valid traceparent.
+func traceRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if trace, parent, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanKey{}, &span{trace: trace, id: parent, sampled: sampled})
+		}
+		ctx, sp := startSpan(ctx, r.Method, spanServer)
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		sp.set("http.request.method", r.Method)
+		sp.set("url.path", r.URL.Path)
+		sp.set("client.address", ip)
+		sp.set("user_agent.original", r.UserAgent())
+		sp.set("shhoook.request_id", requestID(ctx))
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r.WithContext(ctx))
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		sp.set("http.response.status_code", status)
+		if status >= 500 {
+			sp.fail(http.StatusText(status))
+		}
+		sp.finish()
+	})
+}
+
+// traceRoute names the request's span after the endpoint it was routed to.
+func traceRoute(ctx context.Context, ep *Endpoint) {
+	if sp := spanFrom(ctx); sp != nil && sp.kind == spanServer {
+		sp.rename(ep.Method + " " + ep.URI)
+		sp.set("http.route", ep.URI)
+	}
+}
+
+// scriptSpan starts the span of one script run. Its arguments are given
+// as in the endpoint config, so param values stay out of the trace.
+func scriptSpan(ctx context.Context, ep *Endpoint, sc *scriptCmd) (context.Context, *span) {
+	name := filepath.Base(ep.Script[0])
+	ctx, sp := startSpan(ctx, "run "+name, spanInternal)
+	if sp != nil {
+		sp.set("shhoook.endpoint", ep.URI)
+		sp.set("process.executable.name", name)
+		sp.set("process.command_args", ep.Script)
+		if len(sc.steps) > 0 {
+			sp.set("shhoook.steps", len(sc.steps)+1)
+		}
+	}
+	return ctx, sp
+}
+
+// endScriptSpan records how the run went.
+func endScriptSpan(sp *span, res *runResult) {
+	if sp == nil {
+		return
+	}
+	sp.set("process.exit.code", res.exitCode)
+	sp.set("shhoook.timed_out", res.timedOut)
+	if res.failedStep > 0 {
+		sp.set("shhoook.failed_step", res.failedStep)
+	}
+	switch {
+	case res.timedOut:
+		sp.fail("timed out")
+	case res.err != nil:
+		sp.fail(fmt.Sprintf("exit code %d", res.exitCode))
+	}
+	sp.finish()
+}
+
+// export sends finished spans in batches, for good.
+func (t *tracer) export() {
+	tick := time.NewTicker(traceEvery)
+	defer tick.Stop()
+	var batch []*span
+	send := func() {
+		if len(batch) > 0 {
+			if err := t.post(batch); err != nil {
+				errorf(context.Background(), "tracing: export %d spans: %v", len(batch), err)
+			}
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case sp := <-t.spans:
+			if batch = append(batch, sp); len(batch) >= traceBatch {
+				send()
+			}
+		case <-tick.C:
+			send()
+		case done := <-t.flush:
+			for len(t.spans) > 0 && len(batch) < traceQueue {
+				batch = append(batch, <-t.spans)
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+// shutdown exports the spans still queued, waiting until ctx is done at
+// most.
+func (t *tracer) shutdown(ctx context.Context) {
+	done := make(chan struct{})
+	select {
+	case t.flush <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// OTLP/JSON, as far as it is used here
+type (
+	otlpAttr struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+	otlpSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         int        `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr `json:"attributes,omitempty"`
+		Status       struct {
+			Code    int    `json:"code,omitempty"` // 2 = error
+			Message string `json:"message,omitempty"`
+		} `json:"status"`
+	}
+)
+
+// otlpValue wraps v as an OTLP AnyValue.
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case []string:
+		vals := make([]map[string]any, len(v))
+		for i, s := range v {
+			vals[i] = otlpValue(s)
+		}
+		return map[string]any{"arrayValue": map[string]any{"values": vals}}
+	}
+	return map[string]any{"stringValue": fmt.Sprint(v)}
+}
+
+func (t *tracer) post(batch []*span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, sp := range batch {
+		sp.mu.Lock()
+		o := otlpSpan{
+			TraceID:    hex.EncodeToString(sp.trace[:]),
+			SpanID:     hex.EncodeToString(sp.id[:]),
+			Name:       sp.name,
+			Kind:       sp.kind,
+			Start:      strconv.FormatInt(sp.start.UnixNano(), 10),
+			End:        strconv.FormatInt(sp.end.UnixNano(), 10),
+			Attributes: sp.attrs,
+		}
+		if sp.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(sp.parent[:])
+		}
+		if sp.failed != "" {
+			o.Status.Code, o.Status.Message = 2, sp.failed
+		}
+		sp.mu.Unlock()
+		spans[i] = o
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpAttr{{Key: "service.name", Value: otlpValue(t.service)}}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "shhoook"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", t.url, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// handoffEnv carries the parent pid to a process started by upgrade, so
+// it can accept the inherited sockets and tell the parent to drain.
+const handoffEnv = "SHHOOOK_HANDOFF"
+
+// upgrade starts a fresh copy of the binary that inherits the listening
+// sockets, HTTP/3's UDP ones after the others (same LISTEN_FDS convention
+// as socket activation). The current process keeps serving until the new
+// one is up and sends it SIGTERM.
+func upgrade(listeners []listenSpec) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var names []string
+	add := func(l listenSpec, sock any) error {
+		fl, ok := sock.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %s cannot be handed off", l.name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("listener %s: %v", l.name, err)
+		}
+		files = append(files, f)
+		// unnamed listeners are named after their address again on the
+		// other side; addresses can't go into the ':'-separated list
+		name := l.name
+		if name == l.addr {
+			name = ""
+		}
+		names = append(names, name)
+		return nil
+	}
+	for _, l := range listeners {
+		if err := add(l, l.ln); err != nil {
+			return err
+		}
+	}
+	for _, l := range listeners {
+		if l.pc == nil {
+			continue
+		}
+		if err := add(l, l.pc); err != nil {
+			return err
+		}
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") && !strings.HasPrefix(kv, handoffEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		handoffEnv+"="+strconv.Itoa(os.Getpid()),
+	)
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() { _ = cmd.Wait() }()
+	return nil
+}
+
+// handedOff reports whether this process was started by upgrade.
+func handedOff() bool {
+	pid, err := strconv.Atoi(os.Getenv(handoffEnv))
+	return err == nil && pid == os.Getppid()
+}
+
+// releaseParent asks the process we took the sockets over from to drain
+// and exit. Called once our own servers are accepting.
+func releaseParent() {
+	if !handedOff() {
+		return
+	}
+	pid := os.Getppid()
+	os.Unsetenv(handoffEnv)
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		errorf(context.Background(), "handoff: signal parent %d: %v", pid, err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// set at build time: -ldflags "-X main.version=1.4.0 -X main.commit=..."
+var (
+	version   = "dev"
+	commit    string
+	buildDate string
+)
+
+// buildInfo is the /version body.
+type buildInfo struct {
+	Version   string     `json:"version"`
+	Commit    string     `json:"commit,omitempty"`
+	BuildDate string     `json:"build_date,omitempty"`
+	GoVersion string     `json:"go_version"`
+	Platform  string     `json:"platform"`
+	Config    configInfo `json:"config"`
+}
+
+// configInfo tells which endpoint configs are loaded: the same digest on
+// two instances means the same files.
+type configInfo struct {
+	Endpoints int    `json:"endpoints"`
+	SHA256    string `json:"sha256"`
+}
+
+// readBuildInfo is what this binary knows about itself; without -X flags
+// the commit and date come from the module's VCS stamp, if any.
+func readBuildInfo() buildInfo {
+	bi := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	if info, ok := debug.ReadBuildInfo(); ok && bi.Commit == "" {
+		dirty := false
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				bi.Commit = s.Value
+			case "vcs.time":
+				if bi.BuildDate == "" {
+					bi.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if dirty && bi.Commit != "" {
+			bi.Commit += "-dirty"
+		}
+	}
+	return bi
+}
+
+// configDigest hashes the endpoint configs in dir, the files loadEndpoints
+// reads, by path (relative to dir) and content.
+func configDigest(dir string) (string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.ToLower(filepath.Ext(p)) == ".json" {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	h := sha256.New()
+	for _, p := range files {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return "", err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.ToSlash(rel), len(b))
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// printVersion answers --version, with the configs in CONFIG_DIR if they
+// load.
+func printVersion() {
+	bi := readBuildInfo()
+	fmt.Printf("shhoook %s\n", bi.Version)
+	if bi.Commit != "" {
+		fmt.Printf("commit:     %s\n", bi.Commit)
+	}
+	if bi.BuildDate != "" {
+		fmt.Printf("built:      %s\n", bi.BuildDate)
+	}
+	fmt.Printf("go:         %s %s\n", bi.GoVersion, bi.Platform)
+	dir := getenv("CONFIG_DIR", "./conf")
+	eps, err := loadEndpoints(dir)
+	if err == nil {
+		var sum string
+		if sum, err = configDigest(dir); err == nil {
+			fmt.Printf("config:     %s: %d endpoints, sha256 %s\n", dir, len(eps), sum)
+			return
+		}
+	}
+	fmt.Printf("config:     %v\n", err)
+}
+
+// serveVersion answers /version.
+func (s *server) serveVersion(w http.ResponseWriter, r *http.Request) {
+	bi := readBuildInfo()
+	bi.Config = configInfo{Endpoints: len(s.eps), SHA256: s.configSum}
+	writeJSON(w, http.StatusOK, bi)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Forge-, registry- and alert-aware endpoints (github, registry,
+// grafana, ...) look at a delivery before anything runs: they verify
+// its signature, turn away events the endpoint doesn't want, and add what
+// they read from it to the params.
+
+// deliveryFilter is a forge, registry or alert block of an endpoint.
+type deliveryFilter interface {
+	validate() error
+	// check filters a delivery: skip is why it doesn't run the script,
+	// or "" with the params it brings
+	check(r *http.Request, body *requestBody) (params map[string]string, skip string)
+	params() []string // those check sets; globs for families ("alert_label_*")
+	// credential is where verify finds the delivery's proof: a header
+	// ("X-Hub-Signature-256") or a query parameter ("?token"); "" if the
+	// block checks none
+	credential() string
+	verify(r *http.Request, raw []byte) error
+}
+
+// deliveryFilterOf validates ep's delivery block; an endpoint has one at
+// most.
+func deliveryFilterOf(ep *Endpoint) (deliveryFilter, error) {
+	blocks := map[string]deliveryFilter{}
+	if ep.GitHub != nil {
+		blocks["github"] = ep.GitHub
+	}
+	if ep.GitLab != nil {
+		blocks["gitlab"] = ep.GitLab
+	}
+	if ep.Bitbucket != nil {
+		blocks["bitbucket"] = ep.Bitbucket
+	}
+	if ep.Registry != nil {
+		blocks["registry"] = ep.Registry
+	}
+	if ep.Alertmanager != nil {
+		blocks["alertmanager"] = ep.Alertmanager
+	}
+	if ep.Grafana != nil {
+		blocks["grafana"] = ep.Grafana
+	}
+	var f deliveryFilter
+	var names []string
+	for name, b := range blocks {
+		if err := b.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		f, names = b, append(names, name)
+	}
+	if len(names) > 1 {
+		slices.Sort(names)
+		return nil, fmt.Errorf("%s: one of them at most", strings.Join(names, ", "))
+	}
+	return f, nil
+}
+
+// deliveryCredential is where the endpoint's forge block finds the proof
+// of a delivery, "" if it checks none; an endpoint with one may leave out
+// auth.
+func deliveryCredential(ep *Endpoint) string {
+	if ep.filter == nil {
+		return ""
+	}
+	return ep.filter.credential()
+}
+
+// verifyDelivery checks the signature of the delivery, if the endpoint
+// asks for one.
+func verifyDelivery(ep *Endpoint, r *http.Request, raw []byte) error {
+	if deliveryCredential(ep) == "" {
+		return nil
+	}
+	return ep.filter.verify(r, raw)
+}
+
+// checkDelivery applies the endpoint's forge block, if any.
+func checkDelivery(ep *Endpoint, r *http.Request, body *requestBody) (params map[string]string, skip string) {
+	if ep.filter == nil {
+		return nil, ""
+	}
+	return ep.filter.check(r, body)
+}
+
+// deliveryParams names the params checkDelivery sets for ep.
+func deliveryParams(ep *Endpoint) []string {
+	if ep.filter == nil {
+		return nil
+	}
+	return ep.filter.params()
+}
+
+// verifyHMAC checks a signature header of the form sha256=<hex>, the
+// HMAC-SHA256 of the body with secret.
+func verifyHMAC(r *http.Request, header, secret string, raw []byte) error {
+	sig, ok := strings.CutPrefix(r.Header.Get(header), "sha256=")
+	got, err := hex.DecodeString(sig)
+	if !ok || err != nil {
+		return fmt.Errorf("missing or malformed %s", header)
+	}
+	if !hmac.Equal(got, hmacSHA256([]byte(secret), string(raw))) {
+		return fmt.Errorf("bad %s", header)
+	}
+	return nil
+}
+
+// skipDelivery answers a delivery the endpoint filtered out: 200, so the
+// sender neither retries nor marks the hook as failing.
+func (s *server) skipDelivery(w http.ResponseWriter, r *http.Request, ep *Endpoint, reason string) {
+	logf(r.Context(), "%s %s: skipped: %s", ep.Method, ep.URI, reason)
+	stats.add(mOutcomes, "", 1, "endpoint", ep.URI, "outcome", "skipped")
+	statsd.count("outcomes", 1, "endpoint", ep.URI, "outcome", "skipped")
+	w.Header().Set("X-Skipped", reason)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("skipped: " + reason + "\n"))
+}
+
+// deliveryPayload is the decoded JSON of a delivery; forges that post
+// forms put it in the payload field.
+func deliveryPayload(body *requestBody) any {
+	if m, ok := body.data.(map[string]any); ok && body.format == "form" {
+		var v any
+		if s, ok := m["payload"].(string); ok && json.Unmarshal([]byte(s), &v) == nil {
+			return v
+		}
+	}
+	return body.data
+}
+
+// jsonPath looks up a dotted path in decoded JSON: "repository.full_name",
+// "changes.0.ref.id". Anything but a string, number or bool is "".
+func jsonPath(v any, p string) string {
+	switch v = jsonValue(v, p); v.(type) {
+	case string, json.Number, bool, float64:
+		return toString(v)
+	}
+	return ""
+}
+
+// jsonValue is what a dotted path leads to in decoded JSON, nil if
+// nothing.
+func jsonValue(v any, p string) any {
+	for _, k := range strings.Split(p, ".") {
+		switch t := v.(type) {
+		case map[string]any:
+			v = t[k]
+		case []any:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil
+			}
+			v = t[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// matchAny reports whether v matches one of patterns, globs as in
+// path.Match; no patterns match anything.
+func matchAny(patterns []string, v string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPatterns reports the first bad glob among patterns.
+func checkPatterns(what string, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return fmt.Errorf("bad %s pattern %q", what, p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Just enough of RFC 6455 to push script output to a browser and take
+// a cancel message back: unfragmented text frames, ping/pong, close.
+
+const (
+	wsGUID         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsProtocol     = "shhoook" // subprotocol echoed back to browsers
+	wsMaxFrame     = 64 << 10  // client frames are only control messages
+	wsText         = 0x1
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+	wsCloseNormal  = 1000
+	wsCloseAway    = 1001
+	wsCloseTooBig  = 1009
+	wsWriteTimeout = 10 * time.Second
+)
+
+func isWebSocket(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsSubprotocols lists the Sec-WebSocket-Protocol values offered.
+func wsSubprotocols(r *http.Request) []string {
+	var out []string
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
+
+// wsToken returns the token a browser passed as a subprotocol. Browsers
+// can't set headers on a WebSocket, so dashboards connect with
+// new WebSocket(url, ["shhoook", token]).
+func wsToken(r *http.Request) string {
+	ps := wsSubprotocols(r)
+	if !slices.Contains(ps, wsProtocol) {
+		return ""
+	}
+	for _, p := range ps {
+		if p != wsProtocol {
+			return p
+		}
+	}
+	return ""
+}
+
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	mu   sync.Mutex // serializes frame writes
+}
+
+// wsUpgrade completes the handshake and takes over the connection.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("bad websocket handshake")
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	h := w.Header()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(sum[:]))
+	if slices.Contains(wsSubprotocols(r), wsProtocol) {
+		h.Set("Sec-WebSocket-Protocol", wsProtocol)
+	}
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{}) // no server read/write timeouts from here on
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hdr := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xFFFF:
+		hdr = append(hdr, 126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr = append(hdr, 127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.conn.Write(append(hdr, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *wsConn) writeJSON(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, b)
+}
+
+func (c *wsConn) close(code uint16) {
+	_ = c.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, code))
+	c.conn.Close()
+}
+
+// readFrame returns the next frame from the client, unmasked.
+func (c *wsConn) readFrame() (op byte, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(c.br, h[:]); err != nil {
+		return 0, nil, err
+	}
+	op = h[0] & 0x0F
+	n := uint64(h[1] & 0x7F)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > wsMaxFrame {
+		return 0, nil, errFrameTooBig
+	}
+	var mask [4]byte
+	if h[1]&0x80 != 0 {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+var errFrameTooBig = errors.New("websocket frame too big")
+
+// wsMessage is sent for every output line and once at the end.
+type wsMessage struct {
+	Type     string `json:"type"` // stdout, stderr or exit
+	Data     string `json:"data,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Duration *int64 `json:"duration_ms,omitempty"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+	Canceled bool   `json:"canceled,omitempty"`
+	// output beyond max_output_bytes was dropped
+	Truncated   bool  `json:"truncated,omitempty"`
+	OutputBytes int64 `json:"output_bytes,omitempty"`
+	FailedStep  int   `json:"failed_step,omitempty"`
+}
+
+// isCancel accepts "cancel" or {"type": "cancel"}.
+func isCancel(msg []byte) bool {
+	if strings.TrimSpace(string(msg)) == "cancel" {
+		return true
+	}
+	var m struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(msg, &m) == nil && m.Type == "cancel"
+}
+
+// wsStreams are the WebSocket streams in progress. Their connections
+// are hijacked, so http.Server.Shutdown doesn't wait for them.
+type wsStreams struct {
+	mu    sync.Mutex
+	conns map[*wsConn]*Endpoint
+	wg    sync.WaitGroup
+}
+
+func (t *wsStreams) add(c *wsConn, ep *Endpoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = map[*wsConn]*Endpoint{}
+	}
+	t.conns[c] = ep
+	t.wg.Add(1)
+}
+
+func (t *wsStreams) done(c *wsConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+	t.wg.Done()
+}
+
+// drain waits for the streams to end until ctx expires, then closes
+// those left with 1001 (going away) and waits for their scripts to be
+// killed, which takes at most kill_grace.
+func (t *wsStreams) drain(ctx context.Context) error {
+	err := waitGroup(ctx, &t.wg)
+	if err == nil {
+		return nil
+	}
+	var grace time.Duration
+	t.mu.Lock()
+	for c, ep := range t.conns {
+		c.close(wsCloseAway)
+		grace = max(grace, ep.killGrace)
+	}
+	t.mu.Unlock()
+	// the script's Wait gives up a second after the SIGKILL
+	killed, cancel := context.WithTimeout(context.Background(), grace+2*time.Second)
+	defer cancel()
+	_ = waitGroup(killed, &t.wg)
+	return err
+}
+
+// streamWebSocket runs the script with its output sent as WebSocket
+// messages. A "cancel" message from the client, or the client going
+// away, kills the script.
+func (s *server) streamWebSocket(w http.ResponseWriter, r *http.Request, ep *Endpoint, sc *scriptCmd) {
+	c, err := wsUpgrade(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.ws.add(c, ep)
+	defer s.ws.done(c)
+	// the request context ends when the handler returns; the script
+	// runs on its own, canceled by the client
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+	var canceled atomic.Bool
+	go func() {
+		defer cancel()
+		for {
+			op, payload, err := c.readFrame()
+			switch {
+			case errors.Is(err, errFrameTooBig):
+				c.close(wsCloseTooBig)
+				return
+			case err != nil:
+				return
+			case op == wsClose:
+				return
+			case op == wsPing:
+				_ = c.writeFrame(wsPong, payload)
+			case op == wsText && isCancel(payload):
+				canceled.Store(true)
+				return
+			}
+		}
+	}()
+
+	mu := new(sync.Mutex)
+	stdout := &lineWriter{mu: mu, emit: func(l string) error { return c.writeJSON(wsMessage{Type: "stdout", Data: l}) }}
+	stderr := &lineWriter{mu: mu, emit: func(l string) error { return c.writeJSON(wsMessage{Type: "stderr", Data: l}) }}
+	res := runScript(ctx, ep, sc, stdout, stderr)
+	stdout.close()
+	stderr.close()
+	ms := res.duration.Milliseconds()
+	exit := wsMessage{Type: "exit", ExitCode: &res.exitCode, Duration: &ms, TimedOut: res.timedOut, Canceled: canceled.Load(), FailedStep: res.failedStep}
+	if res.truncated {
+		exit.Truncated, exit.OutputBytes = true, res.outputBytes
+	}
+	_ = c.writeJSON(exit)
+	c.close(wsCloseNormal)
+}